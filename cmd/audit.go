@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/api"
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/spf13/cobra"
+)
+
+var auditSince string
+var auditUntil string
+var auditQuery audit.Query
+var auditJSON bool
+
+// parseTimeArg accepts RFC3339 or a duration before now, e.g. 2h.
+func parseTimeArg(arg string) (time.Time, error) {
+	if d, err := time.ParseDuration(arg); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time %s, expected RFC3339 or a duration", arg)
+	}
+	return t, nil
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show the audit log of the running daemon.",
+	Long: `Lists recorded config changes, image pulls, container changes, hook runs
+and self-update decisions, oldest first. --since and --until take an RFC3339
+time or a duration before now, e.g. 24h.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q := auditQuery
+		var err error
+		if auditSince != "" {
+			if q.Since, err = parseTimeArg(auditSince); err != nil {
+				return err
+			}
+		}
+		if auditUntil != "" {
+			if q.Until, err = parseTimeArg(auditUntil); err != nil {
+				return err
+			}
+		}
+		entries, err := api.NewClient(apiAddr).Audit(&q)
+		if err != nil {
+			return err
+		}
+		if auditJSON {
+			return printJSON(entries)
+		}
+		for _, e := range entries {
+			fields := []string{e.Time.Local().Format(time.RFC3339), e.Type, e.Outcome}
+			if e.Target != "" {
+				fields = append(fields, "target="+e.Target)
+			}
+			if e.Image != "" {
+				fields = append(fields, "image="+e.Image+":"+e.Tag)
+			}
+			if e.Container != "" {
+				fields = append(fields, "container="+e.Container)
+			}
+			if e.Message != "" {
+				fields = append(fields, e.Message)
+			}
+			fmt.Println(strings.Join(fields, " "))
+			if e.Diff != "" {
+				fmt.Print(e.Diff)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "only entries after this time")
+	auditCmd.Flags().StringVar(&auditUntil, "until", "", "only entries before this time")
+	auditCmd.Flags().StringVar(&auditQuery.Target, "target", "", "only entries of this target")
+	auditCmd.Flags().StringVar(&auditQuery.Type, "type", "", "only entries of this type")
+	auditCmd.Flags().IntVarP(&auditQuery.Limit, "limit", "n", 0, "number of most recent entries to show, 0 for all")
+	auditCmd.Flags().BoolVar(&auditJSON, "json", false, "print the entries as JSON")
+	RootCmd.AddCommand(auditCmd)
+}
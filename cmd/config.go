@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/fuserobotics/deviced/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var showConfigCmd = &cobra.Command{
+	Use:   "showconfig",
+	Short: "Show the running config, with variables rendered.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dat, err := api.NewClient(apiAddr).Config()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(dat)
+		return err
+	},
+}
+
+var factsCmd = &cobra.Command{
+	Use:   "facts",
+	Short: "Show the facts the running config was rendered with.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		facts, err := api.NewClient(apiAddr).Facts()
+		if err != nil {
+			return err
+		}
+		return printJSON(facts)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(showConfigCmd)
+	RootCmd.AddCommand(factsCmd)
+}
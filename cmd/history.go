@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/fuserobotics/deviced/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the config revisions applied by the running daemon.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		revs, err := api.NewClient(apiAddr).ConfigHistory()
+		if err != nil {
+			return err
+		}
+		return printJSON(revs)
+	},
+}
+
+var confirmCmd = &cobra.Command{
+	Use:   "confirm [version]",
+	Short: "Keep a config revision on trial, the newest by default.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("Expected at most one version")
+		}
+		version := 0
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return errors.New("Invalid version " + args[0])
+			}
+			version = n
+		}
+		rev, err := api.NewClient(apiAddr).ConfirmConfig(version)
+		if err != nil {
+			return err
+		}
+		return printJSON(rev)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+	RootCmd.AddCommand(confirmCmd)
+}
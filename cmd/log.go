@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var logLevelCmd = &cobra.Command{
+	Use:   "loglevel [level]",
+	Short: "Show or change the log level of the running daemon.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("Expected at most one level")
+		}
+		client := api.NewClient(apiAddr)
+		var level string
+		var err error
+		if len(args) == 1 {
+			level, err = client.SetLogLevel(args[0])
+		} else {
+			level, err = client.LogLevel()
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(level)
+		return nil
+	},
+}
+
+var daemonLogsCmd = &cobra.Command{
+	Use:   "daemonlogs",
+	Short: "Show recent log entries of the running daemon.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := api.NewClient(apiAddr).Logs()
+		if err != nil {
+			return err
+		}
+		return printJSON(entries)
+	},
+}
+
+var logsTail int
+var logsJSON bool
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <target>",
+	Short: "Show the collected output of a target's containers.",
+	Long: `Reads the output collected by the running daemon, see containerLogs in the config.
+Lines of all replicas and earlier containers of the target are included.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected arguments: <target>")
+		}
+		lines, err := api.NewClient(apiAddr).ContainerLogs(args[0], logsTail)
+		if err != nil {
+			return err
+		}
+		if logsJSON {
+			return printJSON(lines)
+		}
+		for _, jl := range lines {
+			fmt.Printf("%s %s %s", jl.Created.Local().Format(time.RFC3339), jl.Stream, jl.Log)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(logLevelCmd)
+	RootCmd.AddCommand(daemonLogsCmd)
+	logsCmd.Flags().IntVarP(&logsTail, "tail", "n", api.DefaultLogTail, "number of lines to show, 0 for all")
+	logsCmd.Flags().BoolVar(&logsJSON, "json", false, "print the lines as JSON")
+	RootCmd.AddCommand(logsCmd)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// promoteCmd moves a (usually prefetched) tag to the top of a target's versions.
+var promoteCmd = &cobra.Command{
+	Use:   "promote <target> <tag>",
+	Short: "Promote a tag to the preferred version of a target.",
+	Long: `Moves the tag to the front of the target's versions list and removes it from the prefetch list.
+The file defining the target is rewritten, and the running daemon switches to the tag on reload.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("Expected arguments: <target> <tag>")
+		}
+		targetId, tag := args[0], args[1]
+
+		files, err := config.ReadConfigFiles(configPath, configDir)
+		if err != nil {
+			return err
+		}
+		conf, err := files.Parse()
+		if err != nil {
+			return err
+		}
+
+		var target *config.TargetContainer
+		for _, tctr := range conf.Containers {
+			if strings.EqualFold(tctr.Id, targetId) {
+				target = tctr
+				break
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("No target with id %s in %s", targetId, configPath)
+		}
+
+		// Rewrite only the file the target is defined in.
+		fragment := target.Source != files.Main
+		if err := config.UpdateTargetInFile(target.Source, fragment, targetId, func(tctr *config.TargetContainer) {
+			tctr.Promote(tag)
+		}); err != nil {
+			return fmt.Errorf("Unable to write config to %s, %v", target.Source, err)
+		}
+		fmt.Printf("Promoted %s to %s:%s.\n", targetId, target.Image, tag)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(promoteCmd)
+}
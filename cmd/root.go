@@ -5,11 +5,14 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/fuserobotics/deviced/pkg/config"
 	"github.com/fuserobotics/deviced/pkg/daemon"
 	"github.com/spf13/cobra"
 )
 
 var configPath string
+var configDir string
+var apiAddr string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -19,7 +22,7 @@ var RootCmd = &cobra.Command{
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
-		s := daemon.System{ConfigPath: configPath}
+		s := daemon.System{ConfigPath: configPath, ConfigDir: configDir}
 		os.Exit(s.Main())
 	},
 }
@@ -41,6 +44,8 @@ func init() {
 	// will be global for your application.
 
 	RootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config path (default is /etc/deviced.yaml)")
+	RootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "dir of config fragments (*.yaml) merged into the config")
+	RootCmd.PersistentFlags().StringVar(&apiAddr, "api", config.DefaultApiListenAddr, "address of the running daemon's API")
 }
 
 func initConfig() {
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/secrets"
+	"github.com/fuserobotics/deviced/pkg/utils"
+	"github.com/go-yaml/yaml"
+	"github.com/spf13/cobra"
+)
+
+var secretFile string
+
+// openSecretStore opens the store in the data dir of the config. The config
+// is read loosely, an invalid config should not lock out its secrets.
+func openSecretStore() (*secrets.Store, error) {
+	conf := &config.DevicedConfig{}
+	if dat, err := ioutil.ReadFile(configPath); err == nil {
+		if err := yaml.Unmarshal(dat, conf); err != nil {
+			return nil, fmt.Errorf("%s: %v", configPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	conf.FillWithDefaults()
+	machineId, err := utils.MachineId()
+	if err != nil {
+		return nil, err
+	}
+	return secrets.OpenStore(conf.SecretStoreDir(), machineId)
+}
+
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage the encrypted secret store of this device.",
+	Long: `Secrets in the store are referenced from the config as store:<name>. The
+store is encrypted with a key derived from the machine id, so it can only be
+read on this device.`,
+}
+
+var secretSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Store a secret, read from stdin or --file.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected a secret name")
+		}
+		var value []byte
+		var err error
+		if secretFile != "" {
+			value, err = ioutil.ReadFile(secretFile)
+		} else {
+			value, err = ioutil.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return err
+		}
+		store, err := openSecretStore()
+		if err != nil {
+			return err
+		}
+		if err := store.Set(args[0], value); err != nil {
+			return err
+		}
+		fmt.Printf("Stored secret %s.\n", args[0])
+		return nil
+	},
+}
+
+var secretRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a secret from the store.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected a secret name")
+		}
+		store, err := openSecretStore()
+		if err != nil {
+			return err
+		}
+		return store.Delete(args[0])
+	},
+}
+
+var secretLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the names of the stored secrets.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openSecretStore()
+		if err != nil {
+			return err
+		}
+		names, err := store.Names()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	},
+}
+
+func init() {
+	secretSetCmd.Flags().StringVarP(&secretFile, "file", "f", "", "read the secret from a file instead of stdin")
+	secretCmd.AddCommand(secretSetCmd)
+	secretCmd.AddCommand(secretRmCmd)
+	secretCmd.AddCommand(secretLsCmd)
+	RootCmd.AddCommand(secretCmd)
+}
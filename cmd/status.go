@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fuserobotics/deviced/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of the running daemon.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		status, err := api.NewClient(apiAddr).Status()
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+	},
+}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Show recent actions of the running daemon.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		events, err := api.NewClient(apiAddr).Events()
+		if err != nil {
+			return err
+		}
+		return printJSON(events)
+	},
+}
+
+var holdCmd = &cobra.Command{
+	Use:   "hold [target]",
+	Short: "Hold container replacements, for one target or all targets.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setHold(args, true)
+	},
+}
+
+var releaseCmd = &cobra.Command{
+	Use:   "release [target]",
+	Short: "Release a hold on container replacements.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setHold(args, false)
+	},
+}
+
+func setHold(args []string, held bool) error {
+	if len(args) > 1 {
+		return errors.New("Expected at most one target")
+	}
+	target := ""
+	if len(args) == 1 {
+		target = args[0]
+	}
+	status, err := api.NewClient(apiAddr).SetHold(target, held)
+	if err != nil {
+		return err
+	}
+	return printJSON(status)
+}
+
+func printJSON(value interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(value); err != nil {
+		return fmt.Errorf("Unable to encode response, %v", err)
+	}
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+	RootCmd.AddCommand(eventsCmd)
+	RootCmd.AddCommand(holdCmd)
+	RootCmd.AddCommand(releaseCmd)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var validateFile string
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check a config file without applying it.",
+	Long: `Parses the file strictly, merging the fragments of --config-dir, and reports
+every problem found, the same checks the daemon runs before applying a config.
+Exits non-zero if the config is invalid.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := validateFile
+		if path == "" {
+			path = configPath
+		}
+		files, err := config.ReadConfigFiles(path, configDir)
+		if err != nil {
+			return err
+		}
+		if fragments := files.Fragments(); len(fragments) != 0 {
+			fmt.Printf("Merging %d fragments from %s.\n", len(fragments), configDir)
+		}
+		if _, err := files.Parse(); err != nil {
+			if verr, ok := err.(*config.ValidationError); ok {
+				for _, problem := range verr.Problems {
+					fmt.Println(problem)
+				}
+				return fmt.Errorf("%s is invalid, %d problems", path, len(verr.Problems))
+			}
+			fmt.Println(err)
+			return errors.New(path + " is invalid")
+		}
+		fmt.Printf("%s is valid\n", path)
+		return nil
+	},
+}
+
+func init() {
+	validateCmd.Flags().StringVarP(&validateFile, "file", "f", "", "config file to check (default is --config)")
+	RootCmd.AddCommand(validateCmd)
+}
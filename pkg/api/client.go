@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/state"
+)
+
+// Client talks to a running deviced API.
+type Client struct {
+	Addr       string
+	HttpClient *http.Client
+}
+
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:       addr,
+		HttpClient: &http.Client{Timeout: time.Duration(30) * time.Second},
+	}
+}
+
+func (c *Client) do(method string, path string, query url.Values, body io.Reader, result interface{}) error {
+	u := url.URL{Scheme: "http", Host: c.Addr, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		errResp := &ErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("API returned %s", resp.Status)
+		}
+		return errors.New(errResp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if raw, ok := result.(*[]byte); ok {
+		*raw, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *Client) Status() (*state.StatusSnapshot, error) {
+	res := &state.StatusSnapshot{}
+	err := c.do(http.MethodGet, "/status", nil, nil, res)
+	return res, err
+}
+
+func (c *Client) Events() ([]*state.Event, error) {
+	var res []*state.Event
+	err := c.do(http.MethodGet, "/events", nil, nil, &res)
+	return res, err
+}
+
+// SetHold holds or releases replacements. An empty target applies to all targets.
+func (c *Client) SetHold(target string, held bool) (*state.StatusSnapshot, error) {
+	query := url.Values{}
+	if target != "" {
+		query.Set("target", target)
+	}
+	method := http.MethodPost
+	if !held {
+		method = http.MethodDelete
+	}
+	res := &state.StatusSnapshot{}
+	err := c.do(method, "/hold", query, nil, res)
+	return res, err
+}
+
+// Logs returns the daemon's recent log entries.
+func (c *Client) Logs() ([]*logging.Entry, error) {
+	var res []*logging.Entry
+	err := c.do(http.MethodGet, "/logs", nil, nil, &res)
+	return res, err
+}
+
+func (c *Client) LogLevel() (string, error) {
+	res := &LogLevelResponse{}
+	err := c.do(http.MethodGet, "/log/level", nil, nil, res)
+	return res.Level, err
+}
+
+// SetLogLevel changes the daemon's log level until the config is reloaded.
+func (c *Client) SetLogLevel(level string) (string, error) {
+	query := url.Values{}
+	query.Set("level", level)
+	res := &LogLevelResponse{}
+	err := c.do(http.MethodPost, "/log/level", query, nil, res)
+	return res.Level, err
+}
+
+// ContainerLogs returns the last collected output lines of a target, 0 for all.
+func (c *Client) ContainerLogs(target string, tail int) ([]*jsonlog.JSONLog, error) {
+	query := url.Values{}
+	query.Set("target", target)
+	query.Set("tail", strconv.Itoa(tail))
+	var res []*jsonlog.JSONLog
+	err := c.do(http.MethodGet, "/containers/logs", query, nil, &res)
+	return res, err
+}
+
+// Audit returns the audit log entries matching the query, oldest first.
+func (c *Client) Audit(q *audit.Query) ([]*audit.Entry, error) {
+	query := url.Values{}
+	if !q.Since.IsZero() {
+		query.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		query.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Target != "" {
+		query.Set("target", q.Target)
+	}
+	if q.Type != "" {
+		query.Set("type", q.Type)
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	var res []*audit.Entry
+	err := c.do(http.MethodGet, "/audit", query, nil, &res)
+	return res, err
+}
+
+// ConfigHistory returns the applied config revisions, oldest first.
+func (c *Client) ConfigHistory() ([]*config.Revision, error) {
+	var res []*config.Revision
+	err := c.do(http.MethodGet, "/config/history", nil, nil, &res)
+	return res, err
+}
+
+// ConfirmConfig keeps a config revision on trial, 0 for the newest.
+func (c *Client) ConfirmConfig(version int) (*config.Revision, error) {
+	query := url.Values{}
+	if version != 0 {
+		query.Set("version", strconv.Itoa(version))
+	}
+	res := &config.Revision{}
+	err := c.do(http.MethodPost, "/config/confirm", query, nil, res)
+	return res, err
+}
+
+// Config returns the running config as YAML, with variables rendered.
+func (c *Client) Config() ([]byte, error) {
+	var res []byte
+	err := c.do(http.MethodGet, "/config", nil, nil, &res)
+	return res, err
+}
+
+// Facts returns the facts the running config was rendered with.
+func (c *Client) Facts() (config.Facts, error) {
+	res := make(config.Facts)
+	err := c.do(http.MethodGet, "/config/facts", nil, nil, &res)
+	return res, err
+}
@@ -0,0 +1,355 @@
+package api
+
+/*
+DeviceD API
+===========
+
+A small HTTP/JSON API for inspecting and steering the daemon.
+
+ - GET    /status               current target status
+ - GET    /events               recent actions, e.g. hook runs
+ - POST   /hold[?target=id]     hold container replacements
+ - DELETE /hold[?target=id]     release a hold
+ - GET    /metrics              metrics in the Prometheus text format
+ - GET    /logs                 recent daemon log entries
+ - GET    /log/level            current log level
+ - POST   /log/level?level=x    change the log level until the next config reload
+ - GET    /containers/logs?target=id[&tail=n]
+                               collected output of a target
+ - GET    /audit[?since=t&until=t&target=id&type=x&limit=n]
+                               audit log entries, times in RFC3339
+ - GET    /config               running config as YAML, with variables rendered
+ - GET    /config/facts         facts the config was rendered with
+ - GET    /config/history       applied config revisions, oldest first
+ - POST   /config/confirm[?version=n]
+                               keep a config on trial, the newest by default
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/logcollect"
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/metrics"
+	"github.com/fuserobotics/deviced/pkg/state"
+)
+
+var log = logging.Component("api")
+
+type ApiServer struct {
+	Config     *config.DevicedConfig
+	ConfigLock *sync.Mutex
+	Status     *state.Status
+	Logs       *logcollect.Collector
+	Audit      *audit.Log
+	History    *config.History
+
+	// Re-checks all targets without waiting for the next event
+	WakeContainerWorker func()
+
+	Listener net.Listener
+	Mux      *http.ServeMux
+}
+
+func (as *ApiServer) Init() error {
+	as.Mux = http.NewServeMux()
+	as.Mux.HandleFunc("/status", as.handleStatus)
+	as.Mux.HandleFunc("/hold", as.handleHold)
+	as.Mux.HandleFunc("/events", as.handleEvents)
+	as.Mux.HandleFunc("/containers/logs", as.handleContainerLogs)
+	as.Mux.HandleFunc("/metrics", as.handleMetrics)
+	as.Mux.HandleFunc("/audit", as.handleAudit)
+	as.Mux.HandleFunc("/config", as.handleConfig)
+	as.Mux.HandleFunc("/config/facts", as.handleConfigFacts)
+	as.Mux.HandleFunc("/config/history", as.handleConfigHistory)
+	as.Mux.HandleFunc("/config/confirm", as.handleConfigConfirm)
+	as.Mux.HandleFunc("/logs", as.handleLogs)
+	as.Mux.HandleFunc("/log/level", as.handleLogLevel)
+
+	listener, err := net.Listen("tcp", as.Config.ApiConfig.ListenAddr)
+	if err != nil {
+		return err
+	}
+	as.Listener = listener
+	return nil
+}
+
+func (as *ApiServer) Run() {
+	log.Infof("API listening on %s...", as.Listener.Addr())
+	err := http.Serve(as.Listener, as.Mux)
+	log.Infof("API server exited, %v", err)
+}
+
+func (as *ApiServer) Quit() {
+	if as.Listener != nil {
+		as.Listener.Close()
+	}
+}
+
+func (as *ApiServer) wakeContainerWorker() {
+	if as.WakeContainerWorker != nil {
+		as.WakeContainerWorker()
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(value)
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, &ErrorResponse{Error: err.Error()})
+}
+
+func (as *ApiServer) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(rw, http.StatusOK, as.Status.Snapshot())
+}
+
+func (as *ApiServer) handleEvents(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(rw, http.StatusOK, as.Status.Events())
+}
+
+func (as *ApiServer) handleContainerLogs(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	query := req.URL.Query()
+	target := query.Get("target")
+	if target == "" {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("target is required"))
+		return
+	}
+	tail := DefaultLogTail
+	if tailStr := query.Get("tail"); tailStr != "" {
+		n, err := strconv.Atoi(tailStr)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid tail %s", tailStr))
+			return
+		}
+		tail = n
+	}
+	if as.Logs == nil {
+		writeError(rw, http.StatusServiceUnavailable, logcollect.ErrDisabled)
+		return
+	}
+	lines, err := as.Logs.Tail(target, tail)
+	if err == logcollect.ErrDisabled {
+		writeError(rw, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, lines)
+}
+
+func (as *ApiServer) handleAudit(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	if as.Audit == nil {
+		writeError(rw, http.StatusServiceUnavailable, fmt.Errorf("audit log is disabled"))
+		return
+	}
+	query := req.URL.Query()
+	q := &audit.Query{
+		Target: query.Get("target"),
+		Type:   query.Get("type"),
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid since %s", since))
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid until %s", until))
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid limit %s", limit))
+			return
+		}
+	}
+	entries, err := as.Audit.Query(q)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, entries)
+}
+
+func (as *ApiServer) handleConfig(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	as.ConfigLock.Lock()
+	dat, err := as.Config.MarshalRedacted()
+	as.ConfigLock.Unlock()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-yaml")
+	rw.Write(dat)
+}
+
+func (as *ApiServer) handleConfigFacts(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	as.ConfigLock.Lock()
+	facts := make(config.Facts)
+	for k, v := range as.Config.Facts {
+		facts[k] = v
+	}
+	as.ConfigLock.Unlock()
+	writeJSON(rw, http.StatusOK, facts)
+}
+
+func (as *ApiServer) handleConfigHistory(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	if as.History == nil {
+		writeError(rw, http.StatusServiceUnavailable, fmt.Errorf("config history is unavailable"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, as.History.Revisions())
+}
+
+func (as *ApiServer) handleConfigConfirm(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	if as.History == nil {
+		writeError(rw, http.StatusServiceUnavailable, fmt.Errorf("config history is unavailable"))
+		return
+	}
+	version := 0
+	if versionStr := req.URL.Query().Get("version"); versionStr != "" {
+		n, err := strconv.Atoi(versionStr)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid version %s", versionStr))
+			return
+		}
+		version = n
+	}
+	rev, err := as.History.Confirm(version, "confirmed via the API")
+	if err != nil {
+		writeError(rw, http.StatusConflict, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, rev)
+}
+
+func (as *ApiServer) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Default.WriteText(rw)
+}
+
+func (as *ApiServer) handleLogs(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(rw, http.StatusOK, logging.Recent())
+}
+
+func (as *ApiServer) handleLogLevel(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level := req.URL.Query().Get("level")
+		if level == "" {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("level is required"))
+			return
+		}
+		if err := logging.SetLevel(level); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		log.Infof("API: log level set to %s.", logging.Level())
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(rw, http.StatusOK, &LogLevelResponse{Level: logging.Level()})
+}
+
+func (as *ApiServer) handleHold(rw http.ResponseWriter, req *http.Request) {
+	target := req.URL.Query().Get("target")
+	switch req.Method {
+	case http.MethodPost:
+		if target != "" && !as.hasTarget(target) {
+			writeError(rw, http.StatusNotFound, fmt.Errorf("no target %s in the config", target))
+			return
+		}
+		log.Infof("API: holding replacements for %s.", holdTargetName(target))
+		if err := as.Status.SetHold(target, true); err != nil {
+			log.Warnf("API: unable to persist the hold for %s, it is lost on restart, %v", holdTargetName(target), err)
+		}
+	case http.MethodDelete:
+		// A hold on a target removed from the config can still be released.
+		if target != "" && !as.hasTarget(target) {
+			log.Warnf("API: releasing hold for %s, which is not in the config.", target)
+		}
+		log.Infof("API: releasing hold for %s.", holdTargetName(target))
+		if err := as.Status.SetHold(target, false); err != nil {
+			log.Warnf("API: unable to persist the release for %s, the hold returns on restart, %v", holdTargetName(target), err)
+		}
+		// Apply pending replacements now rather than on the next recheck
+		as.wakeContainerWorker()
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(rw, http.StatusOK, as.Status.Snapshot())
+}
+
+// hasTarget checks if a target with the id is in the config.
+func (as *ApiServer) hasTarget(id string) bool {
+	as.ConfigLock.Lock()
+	defer as.ConfigLock.Unlock()
+
+	return as.Config.GetContainer(id) != nil
+}
+
+func holdTargetName(target string) string {
+	if target == "" {
+		return "all targets"
+	}
+	return target
+}
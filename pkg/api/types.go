@@ -0,0 +1,12 @@
+package api
+
+// DefaultLogTail is the number of container log lines returned by default.
+const DefaultLogTail int = 100
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
@@ -0,0 +1,188 @@
+// Package audit keeps an append-only record of the actions deviced takes.
+//
+// Entries are written as JSON lines to a size-rotated file, so the history
+// survives restarts and can be queried after a field failure.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/redact"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+var log = logging.Component("audit")
+
+// Entry types.
+const (
+	TypeConfig     string = "config"
+	TypePull       string = "pull"
+	TypeCreate     string = "create"
+	TypeReplace    string = "replace"
+	TypeRemove     string = "remove"
+	TypeHook       string = "hook"
+	TypeSelfUpdate string = "self-update"
+	TypeRollback   string = "rollback"
+)
+
+// Outcomes.
+const (
+	OutcomeOK      string = "ok"
+	OutcomeFailed  string = "failed"
+	OutcomeSkipped string = "skipped"
+)
+
+// Entry is one recorded action.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Outcome   string    `json:"outcome"`
+	Target    string    `json:"target,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	// Config changes only, see Diff
+	Diff string `json:"diff,omitempty"`
+}
+
+// Outcome returns OutcomeOK if err is nil, OutcomeFailed otherwise.
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeFailed
+	}
+	return OutcomeOK
+}
+
+// Query selects entries, zero fields match everything.
+type Query struct {
+	Since  time.Time
+	Until  time.Time
+	Target string
+	Type   string
+	// Most recent entries returned, 0 for all
+	Limit int
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Target != "" && !strings.EqualFold(q.Target, e.Target) {
+		return false
+	}
+	if q.Type != "" && q.Type != e.Type {
+		return false
+	}
+	return true
+}
+
+// Log is the audit log. A nil Log discards entries, so callers don't
+// need to check if auditing is enabled.
+type Log struct {
+	mtx      sync.Mutex
+	name     string
+	maxFiles int
+	file     *utils.RotatingFile
+}
+
+// Open opens the log at name for appending.
+func Open(name string, maxSize int64, maxFiles int) (*Log, error) {
+	file, err := utils.OpenRotatingFile(name, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{name: name, maxFiles: maxFiles, file: file}, nil
+}
+
+// Record appends an entry, setting its time if unset.
+func (l *Log) Record(e *Entry) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Message = redact.String(e.Message)
+	e.Diff = redact.String(e.Diff)
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, err := l.file.Write(append(dat, '\n')); err != nil {
+		log.Warnf("Unable to write audit log %s, %v", l.name, err)
+	}
+}
+
+// Query returns the matching entries, oldest first.
+func (l *Log) Query(q *Query) ([]*Entry, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var res []*Entry
+	for i := l.maxFiles; i >= 0; i-- {
+		name := l.name
+		if i > 0 {
+			name = utils.RotatedName(l.name, i)
+		}
+		entries, err := readEntries(name, q)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		res = append(res, entries...)
+	}
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[len(res)-q.Limit:]
+	}
+	return res, nil
+}
+
+func readEntries(name string, q *Query) ([]*Entry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var res []*Entry
+	scanner := bufio.NewScanner(file)
+	// Config diffs can make for long lines.
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		e := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue
+		}
+		if q.matches(e) {
+			res = append(res, e)
+		}
+	}
+	return res, scanner.Err()
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.file.Close()
+}
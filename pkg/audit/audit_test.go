@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	a := "containers:\n  - id: a\n    image: foo\nrepos: []\n"
+	b := "containers:\n  - id: a\n    image: bar\nrepos: []\nnetworks: []\n"
+	expected := "-     image: foo\n+     image: bar\n+ networks: []\n"
+	if d := Diff(a, b); d != expected {
+		t.Fatalf("unexpected diff:\n%s", d)
+	}
+	if d := Diff(a, a); d != "" {
+		t.Fatalf("expected no diff, got:\n%s", d)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Small enough to rotate a few times.
+	l, err := Open(path.Join(dir, "audit.log"), 300, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		target := "a"
+		if i%2 == 1 {
+			target = "b"
+		}
+		l.Record(&Entry{
+			Time:    start.Add(time.Duration(i) * time.Hour),
+			Type:    TypeCreate,
+			Outcome: OutcomeOK,
+			Target:  target,
+		})
+	}
+
+	all, err := l.Query(&Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 10 {
+		t.Fatalf("expected 10 entries, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Time.Before(all[i-1].Time) {
+			t.Fatalf("entries not in order")
+		}
+	}
+
+	res, err := l.Query(&Query{
+		Since:  start.Add(2 * time.Hour),
+		Until:  start.Add(7 * time.Hour),
+		Target: "B",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || !res[0].Time.Equal(start.Add(3*time.Hour)) {
+		t.Fatalf("unexpected entries %v", res)
+	}
+
+	res, _ = l.Query(&Query{Limit: 2})
+	if len(res) != 2 || !res[1].Time.Equal(start.Add(9*time.Hour)) {
+		t.Fatalf("expected the 2 most recent entries, got %v", res)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Record(&Entry{Type: TypePull})
+	if res, err := l.Query(&Query{}); res != nil || err != nil {
+		t.Fatalf("expected nothing from a nil log")
+	}
+}
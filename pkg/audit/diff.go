@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"bytes"
+	"strings"
+)
+
+// maxDiffCells bounds the size of the LCS table, larger inputs are
+// reported as a full replacement.
+const maxDiffCells int = 4 * 1024 * 1024
+
+// Diff returns a line diff of two texts, with "- " and "+ " prefixes for
+// removed and added lines. Unchanged lines are left out.
+func Diff(a string, b string) string {
+	if a == b {
+		return ""
+	}
+	al := splitLines(a)
+	bl := splitLines(b)
+	if len(al)*len(bl) > maxDiffCells {
+		return formatLines("- ", al) + formatLines("+ ", bl)
+	}
+
+	// lcs[i][j] is the length of the common subsequence of al[i:] and bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	i, j := 0, 0
+	for i < len(al) && j < len(bl) {
+		switch {
+		case al[i] == bl[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			buf.WriteString("- " + al[i] + "\n")
+			i++
+		default:
+			buf.WriteString("+ " + bl[j] + "\n")
+			j++
+		}
+	}
+	buf.WriteString(formatLines("- ", al[i:]))
+	buf.WriteString(formatLines("+ ", bl[j:]))
+	return buf.String()
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func formatLines(prefix string, lines []string) string {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(prefix + line + "\n")
+	}
+	return buf.String()
+}
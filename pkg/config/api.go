@@ -0,0 +1,19 @@
+package config
+
+type ApiConfig struct {
+	// Set to "-" to disable the API
+	ListenAddr string `yaml:"listenAddr,omitempty"`
+}
+
+const DefaultApiListenAddr string = "127.0.0.1:8095"
+
+func (c *ApiConfig) FillWithDefaults() {
+	if c.ListenAddr == "" {
+		c.ListenAddr = DefaultApiListenAddr
+		log.Infof("Using default api listen address of %s", c.ListenAddr)
+	}
+}
+
+func (c *ApiConfig) Enabled() bool {
+	return c.ListenAddr != "-"
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"path"
+)
+
+// AuditConfig configures the on-disk audit log. Changes apply after a restart.
+type AuditConfig struct {
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Defaults to <dataDir>/audit.log
+	Path string `yaml:"path,omitempty"`
+	// Size at which the log is rotated, in megabytes
+	MaxSizeMB int `yaml:"maxSizeMB,omitempty"`
+	// Rotated files kept
+	MaxFiles int `yaml:"maxFiles,omitempty"`
+}
+
+const (
+	DefaultAuditMaxSizeMB int = 5
+	DefaultAuditMaxFiles  int = 4
+)
+
+func (c *AuditConfig) FillWithDefaults(dataDir string) {
+	if c.Path == "" {
+		c.Path = path.Join(dataDir, "audit.log")
+	}
+	if c.MaxSizeMB == 0 {
+		c.MaxSizeMB = DefaultAuditMaxSizeMB
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = DefaultAuditMaxFiles
+	}
+}
@@ -1,70 +1,131 @@
 package config
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
 
 	dcapi "github.com/docker/docker/api/types"
+	"github.com/fuserobotics/deviced/pkg/logging"
 	"github.com/go-yaml/yaml"
 )
 
+var log = logging.Component("config")
+
 type DevicedConfig struct {
 	ContainerConfig ContainerWorkerConfig         `yaml:"containerConfig"`
 	ImageConfig     ImageWorkerConfig             `yaml:"imageConfig"`
 	DockerConfig    DockerClientConfig            `yaml:"dockerConfig"`
+	ApiConfig       ApiConfig                     `yaml:"apiConfig"`
+	LogConfig       LogConfig                     `yaml:"logConfig,omitempty"`
+	ContainerLogs   ContainerLogConfig            `yaml:"containerLogs,omitempty"`
+	Audit           AuditConfig                   `yaml:"audit,omitempty"`
+	Rollback        RollbackConfig                `yaml:"rollback,omitempty"`
 	Repos           []*RemoteRepository           `yaml:"repos"`
 	Containers      []*TargetContainer            `yaml:"containers"`
 	Networks        []*dcapi.NetworkCreateRequest `yaml:"networks"`
+	Volumes         []*VolumeConfig               `yaml:"volumes,omitempty"`
+	// Where deviced keeps its persistent state
+	DataDir string `yaml:"dataDir,omitempty"`
+	// Device facts for templating, defaults to /etc/deviced/facts.yaml
+	FactsFile string `yaml:"factsFile,omitempty"`
+
+	// Facts the config was rendered with
+	Facts Facts `yaml:"-"`
 }
 
+const DefaultDataDir string = "/var/lib/deviced"
+
 func ConfigFileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
 
 func (c *DevicedConfig) WriteConfig(path string) bool {
-	fmt.Printf("Writing config to %s\n", path)
+	log.Infof("Writing config to %s", path)
 
-	d, err := yaml.Marshal(&c)
+	d, err := c.Marshal()
 	if err != nil {
-		fmt.Printf("Error marshalling config: %v\n", err)
+		log.Errorf("Error marshalling config: %v", err)
 		return false
 	}
 
-	err = ioutil.WriteFile(path, d, 0644)
+	// May hold registry passwords.
+	err = ioutil.WriteFile(path, d, 0600)
+	if err != nil {
+		log.Errorf("Error writing config: %v", err)
+		return false
+	}
 	return true
 }
 
+// Marshal returns the config as YAML.
+func (c *DevicedConfig) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
 func (c *DevicedConfig) FillWithDefaults() {
+	if c.DataDir == "" {
+		c.DataDir = DefaultDataDir
+	}
+	c.ContainerConfig.FillWithDefaults()
 	c.DockerConfig.FillWithDefaults()
 	c.ImageConfig.FillWithDefaults()
+	c.ApiConfig.FillWithDefaults()
+	c.LogConfig.FillWithDefaults()
+	c.ContainerLogs.FillWithDefaults(c.DataDir)
+	c.Audit.FillWithDefaults(c.DataDir)
+	c.Rollback.FillWithDefaults()
+}
+
+// Parse strictly unmarshals and validates a single config file, unknown keys
+// are errors. Defaults are not filled in.
+func Parse(dat []byte) (*DevicedConfig, error) {
+	return (&ConfigFiles{Files: map[string]string{"": string(dat)}}).Parse()
 }
 
+// ReadFrom replaces the config with the one at confPath.
+// An unreadable or invalid file leaves the current config alone.
 func (c *DevicedConfig) ReadFrom(confPath string) error {
-	dat, err := ioutil.ReadFile(confPath)
+	files, err := ReadConfigFiles(confPath, "")
 	if err != nil {
-		fmt.Printf("Unable to read config at %s, %v\n", confPath, err)
+		log.Warnf("Unable to read config at %s, %v", confPath, err)
 		return err
 	}
+	return c.LoadFiles(files)
+}
 
-	err = yaml.Unmarshal(dat, &c)
+// LoadFiles replaces the config with the merged files.
+// An invalid config leaves the current config alone.
+func (c *DevicedConfig) LoadFiles(files *ConfigFiles) error {
+	next, err := files.Parse()
 	if err != nil {
-		fmt.Printf("Unable to parse config at %s, %v\n", confPath, err)
+		if verr, ok := err.(*ValidationError); ok {
+			for _, problem := range verr.Problems {
+				log.Warnf("Invalid config at %s: %s", files.Main, problem)
+			}
+		} else {
+			log.Warnf("Unable to parse config at %s, %v", files.Main, err)
+		}
 		return err
 	}
 
-	fmt.Printf("Read config from %s\n", confPath)
+	if fragments := files.Fragments(); len(fragments) != 0 {
+		log.Infof("Read config from %s and %d fragments in %s", files.Main, len(fragments), files.Dir)
+	} else {
+		log.Infof("Read config from %s", files.Main)
+	}
+	*c = *next
 	c.FillWithDefaults()
+	c.registerSecrets()
 	return nil
 }
 
 func (c *DevicedConfig) CreateOrRead(confPath string) bool {
 	if !ConfigFileExists(confPath) {
-		fmt.Printf("Writing default config to %s\n", confPath)
+		log.Infof("Writing default config to %s", confPath)
 		c.FillWithDefaults()
 		if !c.WriteConfig(confPath) {
-			fmt.Printf("Unable to write default config!\n")
+			log.Warn("Unable to write default config!")
 			return false
 		}
 		return true
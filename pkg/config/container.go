@@ -15,6 +15,7 @@ type TargetContainer struct {
 	Image string `yaml:"image"`
 	// acceptable version tags, in order of priority
 	Versions               []string               `yaml:"versions"`
+	Prefetch               []string               `yaml:"prefetch,omitempty"` // pulled ahead of time, not selected until promoted
 	UseAnyVersion          bool                   `yaml:"useAnyVersion,omitempty"`
 	NoArchTag              bool                   `yaml:"noArchTag,omitempty"`
 	RestartExited          bool                   `yaml:"restartExited"`
@@ -22,14 +23,64 @@ type TargetContainer struct {
 	DockerHostConfig       dcapi.HostConfig       `yaml:"dockerHostConfig,omitempty"`
 	DockerNetworkingConfig dcapi.NetworkingConfig `yaml:"dockerNetworkingConfig,omitempty"`
 	LifecycleHooks         LifecycleHookSet       `yaml:"lifecycleHooks,omitempty"`
+	// overrides the global update windows if set
+	UpdateWindows []UpdateWindow `yaml:"updateWindows,omitempty"`
+	// "service" (default) or "job"
+	Kind string `yaml:"kind,omitempty"`
+	// jobs run once per "version" (default) or per "config" (version and config hash)
+	RunPer string `yaml:"runPer,omitempty"`
+	// run to completion in order before the container is started
+	InitContainers []*InitContainer `yaml:"initContainers,omitempty"`
+	// cron expression, runs the container to completion on this schedule
+	Schedule string `yaml:"schedule,omitempty"`
+	// start a scheduled run even if the previous one is still running
+	AllowOverlap bool `yaml:"allowOverlap,omitempty"`
+	// scheduled run results to keep, defaults to 5
+	HistoryLimit int `yaml:"historyLimit,omitempty"`
+	// number of identical containers to run for a service, defaults to 1
+	Replicas int `yaml:"replicas,omitempty"`
+	// snapshot managed volumes before replacing the container
+	Snapshot *SnapshotConfig `yaml:"snapshot,omitempty"`
+	// files mounted read-only in /run/secrets
+	Secrets []*ContainerSecret `yaml:"secrets,omitempty"`
+
+	// Config file the target is defined in, set when loading
+	Source string `yaml:"-" json:"-"`
 }
 
 type LifecycleHookSet struct {
 	OnStop []LifecycleHook
+	// Run against the running container before replacing it.
+	// Any failing hook defers the replacement until the next check.
+	PreUpdate []LifecycleHook `yaml:"preUpdate,omitempty"`
+	// Run after creating a container, before starting it.
+	PreStart []LifecycleHook `yaml:"preStart,omitempty"`
+	// Run after starting a container.
+	PostStart []LifecycleHook `yaml:"postStart,omitempty"`
+	// Run against the old container when replacing it with a new version,
+	// before the OnStop hooks. DEVICED_OLD_TAG and DEVICED_NEW_TAG are set.
+	OnUpgrade []LifecycleHook `yaml:"onUpgrade,omitempty"`
+	// Run after a container has been removed.
+	OnRemove []LifecycleHook `yaml:"onRemove,omitempty"`
 }
 
+const (
+	// Log the failure and carry on (default)
+	HookFailureIgnore string = "ignore"
+	// Abort the operation the hook belongs to
+	HookFailureAbort string = "abort"
+)
+
 type LifecycleHook struct {
-	Exec *LifecycleExecHook
+	Exec      *LifecycleExecHook      `yaml:"exec,omitempty"`
+	Http      *LifecycleHttpHook      `yaml:"http,omitempty"`
+	Container *LifecycleContainerHook `yaml:"container,omitempty"`
+	// "ignore" or "abort"
+	FailurePolicy string `yaml:"failurePolicy,omitempty"`
+}
+
+func (h *LifecycleHook) AbortOnFailure() bool {
+	return strings.EqualFold(h.FailurePolicy, HookFailureAbort)
 }
 
 type LifecycleExecHook struct {
@@ -37,6 +88,29 @@ type LifecycleExecHook struct {
 	Timeout string
 }
 
+// LifecycleContainerHook runs a one-off helper container.
+type LifecycleContainerHook struct {
+	// Defaults to the image and tag of the container the hook runs for
+	Image       string   `yaml:"image,omitempty"`
+	Command     []string `yaml:"command,omitempty"`
+	Env         []string `yaml:"env,omitempty"`
+	Binds       []string `yaml:"binds,omitempty"`
+	NetworkMode string   `yaml:"networkMode,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+}
+
+// LifecycleHttpHook succeeds on a 2xx response.
+type LifecycleHttpHook struct {
+	// GET if empty
+	Method string `yaml:"method,omitempty"`
+	// Defaults to the container ip address
+	Host    string `yaml:"host,omitempty"`
+	Port    int    `yaml:"port,omitempty"`
+	Path    string `yaml:"path,omitempty"`
+	Body    string `yaml:"body,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
 func (tc *TargetContainer) ContainerVersionScore(version string) uint {
 	vers := arch.AppendArchTagSuffix(tc.Versions)
 	for idx, ver := range vers {
@@ -47,6 +121,77 @@ func (tc *TargetContainer) ContainerVersionScore(version string) uint {
 	return math.MaxUint16
 }
 
+// IsPrefetchOnly returns true if the tag is only listed for prefetching.
+func (tc *TargetContainer) IsPrefetchOnly(version string) bool {
+	if tc.ContainerVersionScore(version) != math.MaxUint16 {
+		return false
+	}
+	for _, ver := range arch.AppendArchTagSuffix(tc.Prefetch) {
+		if strings.EqualFold(ver, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// Promote moves a version to the front of the versions list,
+// removing it from the prefetch list.
+func (tc *TargetContainer) Promote(version string) {
+	versions := []string{version}
+	for _, ver := range tc.Versions {
+		if !strings.EqualFold(ver, version) {
+			versions = append(versions, ver)
+		}
+	}
+	tc.Versions = versions
+
+	var prefetch []string
+	for _, ver := range tc.Prefetch {
+		if !strings.EqualFold(ver, version) {
+			prefetch = append(prefetch, ver)
+		}
+	}
+	tc.Prefetch = prefetch
+}
+
+// EffectiveUpdateWindows returns the windows where this target may be replaced.
+func (tc *TargetContainer) EffectiveUpdateWindows(global []UpdateWindow) []UpdateWindow {
+	if len(tc.UpdateWindows) != 0 {
+		return tc.UpdateWindows
+	}
+	return global
+}
+
+// EffectiveReplicas returns the number of containers to run for this target.
+func (tc *TargetContainer) EffectiveReplicas() int {
+	if tc.RunsToCompletion() || tc.Replicas < 1 {
+		return 1
+	}
+	return tc.Replicas
+}
+
+// GetContainer returns the target with the given id, ignoring case, or nil.
+func (c *DevicedConfig) GetContainer(id string) *TargetContainer {
+	for _, tctr := range c.Containers {
+		if tctr != nil && strings.EqualFold(tctr.Id, id) {
+			return tctr
+		}
+	}
+	return nil
+}
+
 type ContainerWorkerConfig struct {
 	AllowSelfDelete bool `yaml:"allowSelfDelete"`
+	// running containers are only replaced inside these windows, empty is always
+	UpdateWindows []UpdateWindow `yaml:"updateWindows,omitempty"`
+	// remove managed volumes no longer in the config
+	PruneVolumes bool `yaml:"pruneVolumes,omitempty"`
+	// tmpfs the secret files of containers are written to
+	SecretsDir string `yaml:"secretsDir,omitempty"`
+}
+
+func (c *ContainerWorkerConfig) FillWithDefaults() {
+	if c.SecretsDir == "" {
+		c.SecretsDir = DefaultSecretsDir
+	}
 }
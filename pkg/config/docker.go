@@ -47,11 +47,11 @@ func (c *DockerClientTlsConfig) Validate() bool {
 	for idx, path := range paths {
 		pathn := pathNames[idx]
 		if path == "" {
-			fmt.Printf("No %s specified!\n", pathn)
+			log.Infof("No %s specified!", pathn)
 			return false
 		}
 		if _, err := os.Stat(path); os.IsNotExist(err) {
-			fmt.Printf("%s at %s not found!\n", pathn, path)
+			log.Infof("%s at %s not found!", pathn, path)
 			return false
 		}
 	}
@@ -68,7 +68,7 @@ type DockerClientConfig struct {
 func (c *DockerClientConfig) FillWithDefaults() {
 	if c.Endpoint == "" && !c.LoadFromEnvironment {
 		c.Endpoint = "unix:///var/run/docker.sock"
-		fmt.Printf("Using default endpoint of %s\n", c.Endpoint)
+		log.Infof("Using default endpoint of %s", c.Endpoint)
 	}
 }
 
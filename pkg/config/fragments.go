@@ -0,0 +1,307 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	dcapi "github.com/docker/docker/api/types"
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+	"github.com/go-yaml/yaml"
+)
+
+// FragmentSuffix marks the drop-in files of a config dir.
+const FragmentSuffix string = ".yaml"
+
+// Fragment is a drop-in file in the config dir. Fragments only add repos,
+// containers, networks and volumes, settings belong in the main config.
+type Fragment struct {
+	Repos      []*RemoteRepository           `yaml:"repos,omitempty"`
+	Containers []*TargetContainer            `yaml:"containers,omitempty"`
+	Networks   []*dcapi.NetworkCreateRequest `yaml:"networks,omitempty"`
+	Volumes    []*VolumeConfig               `yaml:"volumes,omitempty"`
+}
+
+// ConfigFiles is the content of the main config file and the fragments of
+// the config dir, the input of a config.
+type ConfigFiles struct {
+	Main string `yaml:"main"`
+	Dir  string `yaml:"dir,omitempty"`
+	// Content by path
+	Files map[string]string `yaml:"files"`
+}
+
+// ReadConfigFiles reads the main config and the fragments in dir.
+// An empty or missing dir has no fragments.
+func ReadConfigFiles(mainPath string, dir string) (*ConfigFiles, error) {
+	f := &ConfigFiles{Main: mainPath, Dir: dir, Files: make(map[string]string)}
+	dat, err := ioutil.ReadFile(mainPath)
+	if err != nil {
+		return nil, err
+	}
+	f.Files[mainPath] = string(dat)
+	if dir == "" {
+		return f, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, FragmentSuffix) {
+			continue
+		}
+		fragPath := path.Join(dir, name)
+		if fragPath == mainPath {
+			continue
+		}
+		dat, err := ioutil.ReadFile(fragPath)
+		if err != nil {
+			return nil, err
+		}
+		f.Files[fragPath] = string(dat)
+	}
+	return f, nil
+}
+
+// UnmarshalConfigFiles decodes files stored with Marshal.
+func UnmarshalConfigFiles(dat []byte) (*ConfigFiles, error) {
+	f := &ConfigFiles{}
+	if err := yaml.Unmarshal(dat, f); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Files[f.Main]; !ok {
+		return nil, fmt.Errorf("main config %s is missing", f.Main)
+	}
+	return f, nil
+}
+
+// Marshal encodes the files, the output is the same for the same files.
+func (f *ConfigFiles) Marshal() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+// Digest is the hash of the files, used to notice changes.
+func (f *ConfigFiles) Digest() string {
+	dat, _ := f.Marshal()
+	return ConfigDigest(dat)
+}
+
+// Fragments returns the fragment paths in merge order.
+func (f *ConfigFiles) Fragments() []string {
+	var res []string
+	for name := range f.Files {
+		if name != f.Main {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Write restores the files, removing fragments in the dir that are not part of them.
+func (f *ConfigFiles) Write() error {
+	if f.Dir != "" {
+		infos, _ := ioutil.ReadDir(f.Dir)
+		for _, info := range infos {
+			name := path.Join(f.Dir, info.Name())
+			if _, ok := f.Files[name]; !ok && !info.IsDir() && strings.HasSuffix(name, FragmentSuffix) {
+				if err := os.Remove(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for name, content := range f.Files {
+		if err := ioutils.AtomicWriteFile(name, []byte(content), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse merges the fragments into the main config in name order, renders
+// variables and validates the result. Defaults are not filled in.
+func (f *ConfigFiles) Parse() (*DevicedConfig, error) {
+	c := &DevicedConfig{}
+	if err := yaml.UnmarshalStrict([]byte(f.Files[f.Main]), c); err != nil {
+		return nil, fileError(f.Main, err)
+	}
+	for _, tctr := range c.Containers {
+		if tctr != nil {
+			tctr.Source = f.Main
+		}
+	}
+
+	v := &validator{}
+	m := newMerger(c, f.Main)
+	for _, name := range f.Fragments() {
+		frag := &Fragment{}
+		if err := yaml.UnmarshalStrict([]byte(f.Files[name]), frag); err != nil {
+			return nil, fileError(name, err)
+		}
+		m.merge(v, name, frag)
+	}
+	facts, err := c.LoadFacts()
+	if err != nil {
+		v.addf("facts: %v", err)
+	} else if err := c.Render(facts); err != nil {
+		v.problems = append(v.problems, err.(*ValidationError).Problems...)
+	}
+	c.Facts = facts
+	if err := c.Validate(); err != nil {
+		v.problems = append(v.problems, err.(*ValidationError).Problems...)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func fileError(name string, err error) error {
+	if name == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %v", name, err)
+}
+
+// merger adds fragments to a config, remembering where each item came from.
+type merger struct {
+	conf       *DevicedConfig
+	containers map[string]string
+	networks   map[string]string
+	volumes    map[string]string
+	repos      map[string]string
+}
+
+func newMerger(c *DevicedConfig, mainPath string) *merger {
+	m := &merger{
+		conf:       c,
+		containers: make(map[string]string),
+		networks:   make(map[string]string),
+		volumes:    make(map[string]string),
+		repos:      make(map[string]string),
+	}
+	for _, tctr := range c.Containers {
+		if tctr != nil {
+			m.containers[strings.ToLower(tctr.Id)] = mainPath
+		}
+	}
+	for _, nw := range c.Networks {
+		if nw != nil {
+			m.networks[nw.Name] = mainPath
+		}
+	}
+	for _, vol := range c.Volumes {
+		if vol != nil {
+			m.volumes[vol.Name] = mainPath
+		}
+	}
+	for _, repo := range c.Repos {
+		if repo != nil {
+			m.repos[repo.Url] = mainPath
+		}
+	}
+	return m
+}
+
+// merge adds a fragment, items conflicting with an earlier file are reported and skipped.
+func (m *merger) merge(v *validator, name string, frag *Fragment) {
+	for _, tctr := range frag.Containers {
+		if tctr == nil {
+			continue
+		}
+		if other, ok := m.containers[strings.ToLower(tctr.Id)]; ok && tctr.Id != "" {
+			v.addf("container %s is defined in both %s and %s", tctr.Id, other, name)
+			continue
+		}
+		m.containers[strings.ToLower(tctr.Id)] = name
+		tctr.Source = name
+		m.conf.Containers = append(m.conf.Containers, tctr)
+	}
+	for _, nw := range frag.Networks {
+		if nw == nil {
+			continue
+		}
+		if other, ok := m.networks[nw.Name]; ok && nw.Name != "" {
+			v.addf("network %s is defined in both %s and %s", nw.Name, other, name)
+			continue
+		}
+		m.networks[nw.Name] = name
+		m.conf.Networks = append(m.conf.Networks, nw)
+	}
+	for _, vol := range frag.Volumes {
+		if vol == nil {
+			continue
+		}
+		if other, ok := m.volumes[vol.Name]; ok {
+			v.addf("volume %s is defined in both %s and %s", vol.Name, other, name)
+			continue
+		}
+		m.volumes[vol.Name] = name
+		m.conf.Volumes = append(m.conf.Volumes, vol)
+	}
+	for _, repo := range frag.Repos {
+		if repo == nil {
+			continue
+		}
+		// The same repo may be listed by several teams.
+		if other, ok := m.repos[repo.Url]; ok {
+			if !reflect.DeepEqual(repo, m.conf.getRepo(repo.Url)) {
+				v.addf("repo %s is defined differently in %s and %s", repo.Url, other, name)
+			}
+			continue
+		}
+		m.repos[repo.Url] = name
+		m.conf.Repos = append(m.conf.Repos, repo)
+	}
+}
+
+func (c *DevicedConfig) getRepo(url string) *RemoteRepository {
+	for _, repo := range c.Repos {
+		if repo != nil && repo.Url == url {
+			return repo
+		}
+	}
+	return nil
+}
+
+// UpdateTargetInFile changes the target with the given id in the file
+// it is defined in, the main config or a fragment.
+func UpdateTargetInFile(name string, fragment bool, id string, update func(tctr *TargetContainer)) error {
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	var containers *[]*TargetContainer
+	if fragment {
+		frag := &Fragment{}
+		doc, containers = frag, &frag.Containers
+	} else {
+		conf := &DevicedConfig{}
+		doc, containers = conf, &conf.Containers
+	}
+	if err := yaml.UnmarshalStrict(dat, doc); err != nil {
+		return fileError(name, err)
+	}
+	for _, tctr := range *containers {
+		if tctr != nil && strings.EqualFold(tctr.Id, id) {
+			update(tctr)
+			out, err := yaml.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			return ioutils.AtomicWriteFile(name, out, 0600)
+		}
+	}
+	return fmt.Errorf("no target with id %s in %s", id, name)
+}
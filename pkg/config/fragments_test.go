@@ -0,0 +1,106 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConfigDirMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fragDir := path.Join(dir, "deviced.d")
+	os.Mkdir(fragDir, 0755)
+
+	mainPath := path.Join(dir, "deviced.yaml")
+	writeTestFiles(t, dir, map[string]string{
+		"deviced.yaml": "containers:\n  - id: core\n    image: robot/core\n",
+	})
+	writeTestFiles(t, fragDir, map[string]string{
+		"20-nav.yaml":   "containers:\n  - id: nav\n    image: robot/nav\n    dockerHostConfig:\n      networkMode: ros\n",
+		"10-net.yaml":   "networks:\n  - name: ros\n",
+		"README.md":     "not a fragment",
+		".swap.yaml":    "not a fragment either",
+		"30-repos.yaml": "repos:\n  - url: https://registry.local/\n",
+	})
+
+	files, err := ReadConfigFiles(mainPath, fragDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files.Fragments()) != 3 {
+		t.Fatalf("expected 3 fragments, got %v", files.Fragments())
+	}
+	c, err := files.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Containers) != 2 || c.Containers[1].Id != "nav" {
+		t.Fatalf("containers not merged in order: %v", c.Containers)
+	}
+	if c.Containers[0].Source != mainPath || c.Containers[1].Source != path.Join(fragDir, "20-nav.yaml") {
+		t.Fatalf("unexpected sources %s, %s", c.Containers[0].Source, c.Containers[1].Source)
+	}
+	if len(c.Networks) != 1 || len(c.Repos) != 1 {
+		t.Fatalf("networks or repos not merged")
+	}
+
+	// Stored in the history and restored.
+	dat, err := files.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := UnmarshalConfigFiles(dat)
+	if err != nil || stored.Digest() != files.Digest() {
+		t.Fatalf("files changed when stored, %v", err)
+	}
+	writeTestFiles(t, fragDir, map[string]string{"40-new.yaml": "containers: []\n"})
+	if err := stored.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(fragDir, "40-new.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("expected the new fragment to be removed")
+	}
+}
+
+func TestConfigDirConflicts(t *testing.T) {
+	files := &ConfigFiles{
+		Main: "main.yaml",
+		Files: map[string]string{
+			"main.yaml": "containers:\n  - id: nav\n    image: robot/nav\nnetworks:\n  - name: ros\n",
+			"a.yaml":    "containers:\n  - id: NAV\n    image: other/nav\nrepos:\n  - url: https://registry.local/\n",
+			"b.yaml":    "networks:\n  - name: ros\nrepos:\n  - url: https://registry.local/\n    insecure: true\n",
+		},
+	}
+	_, err := files.Parse()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	expected := []string{
+		"container NAV is defined in both main.yaml and a.yaml",
+		"network ros is defined in both main.yaml and b.yaml",
+		"repo https://registry.local/ is defined differently in a.yaml and b.yaml",
+	}
+	if strings.Join(verr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected problems %v", verr.Problems)
+	}
+
+	files.Files["b.yaml"] = "dataDir: /tmp\n"
+	if _, err := files.Parse(); err == nil || !strings.HasPrefix(err.Error(), "b.yaml:") {
+		t.Fatalf("expected settings in a fragment to be rejected, got %v", err)
+	}
+}
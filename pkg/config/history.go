@@ -0,0 +1,252 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+)
+
+// Revision states.
+const (
+	// Applied and waiting for the trial to pass
+	RevisionTrial string = "trial"
+	// Passed its trial or was confirmed, a rollback target
+	RevisionGood string = "good"
+	// Rolled back to an earlier revision
+	RevisionReverted string = "reverted"
+	// Replaced by a newer config before its trial ended
+	RevisionSuperseded string = "superseded"
+)
+
+// Revision is one applied config file.
+type Revision struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Hash    string    `json:"hash"`
+	State   string    `json:"state"`
+	// Why the revision is in its state, e.g. why it was reverted
+	Message string    `json:"message,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// ConfigDigest returns the hash of a config file as stored in the history.
+func ConfigDigest(dat []byte) string {
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])
+}
+
+// History keeps the applied config files, newest last, in a directory.
+type History struct {
+	Dir   string
+	Limit int
+
+	mtx       sync.Mutex
+	revisions []*Revision
+}
+
+// OpenHistory loads the history in dir, starting empty if there is none.
+func OpenHistory(dir string, limit int) (*History, error) {
+	h := &History{Dir: dir, Limit: limit}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dat, err := ioutil.ReadFile(h.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(dat, &h.revisions); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *History) indexPath() string {
+	return path.Join(h.Dir, "history.json")
+}
+
+func (h *History) revisionPath(version int) string {
+	return path.Join(h.Dir, fmt.Sprintf("%06d.yaml", version))
+}
+
+// save must be called with mtx locked.
+func (h *History) save() error {
+	dat, err := json.MarshalIndent(h.revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(h.indexPath(), dat, 0600)
+}
+
+// Add stores a config file as a new revision.
+func (h *History) Add(dat []byte, state string, message string) (*Revision, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	version := 1
+	if len(h.revisions) != 0 {
+		version = h.revisions[len(h.revisions)-1].Version + 1
+	}
+	now := time.Now()
+	rev := &Revision{
+		Version: version,
+		Time:    now,
+		Hash:    ConfigDigest(dat),
+		State:   state,
+		Message: message,
+		Updated: now,
+	}
+	if err := ioutils.AtomicWriteFile(h.revisionPath(version), dat, 0600); err != nil {
+		return nil, err
+	}
+	h.revisions = append(h.revisions, rev)
+	h.prune()
+	revc := *rev
+	return &revc, h.save()
+}
+
+// prune drops the oldest revisions past the limit, keeping the newest good
+// revision so there is always something to roll back to.
+func (h *History) prune() {
+	if h.Limit < 1 || len(h.revisions) <= h.Limit {
+		return
+	}
+	lastGood := h.lastGood(0)
+	var kept []*Revision
+	excess := len(h.revisions) - h.Limit
+	for _, rev := range h.revisions {
+		if excess > 0 && rev != lastGood {
+			os.Remove(h.revisionPath(rev.Version))
+			excess--
+			continue
+		}
+		kept = append(kept, rev)
+	}
+	h.revisions = kept
+}
+
+// Revisions returns a copy of the history, oldest first.
+func (h *History) Revisions() []*Revision {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	res := make([]*Revision, len(h.revisions))
+	for i, rev := range h.revisions {
+		revc := *rev
+		res[i] = &revc
+	}
+	return res
+}
+
+func (h *History) get(version int) *Revision {
+	for _, rev := range h.revisions {
+		if rev.Version == version {
+			return rev
+		}
+	}
+	return nil
+}
+
+// Get returns a revision, or nil if it is not in the history.
+func (h *History) Get(version int) *Revision {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	rev := h.get(version)
+	if rev == nil {
+		return nil
+	}
+	revc := *rev
+	return &revc
+}
+
+// Latest returns the newest revision, or nil if the history is empty.
+func (h *History) Latest() *Revision {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if len(h.revisions) == 0 {
+		return nil
+	}
+	revc := *h.revisions[len(h.revisions)-1]
+	return &revc
+}
+
+// lastGood must be called with mtx locked.
+func (h *History) lastGood(before int) *Revision {
+	for i := len(h.revisions) - 1; i >= 0; i-- {
+		rev := h.revisions[i]
+		if rev.State == RevisionGood && (before == 0 || rev.Version < before) {
+			return rev
+		}
+	}
+	return nil
+}
+
+// LastGood returns the newest good revision older than version,
+// any version if 0, or nil if there is none.
+func (h *History) LastGood(before int) *Revision {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	rev := h.lastGood(before)
+	if rev == nil {
+		return nil
+	}
+	revc := *rev
+	return &revc
+}
+
+// Read returns the config file of a revision.
+func (h *History) Read(version int) ([]byte, error) {
+	return ioutil.ReadFile(h.revisionPath(version))
+}
+
+// SetState changes the state of a revision.
+func (h *History) SetState(version int, state string, message string) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	rev := h.get(version)
+	if rev == nil {
+		return fmt.Errorf("revision %d is not in the history", version)
+	}
+	rev.State = state
+	rev.Message = message
+	rev.Updated = time.Now()
+	return h.save()
+}
+
+// Confirm marks a revision on trial as good. Version 0 is the newest revision.
+func (h *History) Confirm(version int, message string) (*Revision, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	var rev *Revision
+	if version == 0 && len(h.revisions) != 0 {
+		rev = h.revisions[len(h.revisions)-1]
+	} else {
+		rev = h.get(version)
+	}
+	if rev == nil {
+		return nil, fmt.Errorf("revision %d is not in the history", version)
+	}
+	if rev.State != RevisionTrial {
+		return nil, fmt.Errorf("revision %d is %s, not on trial", rev.Version, rev.State)
+	}
+	rev.State = RevisionGood
+	rev.Message = message
+	rev.Updated = time.Now()
+	revc := *rev
+	return &revc, h.save()
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := OpenHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Add([]byte("containers: []\n"), RevisionGood, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := h.Add([]byte("repos: []\n"), RevisionTrial, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The only good revision is kept past the limit.
+	revs := h.Revisions()
+	if len(revs) != 3 || revs[0].Version != 1 || revs[1].Version != 3 {
+		t.Fatalf("unexpected revisions after pruning %v", revs)
+	}
+	if _, err := h.Read(2); !os.IsNotExist(err) {
+		t.Fatalf("expected revision 2 to be removed")
+	}
+	if good := h.LastGood(4); good == nil || good.Version != 1 {
+		t.Fatalf("expected revision 1 to be the last good one, got %v", good)
+	}
+
+	if _, err := h.Confirm(0, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Confirm(4, "again"); err == nil {
+		t.Fatal("expected confirming a good revision to fail")
+	}
+
+	// Reopening reads the index back.
+	h, err = OpenHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := h.Latest()
+	if latest == nil || latest.Version != 4 || latest.State != RevisionGood {
+		t.Fatalf("unexpected latest revision %v", latest)
+	}
+	dat, err := h.Read(1)
+	if err != nil || string(dat) != "containers: []\n" {
+		t.Fatalf("unexpected revision 1 contents %q, %v", dat, err)
+	}
+	if latest.Hash != ConfigDigest([]byte("repos: []\n")) {
+		t.Fatalf("unexpected hash %s", latest.Hash)
+	}
+}
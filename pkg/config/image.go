@@ -1,14 +1,63 @@
 package config
 
-import "fmt"
+import (
+	"os"
+	"path"
+)
+
+const (
+	// Pull images through the Docker daemon
+	PullModeDaemon string = "daemon"
+	// Fetch blobs directly with resume support, then load into the daemon
+	PullModeDirect string = "direct"
+)
 
 type ImageWorkerConfig struct {
 	RecheckPeriod int `yaml:"recheckPeriod"`
+	// "daemon" (default) or "direct"
+	PullMode string `yaml:"pullMode,omitempty"`
+	// Blob cache for direct pulls
+	CacheDir string `yaml:"cacheDir,omitempty"`
+	// Attempts per blob in direct mode before giving up
+	MaxBlobRetries int  `yaml:"maxBlobRetries,omitempty"`
+	KeepBlobCache  bool `yaml:"keepBlobCache,omitempty"`
+	// Use the auths and credential helpers of a Docker config.json for
+	// repos without credentials of their own
+	UseDockerConfig bool `yaml:"useDockerConfig,omitempty"`
+	// Defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json
+	DockerConfigPath string `yaml:"dockerConfigPath,omitempty"`
+}
+
+// DefaultDockerConfigPath returns where the docker CLI keeps its config.
+func DefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return path.Join(dir, "config.json")
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = "/root"
+	}
+	return path.Join(home, ".docker", "config.json")
 }
 
 func (c *ImageWorkerConfig) FillWithDefaults() {
 	if c.RecheckPeriod == 0 {
 		c.RecheckPeriod = 60
-		fmt.Printf("Using default recheck period of %d\n", c.RecheckPeriod)
+		log.Infof("Using default recheck period of %d", c.RecheckPeriod)
+	}
+	if c.PullMode == "" {
+		c.PullMode = PullModeDaemon
+	}
+	if c.UseDockerConfig && c.DockerConfigPath == "" {
+		c.DockerConfigPath = DefaultDockerConfigPath()
+	}
+	if c.PullMode == PullModeDirect {
+		if c.CacheDir == "" {
+			c.CacheDir = "/var/lib/deviced/blobs"
+			log.Infof("Using default blob cache dir of %s", c.CacheDir)
+		}
+		if c.MaxBlobRetries == 0 {
+			c.MaxBlobRetries = 5
+		}
 	}
 }
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	dcapi "github.com/fuserobotics/deviced/pkg/types"
+)
+
+const (
+	// Long running container, recreated or restarted when it exits
+	TargetKindService string = "service"
+	// Runs to completion once per version
+	TargetKindJob string = "job"
+	// Reported in the status for targets with a schedule, not a config kind
+	TargetKindScheduled string = "scheduled"
+)
+
+const (
+	JobRunPerVersion string = "version"
+	JobRunPerConfig  string = "config"
+)
+
+// InitContainer must exit successfully before the target container starts.
+type InitContainer struct {
+	Name string `yaml:"name"`
+	// Defaults to the image and tag selected for the target
+	Image            string           `yaml:"image,omitempty"`
+	DockerConfig     dcapi.Config     `yaml:"dockerConfig,omitempty"`
+	DockerHostConfig dcapi.HostConfig `yaml:"dockerHostConfig,omitempty"`
+	// Defaults to 10 minutes
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+func (tc *TargetContainer) IsJob() bool {
+	return strings.EqualFold(tc.Kind, TargetKindJob)
+}
+
+// IsScheduled checks if the target runs to completion on a cron schedule.
+func (tc *TargetContainer) IsScheduled() bool {
+	return tc.Schedule != ""
+}
+
+// RunsToCompletion checks if containers of the target are expected to exit.
+func (tc *TargetContainer) RunsToCompletion() bool {
+	return tc.IsJob() || tc.IsScheduled()
+}
+
+const DefaultHistoryLimit int = 5
+
+func (tc *TargetContainer) EffectiveHistoryLimit() int {
+	if tc.HistoryLimit > 0 {
+		return tc.HistoryLimit
+	}
+	return DefaultHistoryLimit
+}
+
+// ConfigHash is a short digest of the target definition.
+func (tc *TargetContainer) ConfigHash() string {
+	dat, err := json.Marshal(tc)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// JobRunKey identifies a job run, the job runs again when it changes.
+func (tc *TargetContainer) JobRunKey(tag string) string {
+	if strings.EqualFold(tc.RunPer, JobRunPerConfig) {
+		return strings.Join([]string{tag, tc.ConfigHash()}, "-")
+	}
+	return tag
+}
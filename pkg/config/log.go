@@ -0,0 +1,44 @@
+package config
+
+import (
+	"github.com/fuserobotics/deviced/pkg/logging"
+)
+
+type LogConfig struct {
+	// panic, fatal, error, warning, info or debug
+	Level string `yaml:"level,omitempty"`
+	// text or json, json lines use the jsonlog format
+	Format string `yaml:"format,omitempty"`
+	// Number of recent entries kept for the API, 0 for the default, negative disables the buffer
+	BufferSize int `yaml:"bufferSize,omitempty"`
+}
+
+const (
+	DefaultLogLevel      string = "info"
+	DefaultLogBufferSize int    = 200
+)
+
+func (c *LogConfig) FillWithDefaults() {
+	if c.Level == "" {
+		c.Level = DefaultLogLevel
+	}
+	if c.Format == "" {
+		c.Format = logging.FormatText
+	}
+	if c.BufferSize == 0 {
+		c.BufferSize = DefaultLogBufferSize
+	}
+}
+
+func (c *LogConfig) Validate() error {
+	return logging.Validate(c.Level, c.Format)
+}
+
+// Apply configures the logger.
+func (c *LogConfig) Apply() error {
+	bufferSize := c.BufferSize
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	return logging.Configure(c.Level, c.Format, bufferSize)
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+const (
+	LogForwardSyslog string = "syslog"
+	LogForwardHttp   string = "http"
+)
+
+// ContainerLogConfig configures collection of the output of managed containers.
+type ContainerLogConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Where log files are written, defaults to <dataDir>/logs
+	Dir string `yaml:"dir,omitempty"`
+	// Size at which a target's log file is rotated, in megabytes
+	MaxSizeMB int `yaml:"maxSizeMB,omitempty"`
+	// Rotated files kept per target
+	MaxFiles int `yaml:"maxFiles,omitempty"`
+	// Optional remote sink
+	Forward *LogForwardConfig `yaml:"forward,omitempty"`
+}
+
+// LogForwardConfig is a remote sink for collected lines.
+type LogForwardConfig struct {
+	// "syslog" or "http"
+	Type string `yaml:"type"`
+	// syslog: udp://host:514, tcp://host:514 or unix:///dev/log, empty for the local syslog
+	// http: URL the lines are POSTed to as newline delimited JSON
+	Address string `yaml:"address,omitempty"`
+	// Syslog tag, defaults to deviced
+	Tag string `yaml:"tag,omitempty"`
+	// Lines are buffered on disk while the sink is unreachable, oldest are dropped past this size
+	MaxBufferMB int `yaml:"maxBufferMB,omitempty"`
+}
+
+const (
+	DefaultLogMaxSizeMB   int = 10
+	DefaultLogMaxFiles    int = 5
+	DefaultLogMaxBufferMB int = 50
+)
+
+func (c *ContainerLogConfig) FillWithDefaults(dataDir string) {
+	if c.Dir == "" {
+		c.Dir = path.Join(dataDir, "logs")
+	}
+	if c.MaxSizeMB == 0 {
+		c.MaxSizeMB = DefaultLogMaxSizeMB
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = DefaultLogMaxFiles
+	}
+	if c.Forward != nil {
+		if c.Forward.Tag == "" {
+			c.Forward.Tag = "deviced"
+		}
+		if c.Forward.MaxBufferMB == 0 {
+			c.Forward.MaxBufferMB = DefaultLogMaxBufferMB
+		}
+	}
+}
+
+// BufferDir is where lines wait to be forwarded.
+func (c *ContainerLogConfig) BufferDir() string {
+	return path.Join(c.Dir, "forward")
+}
+
+func (c *ContainerLogConfig) Validate() error {
+	if c.Forward == nil {
+		return nil
+	}
+	switch c.Forward.Type {
+	case LogForwardSyslog:
+	case LogForwardHttp:
+		if c.Forward.Address == "" {
+			return errors.New("containerLogs.forward: http forwarding needs an address")
+		}
+	default:
+		return fmt.Errorf("containerLogs.forward: unknown type %q", c.Forward.Type)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	dcapi "github.com/docker/docker/api/types"
+)
+
+// GetNetwork returns the network definition with the given name, or nil.
+func (c *DevicedConfig) GetNetwork(name string) *dcapi.NetworkCreateRequest {
+	for _, net := range c.Networks {
+		if net.Name == name {
+			return net
+		}
+	}
+	return nil
+}
+
+// NetworkHash returns a short hash of a network definition,
+// used to notice when a definition changes.
+func NetworkHash(net *dcapi.NetworkCreateRequest) string {
+	dat, _ := json.Marshal(net)
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ValidateNetworks checks network names are unique and subnets do not overlap.
+func (c *DevicedConfig) ValidateNetworks() error {
+	type subnet struct {
+		network string
+		ipnet   *net.IPNet
+	}
+	var subnets []subnet
+	names := make(map[string]bool)
+	for _, nw := range c.Networks {
+		if nw.Name == "" {
+			return fmt.Errorf("network definition with empty name")
+		}
+		if names[nw.Name] {
+			return fmt.Errorf("network %s defined more than once", nw.Name)
+		}
+		names[nw.Name] = true
+		if nw.IPAM == nil {
+			continue
+		}
+		for _, ipam := range nw.IPAM.Config {
+			if ipam.Subnet == "" {
+				continue
+			}
+			_, ipnet, err := net.ParseCIDR(ipam.Subnet)
+			if err != nil {
+				return fmt.Errorf("network %s has invalid subnet %s, %v", nw.Name, ipam.Subnet, err)
+			}
+			for _, other := range subnets {
+				if other.ipnet.Contains(ipnet.IP) || ipnet.Contains(other.ipnet.IP) {
+					return fmt.Errorf("network %s subnet %s overlaps network %s subnet %s", nw.Name, ipnet, other.network, other.ipnet)
+				}
+			}
+			subnets = append(subnets, subnet{network: nw.Name, ipnet: ipnet})
+		}
+	}
+	return nil
+}
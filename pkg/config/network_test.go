@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+
+	dcapi "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+func testNetwork(name string, subnets ...string) *dcapi.NetworkCreateRequest {
+	nw := &dcapi.NetworkCreateRequest{Name: name}
+	nw.IPAM = &network.IPAM{}
+	for _, subnet := range subnets {
+		nw.IPAM.Config = append(nw.IPAM.Config, network.IPAMConfig{Subnet: subnet})
+	}
+	return nw
+}
+
+func TestValidateNetworks(t *testing.T) {
+	c := &DevicedConfig{Networks: []*dcapi.NetworkCreateRequest{
+		testNetwork("ros", "172.30.0.0/24"),
+		testNetwork("ctl", "172.30.1.0/24"),
+	}}
+	if err := c.ValidateNetworks(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	c.Networks = append(c.Networks, testNetwork("wide", "172.30.0.0/16"))
+	if err := c.ValidateNetworks(); err == nil {
+		t.Fatal("expected overlapping subnets to be rejected")
+	}
+
+	c.Networks = []*dcapi.NetworkCreateRequest{testNetwork("ros"), testNetwork("ros")}
+	if err := c.ValidateNetworks(); err == nil {
+		t.Fatal("expected duplicate network names to be rejected")
+	}
+}
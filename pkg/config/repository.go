@@ -1,34 +1,69 @@
 package config
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"github.com/docker/engine-api/types"
+	"fmt"
+	"net/url"
+
+	"github.com/fuserobotics/deviced/pkg/secrets"
 )
 
 type RemoteRepository struct {
-	Url         string              `yaml:"url"`
-	PullPrefix  string              `yaml:"pullPrefix"`
-	Username    string              `yaml:"username,omitempty"`
-	Password    string              `yaml:"password,omitempty"`
-	MetaHeaders map[string][]string `yaml:"metaHeaders,omitempty"`
-	Insecure    bool                `yaml:"insecure,omitempty"`
+	Url        string `yaml:"url"`
+	PullPrefix string `yaml:"pullPrefix"`
+	Username   string `yaml:"username,omitempty"`
+	Password   string `yaml:"password,omitempty"`
+	// Secret reference for the password: file:/path, env:NAME or store:name
+	PasswordFrom string `yaml:"passwordFrom,omitempty"`
+	// Exchanged with the token server for access tokens, renewed tokens
+	// are kept in the data dir
+	IdentityToken string `yaml:"identityToken,omitempty"`
+	// Bearer token sent to the registry as is
+	RegistryToken string              `yaml:"registryToken,omitempty"`
+	MetaHeaders   map[string][]string `yaml:"metaHeaders,omitempty"`
+	Insecure      bool                `yaml:"insecure,omitempty"`
 }
 
 func (r *RemoteRepository) RequiresAuth() bool {
 	return r.Username != ""
 }
 
-// Later validate that it's a OK URL
-func (r *RemoteRepository) Validate() bool {
-	return r.Url != ""
+// HasCredentials checks if the repo sets credentials of its own, otherwise
+// they may come from the Docker config.
+func (r *RemoteRepository) HasCredentials() bool {
+	return r.Username != "" || r.IdentityToken != "" || r.RegistryToken != ""
+}
+
+// Validate checks the url is an absolute http(s) url.
+func (r *RemoteRepository) Validate() error {
+	if r.Url == "" {
+		return fmt.Errorf("missing url")
+	}
+	u, err := url.Parse(r.Url)
+	if err != nil {
+		return fmt.Errorf("invalid url %s, %v", r.Url, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %s, expected http(s)://host[:port]", r.Url)
+	}
+	if r.PasswordFrom != "" {
+		if r.Password != "" {
+			return fmt.Errorf("%s: set password or passwordFrom, not both", r.Url)
+		}
+		if _, err := secrets.ParseRef(r.PasswordFrom); err != nil {
+			return fmt.Errorf("%s: passwordFrom: %v", r.Url, err)
+		}
+	}
+	return nil
 }
 
-func (r *RemoteRepository) BuildBase64Creds() string {
-	auth := types.AuthConfig{
-		Username: r.Username,
-		Password: r.Password,
+// ResolvePassword returns the password, reading passwordFrom if set.
+func (r *RemoteRepository) ResolvePassword(store *secrets.Store) (string, error) {
+	if r.PasswordFrom == "" {
+		return r.Password, nil
+	}
+	password, err := store.ResolveString(r.PasswordFrom)
+	if err != nil {
+		return "", fmt.Errorf("password of %s: %v", r.Url, err)
 	}
-	authBytes, _ := json.Marshal(auth)
-	return base64.StdEncoding.EncodeToString(authBytes)
+	return password, nil
 }
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// RollbackConfig controls how a new config is tried before it is kept.
+type RollbackConfig struct {
+	// Apply new configs right away without a trial
+	Disabled bool `yaml:"disabled,omitempty"`
+	// How long a new config is on trial, defaults to 5m
+	TrialPeriod string `yaml:"trialPeriod,omitempty"`
+	// Revert if a target stays unhealthy this long during the trial, defaults to 2m
+	UnhealthyTimeout string `yaml:"unhealthyTimeout,omitempty"`
+	// Revert at the end of the trial unless the config was confirmed via the API
+	RequireConfirm bool `yaml:"requireConfirm,omitempty"`
+	// Applied configs kept in the history
+	HistoryLimit int `yaml:"historyLimit,omitempty"`
+}
+
+const (
+	DefaultTrialPeriod        string = "5m"
+	DefaultUnhealthyTimeout   string = "2m"
+	DefaultConfigHistoryLimit int    = 10
+)
+
+func (c *RollbackConfig) FillWithDefaults() {
+	if c.TrialPeriod == "" {
+		c.TrialPeriod = DefaultTrialPeriod
+	}
+	if c.UnhealthyTimeout == "" {
+		c.UnhealthyTimeout = DefaultUnhealthyTimeout
+	}
+	if c.HistoryLimit == 0 {
+		c.HistoryLimit = DefaultConfigHistoryLimit
+	}
+}
+
+func (c *RollbackConfig) Validate() error {
+	for _, d := range []string{c.TrialPeriod, c.UnhealthyTimeout} {
+		if d == "" {
+			continue
+		}
+		if dur, err := time.ParseDuration(d); err != nil || dur <= 0 {
+			return fmt.Errorf("rollback: invalid duration %q, expected a duration like 5m", d)
+		}
+	}
+	return nil
+}
+
+// TrialDuration returns the trial period, call after FillWithDefaults.
+func (c *RollbackConfig) TrialDuration() time.Duration {
+	d, _ := time.ParseDuration(c.TrialPeriod)
+	return d
+}
+
+// UnhealthyDuration returns the unhealthy timeout, call after FillWithDefaults.
+func (c *RollbackConfig) UnhealthyDuration() time.Duration {
+	d, _ := time.ParseDuration(c.UnhealthyTimeout)
+	return d
+}
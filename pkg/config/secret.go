@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/fuserobotics/deviced/pkg/redact"
+	"github.com/fuserobotics/deviced/pkg/secrets"
+)
+
+// ContainerSecretsPath is where secrets are mounted in containers.
+const ContainerSecretsPath string = "/run/secrets"
+
+// DefaultSecretsDir is the host tmpfs the secret files of containers are written to.
+const DefaultSecretsDir string = "/run/deviced/secrets"
+
+// ContainerSecret is mounted read-only at /run/secrets/<name> in the container.
+type ContainerSecret struct {
+	Name string `yaml:"name"`
+	// file:/path, env:NAME or store:name
+	From string `yaml:"from"`
+}
+
+// Validate checks the name and reference.
+func (s *ContainerSecret) Validate() error {
+	if err := secrets.ValidName(s.Name); err != nil {
+		return err
+	}
+	if s.From == "" {
+		return fmt.Errorf("secret %s: missing from", s.Name)
+	}
+	if _, err := secrets.ParseRef(s.From); err != nil {
+		return fmt.Errorf("secret %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+// SecretStoreDir is where the encrypted secret store is kept.
+func (c *DevicedConfig) SecretStoreDir() string {
+	return path.Join(c.DataDir, "secrets")
+}
+
+// registerSecrets adds the plain passwords and tokens in the config to the redacted values.
+func (c *DevicedConfig) registerSecrets() {
+	for _, repo := range c.Repos {
+		if repo == nil {
+			continue
+		}
+		for _, val := range []string{repo.Password, repo.IdentityToken, repo.RegistryToken} {
+			if val != "" {
+				redact.Add(val)
+			}
+		}
+	}
+}
+
+// MarshalRedacted returns the config as YAML with passwords, tokens and known
+// secret values replaced, for showing to users.
+func (c *DevicedConfig) MarshalRedacted() ([]byte, error) {
+	cc := *c
+	cc.Repos = make([]*RemoteRepository, len(c.Repos))
+	for i, repo := range c.Repos {
+		if repo == nil {
+			continue
+		}
+		repoc := *repo
+		for _, val := range []*string{&repoc.Password, &repoc.IdentityToken, &repoc.RegistryToken} {
+			if *val != "" {
+				*val = redact.Placeholder
+			}
+		}
+		cc.Repos[i] = &repoc
+	}
+	dat, err := cc.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(redact.String(string(dat))), nil
+}
@@ -0,0 +1,36 @@
+package config
+
+// SnapshotConfig enables volume snapshots before a target is replaced.
+type SnapshotConfig struct {
+	// managed volumes to snapshot, defaults to all used by the target
+	Volumes []string `yaml:"volumes,omitempty"`
+	// snapshots to keep per target, defaults to 3
+	Keep int `yaml:"keep,omitempty"`
+}
+
+const DefaultSnapshotKeep int = 3
+
+// EffectiveKeep returns the number of snapshots to keep.
+func (sc *SnapshotConfig) EffectiveKeep() int {
+	if sc.Keep <= 0 {
+		return DefaultSnapshotKeep
+	}
+	return sc.Keep
+}
+
+// SnapshotVolumes returns the managed volumes to snapshot for a target.
+func (c *DevicedConfig) SnapshotVolumes(tctr *TargetContainer) []string {
+	if tctr.Snapshot == nil {
+		return nil
+	}
+	if len(tctr.Snapshot.Volumes) == 0 {
+		return c.TargetVolumes(tctr)
+	}
+	var names []string
+	for _, name := range tctr.Snapshot.Volumes {
+		if c.GetVolume(name) != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
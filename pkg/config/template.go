@@ -0,0 +1,170 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fuserobotics/deviced/pkg/arch"
+	"github.com/fuserobotics/deviced/pkg/utils"
+	"github.com/go-yaml/yaml"
+)
+
+// DefaultFactsFile is read for facts if it exists and factsFile is not set.
+const DefaultFactsFile string = "/etc/deviced/facts.yaml"
+
+// factsPrefix selects a fact instead of an environment variable.
+const factsPrefix string = "facts."
+
+// Facts are the device specific values available as ${facts.name}.
+type Facts map[string]string
+
+// BuiltinFacts returns the facts every device has: arch, hostname and machineId.
+func BuiltinFacts() Facts {
+	facts := Facts{"arch": arch.GetArch()}
+	if hostname, err := os.Hostname(); err == nil {
+		facts["hostname"] = hostname
+	}
+	if id, err := utils.MachineId(); err == nil {
+		facts["machineId"] = id
+	}
+	return facts
+}
+
+// EffectiveFactsFile returns the facts file to read.
+func (c *DevicedConfig) EffectiveFactsFile() string {
+	if c.FactsFile != "" {
+		return c.FactsFile
+	}
+	return DefaultFactsFile
+}
+
+// LoadFacts returns the builtin facts overlaid with the facts file, a flat
+// YAML map. The default facts file is optional, a configured one is not.
+func (c *DevicedConfig) LoadFacts() (Facts, error) {
+	facts := BuiltinFacts()
+	name := c.EffectiveFactsFile()
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) && c.FactsFile == "" {
+			return facts, nil
+		}
+		return nil, err
+	}
+	fileFacts := make(map[string]string)
+	if err := yaml.Unmarshal(dat, &fileFacts); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for k, v := range fileFacts {
+		facts[k] = v
+	}
+	return facts, nil
+}
+
+// renderer substitutes variables, collecting undefined ones as problems.
+type renderer struct {
+	facts     Facts
+	lookupEnv func(name string) (string, bool)
+	v         *validator
+}
+
+// render expands ${NAME} from the environment and ${facts.name} from the
+// facts. ${NAME:-default} falls back to default, $$ is a literal $.
+func (r *renderer) render(where string, s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			buf.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			buf.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			r.v.addf("%s: unterminated variable in %q", where, s)
+			return s
+		}
+		expr := s[i+2 : i+end]
+		i += end
+
+		name, def, hasDef := expr, "", false
+		if idx := strings.Index(expr, ":-"); idx >= 0 {
+			name, def, hasDef = expr[:idx], expr[idx+2:], true
+		}
+		var val string
+		var ok bool
+		if strings.HasPrefix(name, factsPrefix) {
+			val, ok = r.facts[strings.TrimPrefix(name, factsPrefix)]
+		} else {
+			val, ok = r.lookupEnv(name)
+		}
+		if !ok {
+			if !hasDef {
+				r.v.addf("%s: ${%s} is not set", where, name)
+			}
+			val = def
+		}
+		buf.WriteString(val)
+	}
+	return buf.String()
+}
+
+func (r *renderer) renderList(where string, list []string) {
+	for i := range list {
+		list[i] = r.render(where, list[i])
+	}
+}
+
+func (r *renderer) renderMap(where string, m map[string]string) {
+	for k, val := range m {
+		m[k] = r.render(where, val)
+	}
+}
+
+// Render substitutes variables in the image names, env, labels and binds of
+// the targets, their init containers and hook containers.
+func (c *DevicedConfig) Render(facts Facts) error {
+	v := &validator{}
+	r := &renderer{facts: facts, lookupEnv: os.LookupEnv, v: v}
+	for _, tctr := range c.Containers {
+		if tctr == nil {
+			continue
+		}
+		prefix := "container " + tctr.Id
+		tctr.Image = r.render(prefix+" image", tctr.Image)
+		r.renderList(prefix+" env", tctr.DockerConfig.Env)
+		r.renderMap(prefix+" labels", tctr.DockerConfig.Labels)
+		r.renderList(prefix+" binds", tctr.DockerHostConfig.Binds)
+		for _, init := range tctr.InitContainers {
+			iprefix := fmt.Sprintf("%s: init container %s", prefix, init.Name)
+			init.Image = r.render(iprefix+" image", init.Image)
+			r.renderList(iprefix+" env", init.DockerConfig.Env)
+			r.renderMap(iprefix+" labels", init.DockerConfig.Labels)
+			r.renderList(iprefix+" binds", init.DockerHostConfig.Binds)
+		}
+		hooks := &tctr.LifecycleHooks
+		for _, phase := range [][]LifecycleHook{hooks.OnStop, hooks.PreUpdate, hooks.PreStart, hooks.PostStart, hooks.OnUpgrade, hooks.OnRemove} {
+			for i := range phase {
+				if hc := phase[i].Container; hc != nil {
+					hc.Image = r.render(prefix+" hook image", hc.Image)
+					r.renderList(prefix+" hook env", hc.Env)
+					r.renderList(prefix+" hook binds", hc.Binds)
+				}
+			}
+		}
+	}
+	return v.err()
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	r := &renderer{
+		facts: Facts{"serial": "SN42", "hostname": "robot-7"},
+		lookupEnv: func(name string) (string, bool) {
+			if name == "REGISTRY" {
+				return "registry.local", true
+			}
+			return "", false
+		},
+		v: &validator{},
+	}
+	cases := map[string]string{
+		"${REGISTRY}/nav":                   "registry.local/nav",
+		"SERIAL=${facts.serial}":            "SERIAL=SN42",
+		"/calib/${facts.hostname}:/calib":   "/calib/robot-7:/calib",
+		"LEVEL=${LEVEL:-info}":              "LEVEL=info",
+		"PRICE=$$5 and $HOME":               "PRICE=$5 and $HOME",
+		"${facts.missing:-}${facts.serial}": "SN42",
+	}
+	for in, expected := range cases {
+		if out := r.render("test", in); out != expected {
+			t.Fatalf("render %q: expected %q, got %q", in, expected, out)
+		}
+	}
+	if len(r.v.problems) != 0 {
+		t.Fatalf("unexpected problems %v", r.v.problems)
+	}
+
+	r.render("container nav env", "ID=${facts.calibration}")
+	r.render("container nav env", "ID=${UNSET")
+	if len(r.v.problems) != 2 || r.v.problems[0] != "container nav env: ${facts.calibration} is not set" {
+		t.Fatalf("expected undefined variables to be reported, got %v", r.v.problems)
+	}
+}
+
+func TestParseRendersFacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "facts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	factsPath := path.Join(dir, "facts.yaml")
+	if err := ioutil.WriteFile(factsPath, []byte("serial: SN42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Parse([]byte(`
+factsFile: ` + factsPath + `
+containers:
+  - id: nav
+    image: robot/nav-${facts.arch}
+    dockerConfig:
+      env: ["SERIAL=${facts.serial}"]
+      labels:
+        host: ${facts.hostname}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tctr := c.Containers[0]
+	if tctr.Image != "robot/nav-"+c.Facts["arch"] || tctr.DockerConfig.Env[0] != "SERIAL=SN42" {
+		t.Fatalf("config not rendered: %s %v", tctr.Image, tctr.DockerConfig.Env)
+	}
+	if tctr.DockerConfig.Labels["host"] != c.Facts["hostname"] {
+		t.Fatalf("labels not rendered: %v", tctr.DockerConfig.Labels)
+	}
+
+	_, err = Parse([]byte("factsFile: " + path.Join(dir, "missing.yaml") + "\n"))
+	if err == nil || !strings.Contains(err.Error(), "facts:") {
+		t.Fatalf("expected a configured facts file to be required, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/schedule"
+)
+
+var (
+	// Target ids end up in container names and labels, keep them to a DNS label.
+	validTargetId = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	// Same as the tag grammar of docker references.
+	validVersion = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// ValidationError lists every problem found in a config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) check(err error) {
+	if err != nil {
+		v.problems = append(v.problems, err.Error())
+	}
+}
+
+func (v *validator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// Validate checks the config for errors that would break reconciliation.
+// The returned error is a *ValidationError listing all problems found.
+func (c *DevicedConfig) Validate() error {
+	v := &validator{}
+	v.check(c.LogConfig.Validate())
+	v.check(c.ContainerLogs.Validate())
+	v.check(c.ValidateNetworks())
+	v.check(c.Rollback.Validate())
+	switch c.ImageConfig.PullMode {
+	case "", PullModeDaemon, PullModeDirect:
+	default:
+		v.addf("imageConfig: unknown pull mode %q", c.ImageConfig.PullMode)
+	}
+	for i := range c.ContainerConfig.UpdateWindows {
+		if err := c.ContainerConfig.UpdateWindows[i].Validate(); err != nil {
+			v.addf("containerConfig.updateWindows: %v", err)
+		}
+	}
+	for i, repo := range c.Repos {
+		if err := repo.Validate(); err != nil {
+			v.addf("repos[%d]: %v", i, err)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i, tctr := range c.Containers {
+		if tctr.Id == "" {
+			v.addf("containers[%d]: missing id", i)
+		} else {
+			if !validTargetId.MatchString(tctr.Id) {
+				v.addf("container %s: id must be a DNS label, letters, digits and dashes", tctr.Id)
+			}
+			if ids[strings.ToLower(tctr.Id)] {
+				v.addf("container %s: id used more than once", tctr.Id)
+			}
+			ids[strings.ToLower(tctr.Id)] = true
+		}
+		c.validateTarget(v, tctr)
+	}
+	return v.err()
+}
+
+func (c *DevicedConfig) validateTarget(v *validator, tctr *TargetContainer) {
+	prefix := "container " + tctr.Id
+	if tctr.Image == "" {
+		v.addf("%s: missing image", prefix)
+	}
+	for _, ver := range append(append([]string{}, tctr.Versions...), tctr.Prefetch...) {
+		if !validVersion.MatchString(ver) {
+			v.addf("%s: invalid version tag %q", prefix, ver)
+		}
+	}
+	switch strings.ToLower(tctr.Kind) {
+	case "", TargetKindService, TargetKindJob:
+	default:
+		v.addf("%s: unknown kind %q", prefix, tctr.Kind)
+	}
+	switch strings.ToLower(tctr.RunPer) {
+	case "", JobRunPerVersion, JobRunPerConfig:
+	default:
+		v.addf("%s: unknown runPer %q", prefix, tctr.RunPer)
+	}
+	if tctr.Schedule != "" {
+		if _, err := schedule.Parse(tctr.Schedule); err != nil {
+			v.addf("%s: %v", prefix, err)
+		}
+	}
+	for i := range tctr.UpdateWindows {
+		if err := tctr.UpdateWindows[i].Validate(); err != nil {
+			v.addf("%s: updateWindows: %v", prefix, err)
+		}
+	}
+
+	c.checkNetworkRef(v, prefix, string(tctr.DockerHostConfig.NetworkMode))
+	for name := range tctr.DockerNetworkingConfig.EndpointsConfig {
+		c.checkNetworkRef(v, prefix, name)
+	}
+
+	names := make(map[string]bool)
+	for _, init := range tctr.InitContainers {
+		if init.Name == "" {
+			v.addf("%s: init container without a name", prefix)
+		} else if names[init.Name] {
+			v.addf("%s: init container %s defined more than once", prefix, init.Name)
+		}
+		names[init.Name] = true
+		checkTimeout(v, fmt.Sprintf("%s: init container %s", prefix, init.Name), init.Timeout)
+		c.checkNetworkRef(v, prefix, string(init.DockerHostConfig.NetworkMode))
+	}
+
+	secretNames := make(map[string]bool)
+	for _, secret := range tctr.Secrets {
+		if secret == nil {
+			continue
+		}
+		if err := secret.Validate(); err != nil {
+			v.addf("%s: %v", prefix, err)
+		} else if secretNames[secret.Name] {
+			v.addf("%s: secret %s defined more than once", prefix, secret.Name)
+		}
+		secretNames[secret.Name] = true
+	}
+
+	hooks := tctr.LifecycleHooks
+	phases := []struct {
+		name  string
+		hooks []LifecycleHook
+	}{
+		{"onstop", hooks.OnStop},
+		{"preUpdate", hooks.PreUpdate},
+		{"preStart", hooks.PreStart},
+		{"postStart", hooks.PostStart},
+		{"onUpgrade", hooks.OnUpgrade},
+		{"onRemove", hooks.OnRemove},
+	}
+	for _, phase := range phases {
+		for i, hook := range phase.hooks {
+			c.validateHook(v, fmt.Sprintf("%s: %s hook %d", prefix, phase.name, i), &hook)
+		}
+	}
+}
+
+func (c *DevicedConfig) validateHook(v *validator, prefix string, hook *LifecycleHook) {
+	switch strings.ToLower(hook.FailurePolicy) {
+	case "", HookFailureIgnore, HookFailureAbort:
+	default:
+		v.addf("%s: unknown failurePolicy %q", prefix, hook.FailurePolicy)
+	}
+	if hook.Exec == nil && hook.Http == nil && hook.Container == nil {
+		v.addf("%s: needs exec, http or container", prefix)
+	}
+	if hook.Exec != nil {
+		checkTimeout(v, prefix, hook.Exec.Timeout)
+	}
+	if hook.Http != nil {
+		checkTimeout(v, prefix, hook.Http.Timeout)
+	}
+	if hook.Container != nil {
+		checkTimeout(v, prefix, hook.Container.Timeout)
+		c.checkNetworkRef(v, prefix, hook.Container.NetworkMode)
+	}
+}
+
+func checkTimeout(v *validator, prefix string, timeout string) {
+	if timeout == "" {
+		return
+	}
+	if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+		v.addf("%s: invalid timeout %q, expected a duration like 30s", prefix, timeout)
+	}
+}
+
+// IsBuiltinNetwork checks if a network mode is provided by Docker itself.
+func IsBuiltinNetwork(name string) bool {
+	switch name {
+	case "", "default", "bridge", "host", "none":
+		return true
+	}
+	return strings.HasPrefix(name, "container:")
+}
+
+func (c *DevicedConfig) checkNetworkRef(v *validator, prefix string, name string) {
+	if !IsBuiltinNetwork(name) && c.GetNetwork(name) == nil {
+		v.addf("%s: network %s is not defined in networks", prefix, name)
+	}
+}
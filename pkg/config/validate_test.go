@@ -0,0 +1,134 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const validConfig = `
+repos:
+  - url: https://registry-1.docker.io/
+containers:
+  - id: nav
+    image: robot/nav
+    versions: [v1.2, latest]
+    dockerHostConfig:
+      networkMode: ros
+    lifecycleHooks:
+      preUpdate:
+        - exec:
+            command: [idle]
+            timeout: 30s
+  - id: db
+    image: postgres
+    versions: ["9.6"]
+networks:
+  - name: ros
+`
+
+func TestParseValid(t *testing.T) {
+	c, err := Parse([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Containers) != 2 || len(c.Networks) != 1 {
+		t.Fatalf("config not parsed: %v", c)
+	}
+}
+
+func TestParseUnknownKey(t *testing.T) {
+	_, err := Parse([]byte(validConfig + "contaniers: []\n"))
+	if err == nil || !strings.Contains(err.Error(), "contaniers") {
+		t.Fatalf("expected the unknown key to be reported, got %v", err)
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	_, err := Parse([]byte(`
+repos:
+  - url: registry.local
+containers:
+  - id: nav
+    image: robot/nav
+    versions: ["v1:2"]
+    dockerHostConfig:
+      networkMode: ros
+    initContainers:
+      - name: migrate
+        timeout: 10
+  - id: NAV
+    image: robot/nav
+  - id: nav_2
+    image: robot/nav
+    lifecycleHooks:
+      preStart:
+        - http:
+            path: /ready
+            timeout: soon
+`))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	expected := []string{
+		"repos[0]: invalid url registry.local",
+		`container nav: invalid version tag "v1:2"`,
+		"container nav: network ros is not defined",
+		`container nav: init container migrate: invalid timeout "10"`,
+		"container NAV: id used more than once",
+		"container nav_2: id must be a DNS label",
+		`container nav_2: preStart hook 0: invalid timeout "soon"`,
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), verr.Problems)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(verr.Problems[i], prefix) {
+			t.Fatalf("problem %d: expected %q, got %q", i, prefix, verr.Problems[i])
+		}
+	}
+}
+
+func TestValidateSecrets(t *testing.T) {
+	_, err := Parse([]byte(`
+repos:
+  - url: https://registry.local
+    username: robot
+    password: hunter22
+    passwordFrom: store:registry
+  - url: https://mirror.local
+    username: robot
+    passwordFrom: vault:registry
+containers:
+  - id: nav
+    image: robot/nav
+    secrets:
+      - name: api-token
+        from: store:nav-token
+      - name: api-token
+        from: env:NAV_TOKEN
+      - name: ../key
+        from: file:/etc/nav/key
+      - name: cert
+        from: file:cert.pem
+`))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	expected := []string{
+		"repos[0]: https://registry.local: set password or passwordFrom, not both",
+		`repos[1]: https://mirror.local: passwordFrom: invalid secret reference "vault:registry"`,
+		"container nav: secret api-token defined more than once",
+		`container nav: invalid secret name "../key"`,
+		`container nav: secret cert: invalid secret reference "file:cert.pem"`,
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), verr.Problems)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(verr.Problems[i], prefix) {
+			t.Fatalf("problem %d: expected %q, got %q", i, prefix, verr.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+// VolumeConfig is a named volume managed by deviced.
+type VolumeConfig struct {
+	Name       string            `yaml:"name"`
+	Driver     string            `yaml:"driver,omitempty"`
+	DriverOpts map[string]string `yaml:"driverOpts,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+}
+
+// GetVolume returns the managed volume with the given name, or nil.
+func (c *DevicedConfig) GetVolume(name string) *VolumeConfig {
+	for _, vol := range c.Volumes {
+		if vol.Name == name {
+			return vol
+		}
+	}
+	return nil
+}
+
+// bindVolumeName returns the volume name of a bind, empty for host paths.
+func bindVolumeName(bind string) string {
+	src := strings.SplitN(bind, ":", 2)[0]
+	if len(src) == 0 || strings.HasPrefix(src, "/") || strings.HasPrefix(src, ".") {
+		return ""
+	}
+	return src
+}
+
+// TargetVolumes returns the managed volumes referenced by a target,
+// including by its init containers.
+func (c *DevicedConfig) TargetVolumes(tctr *TargetContainer) []string {
+	var names []string
+	add := func(name string) {
+		if name == "" || c.GetVolume(name) == nil {
+			return
+		}
+		for _, existing := range names {
+			if existing == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	addHostConfig := func(binds []string, mounts []mount.Mount) {
+		for _, bind := range binds {
+			add(bindVolumeName(bind))
+		}
+		for _, mnt := range mounts {
+			if mnt.Type == mount.TypeVolume {
+				add(mnt.Source)
+			}
+		}
+	}
+	addHostConfig(tctr.DockerHostConfig.Binds, tctr.DockerHostConfig.Mounts)
+	for _, init := range tctr.InitContainers {
+		addHostConfig(init.DockerHostConfig.Binds, init.DockerHostConfig.Mounts)
+	}
+	return names
+}
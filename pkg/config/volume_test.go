@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+func TestTargetVolumes(t *testing.T) {
+	c := &DevicedConfig{
+		Volumes: []*VolumeConfig{{Name: "data"}, {Name: "maps"}, {Name: "unused"}},
+	}
+	tctr := &TargetContainer{Id: "nav"}
+	tctr.DockerHostConfig.Binds = []string{"data:/data", "/etc/hosts:/etc/hosts:ro", "other:/other"}
+	tctr.DockerHostConfig.Mounts = []mount.Mount{
+		{Type: mount.TypeVolume, Source: "maps", Target: "/maps"},
+		{Type: mount.TypeBind, Source: "unused", Target: "/unused"},
+	}
+	tctr.InitContainers = []*InitContainer{{Name: "seed"}}
+	tctr.InitContainers[0].DockerHostConfig.Binds = []string{"data:/seed"}
+
+	vols := c.TargetVolumes(tctr)
+	if len(vols) != 2 || vols[0] != "data" || vols[1] != "maps" {
+		t.Fatalf("unexpected volumes %v", vols)
+	}
+}
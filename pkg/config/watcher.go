@@ -1,28 +1,41 @@
 package config
 
 import (
-	"fmt"
-
 	"github.com/fsnotify/fsnotify"
 )
 
 type DevicedConfigWatcher struct {
-	ConfigPath    *string
+	ConfigPath *string
+	// Watched as well if set
+	ConfigDir *string
+	// Watched as well if it exists
+	FactsFile     string
 	ConfigWatcher *fsnotify.Watcher
 }
 
 func (cw *DevicedConfigWatcher) Init() int {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		fmt.Printf("Unable to initialize filesystem watcher, %s\n", err)
+		log.Warnf("Unable to initialize filesystem watcher, %s", err)
 		return 1
 	}
 	cw.ConfigWatcher = watcher
 	err = watcher.Add(*cw.ConfigPath)
 	if err != nil {
-		fmt.Printf("Unable to initialize filesystem watcher, %s\n", err)
+		log.Warnf("Unable to initialize filesystem watcher, %s", err)
 		return 1
 	}
+	// Adding, changing or removing a fragment reloads the config.
+	if cw.ConfigDir != nil && *cw.ConfigDir != "" {
+		if err := watcher.Add(*cw.ConfigDir); err != nil {
+			log.Warnf("Unable to watch config dir %s, %s", *cw.ConfigDir, err)
+		}
+	}
+	if cw.FactsFile != "" && ConfigFileExists(cw.FactsFile) {
+		if err := watcher.Add(cw.FactsFile); err != nil {
+			log.Warnf("Unable to watch facts file %s, %s", cw.FactsFile, err)
+		}
+	}
 	return 0
 }
 
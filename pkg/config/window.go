@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UpdateWindow is a recurring period of local time where containers may be replaced.
+type UpdateWindow struct {
+	// Days of the week, e.g. "mon", "tue". Empty means every day.
+	Days []string `yaml:"days,omitempty"`
+	// Start and end time as HH:MM. End before start wraps past midnight.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *UpdateWindow) matchesDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if strings.HasPrefix(strings.ToLower(day.String()), strings.ToLower(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *UpdateWindow) Validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		valid := false
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if len(d) >= 3 && strings.HasPrefix(strings.ToLower(day.String()), strings.ToLower(d)) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid day %q", d)
+		}
+	}
+	return nil
+}
+
+// Contains checks if t falls inside the window.
+func (w *UpdateWindow) Contains(t time.Time) bool {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+	if start <= end {
+		return w.matchesDay(t.Weekday()) && sinceMidnight >= start && sinceMidnight < end
+	}
+
+	// Wraps midnight: the part after midnight belongs to the previous day's window.
+	if sinceMidnight >= start {
+		return w.matchesDay(t.Weekday())
+	}
+	if sinceMidnight < end {
+		return w.matchesDay(midnight.AddDate(0, 0, -1).Weekday())
+	}
+	return false
+}
+
+// InUpdateWindow checks a list of windows. An empty list is always open.
+func InUpdateWindow(windows []UpdateWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for i := range windows {
+		if windows[i].Contains(t) {
+			return true
+		}
+	}
+	return false
+}
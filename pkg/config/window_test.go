@@ -0,0 +1,53 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateWindowContains(t *testing.T) {
+	// 2017-03-06 is a Monday.
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2017, 3, day, hour, min, 0, 0, time.Local)
+	}
+
+	w := UpdateWindow{Days: []string{"mon"}, Start: "02:00", End: "04:00"}
+	if !w.Contains(at(6, 3, 0)) {
+		t.Fatal("expected monday 03:00 inside window")
+	}
+	if w.Contains(at(6, 4, 0)) {
+		t.Fatal("expected monday 04:00 outside window")
+	}
+	if w.Contains(at(7, 3, 0)) {
+		t.Fatal("expected tuesday 03:00 outside window")
+	}
+
+	wrap := UpdateWindow{Days: []string{"sun"}, Start: "23:00", End: "01:00"}
+	if !wrap.Contains(at(5, 23, 30)) {
+		t.Fatal("expected sunday 23:30 inside wrapping window")
+	}
+	if !wrap.Contains(at(6, 0, 30)) {
+		t.Fatal("expected monday 00:30 inside sunday's wrapping window")
+	}
+	if wrap.Contains(at(6, 23, 30)) {
+		t.Fatal("expected monday 23:30 outside window")
+	}
+}
+
+func TestInUpdateWindowEmpty(t *testing.T) {
+	if !InUpdateWindow(nil, time.Now()) {
+		t.Fatal("expected empty window list to always be open")
+	}
+}
+
+func TestUpdateWindowValidate(t *testing.T) {
+	if err := (&UpdateWindow{Start: "25:00", End: "01:00"}).Validate(); err == nil {
+		t.Fatal("expected invalid start time to fail")
+	}
+	if err := (&UpdateWindow{Days: []string{"funday"}, Start: "01:00", End: "02:00"}).Validate(); err == nil {
+		t.Fatal("expected invalid day to fail")
+	}
+	if err := (&UpdateWindow{Days: []string{"Sat", "sunday"}, Start: "01:00", End: "02:00"}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,114 @@
+package containersync
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	dct "github.com/docker/docker/api/types"
+	dce "github.com/docker/docker/api/types/events"
+	dcf "github.com/docker/docker/api/types/filters"
+	"github.com/fuserobotics/deviced/pkg/metrics"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+// eventDebounce is how long events are collected before reconciling.
+const eventDebounce = time.Duration(1) * time.Second
+
+// eventSubscriptions returns the event filters the worker subscribes with.
+// A label filter applies to every event type, so managed containers get
+// their own subscription.
+func eventSubscriptions() []dct.EventsOptions {
+	ctrFilters := dcf.NewArgs()
+	ctrFilters.Add("type", "container")
+	ctrFilters.Add("label", deviced_id_label)
+	// Exec events from our hooks and the like are left out.
+	for _, action := range []string{"die", "destroy", "oom"} {
+		ctrFilters.Add("event", action)
+	}
+
+	resFilters := dcf.NewArgs()
+	resFilters.Add("type", "image")
+	resFilters.Add("type", "network")
+	for _, action := range []string{"pull", "tag", "untag", "load", "import", "delete", "create", "destroy"} {
+		resFilters.Add("event", action)
+	}
+
+	return []dct.EventsOptions{{Filters: ctrFilters}, {Filters: resFilters}}
+}
+
+func (cw *ContainerSyncWorker) startEventStream() {
+	cw.stopEventStream()
+
+	log.Info("Registering event listeners...")
+	cw.EventsContext, cw.EventsContextCancel = context.WithCancel(context.Background())
+	events := make(chan dce.Message, 32)
+	errs := make(chan error, 2)
+	for _, opts := range eventSubscriptions() {
+		msgs, serrs := cw.DockerClient.Events(cw.EventsContext, opts)
+		go forwardEvents(cw.EventsContext, msgs, serrs, events, errs)
+	}
+	cw.EventsChannel, cw.ErrorsChannel = events, errs
+}
+
+// forwardEvents merges one subscription into the worker channels.
+func forwardEvents(ctx context.Context, msgs <-chan dce.Message, serrs <-chan error, events chan<- dce.Message, errs chan<- error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-msgs:
+			select {
+			case events <- msg:
+			case <-ctx.Done():
+				return
+			}
+		case err := <-serrs:
+			select {
+			case errs <- err:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// eventTarget returns the lower case target ID a container event is about,
+// empty if the event may affect any target.
+func eventTarget(event dce.Message) string {
+	if event.Type != "container" {
+		return ""
+	}
+	return strings.ToLower(event.Actor.Attributes[deviced_id_label])
+}
+
+// inScope checks if a target is part of a targeted reconcile.
+func inScope(only map[string]bool, id string) bool {
+	return only == nil || only[strings.ToLower(id)]
+}
+
+// reconnectEvents waits for Docker to answer again and subscribes to events.
+// Returns false if the worker was asked to quit while waiting.
+func (cw *ContainerSyncWorker) reconnectEvents() bool {
+	cw.stopEventStream()
+
+	backoff := utils.Backoff{Min: time.Duration(1) * time.Second, Max: time.Duration(30) * time.Second}
+	for {
+		_, err := cw.DockerClient.Ping(context.Background())
+		if err == nil {
+			break
+		}
+		metrics.DockerErrors.Inc("ping")
+		delay := backoff.Next()
+		log.Infof("Docker is unavailable, retrying in %s, %v", delay.String(), err)
+		if cw.sleepShouldQuit(delay) {
+			return false
+		}
+	}
+
+	cw.startEventStream()
+	if cw.Status != nil {
+		cw.Status.AddEvent("", "docker", "reconnected to the docker event stream, resyncing")
+	}
+	return true
+}
@@ -0,0 +1,377 @@
+package containersync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dct "github.com/docker/docker/api/types"
+	dcc "github.com/docker/docker/api/types/container"
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/metrics"
+	"github.com/fuserobotics/deviced/pkg/redact"
+	"github.com/fuserobotics/deviced/pkg/state"
+)
+
+// Hook output kept in results, the rest is discarded.
+const maxHookOutput int = 4096
+
+// Label set on one-off hook containers, value is the target id.
+const deviced_hook_label string = "deviced.hook"
+
+// Lifecycle phases, as reported in the status.
+const (
+	hookPhasePreUpdate string = "preUpdate"
+	hookPhasePreStart  string = "preStart"
+	hookPhasePostStart string = "postStart"
+	hookPhaseOnUpgrade string = "onUpgrade"
+	hookPhaseOnStop    string = "onStop"
+	hookPhaseOnRemove  string = "onRemove"
+)
+
+// hookContext describes what a hook is run for.
+type hookContext struct {
+	Phase  string
+	Target *config.TargetContainer
+	// Container the hook runs against
+	ContainerID string
+	// Exec hooks need a running container
+	Running bool
+	// Image and tag of the container
+	Image string
+	Tag   string
+	// Replica index of the container
+	Replica int
+	// Set for upgrades
+	OldTag string
+	NewTag string
+}
+
+// log returns a logger tagged with the target and container of the hook.
+func (hctx *hookContext) log() *logrus.Entry {
+	entry := log.WithField("container", hctx.ContainerID)
+	if hctx.Target != nil {
+		entry = entry.WithField("target", hctx.Target.Id)
+	}
+	return entry
+}
+
+// Env builds the environment passed to exec and helper container hooks.
+func (hc *hookContext) Env() []string {
+	env := []string{
+		"DEVICED_HOOK_PHASE=" + hc.Phase,
+		"DEVICED_CONTAINER_ID=" + hc.ContainerID,
+	}
+	if hc.Target != nil {
+		env = append(env, "DEVICED_ID="+hc.Target.Id)
+		if hc.Target.EffectiveReplicas() > 1 {
+			env = append(env, "DEVICED_REPLICA="+strconv.Itoa(hc.Replica))
+		}
+	}
+	if hc.OldTag != "" || hc.NewTag != "" {
+		env = append(env, "DEVICED_OLD_TAG="+hc.OldTag, "DEVICED_NEW_TAG="+hc.NewTag)
+	}
+	return env
+}
+
+// hookResult is the outcome of running a single lifecycle hook.
+type hookResult struct {
+	// Exit code for exec and container hooks, status code for http hooks
+	ExitCode int
+	Output   string
+	Err      error
+}
+
+func (r *hookResult) Success() bool {
+	return r.Err == nil && r.ExitCode == 0
+}
+
+func (r *hookResult) String() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return fmt.Sprintf("exit code %d", r.ExitCode)
+}
+
+func hookTimeout(timeout string) time.Duration {
+	waitDur, err := time.ParseDuration(timeout)
+	if err != nil || timeout == "" {
+		log.Info("Using default wait time of 30 seconds for hook...")
+		waitDur = time.Duration(30) * time.Second
+	}
+	return waitDur
+}
+
+// truncateOutput keeps the end of the output, redacting secrets first so
+// none are cut in half.
+func truncateOutput(dat []byte) string {
+	out := redact.String(string(dat))
+	if len(out) > maxHookOutput {
+		out = out[len(out)-maxHookOutput:]
+	}
+	return out
+}
+
+// runHook runs a single hook.
+func (cw *ContainerSyncWorker) runHook(hctx *hookContext, hook *config.LifecycleHook) (res hookResult) {
+	if hctx.Target != nil {
+		started := time.Now()
+		defer func() {
+			metrics.HookDuration.Observe(time.Since(started).Seconds(), hctx.Target.Id, hctx.Phase)
+			if !res.Success() {
+				metrics.HookFailures.Inc(hctx.Target.Id, hctx.Phase)
+			}
+		}()
+	}
+
+	switch {
+	case hook.Exec != nil:
+		if !hctx.Running {
+			return hookResult{Err: fmt.Errorf("exec hooks need a running container, not allowed in %s", hctx.Phase)}
+		}
+		return cw.runExecHook(hctx, hook.Exec)
+	case hook.Http != nil:
+		return cw.runHttpHook(hctx, hook.Http)
+	case hook.Container != nil:
+		return cw.runContainerHook(hctx, hook.Container)
+	}
+	return hookResult{Err: errors.New("hook has no action")}
+}
+
+// runHooks runs the hooks for a phase in order, recording the results.
+// Returns false if a hook with the abort failure policy failed.
+func (cw *ContainerSyncWorker) runHooks(hctx *hookContext, hooks []config.LifecycleHook) (bool, string) {
+	for hidx := range hooks {
+		hook := &hooks[hidx]
+		hctx.log().Infof("Running %s hook %d...", hctx.Phase, hidx)
+		res := cw.runHook(hctx, hook)
+		cw.recordHook(hctx, hidx, &res)
+		if res.Success() {
+			continue
+		}
+
+		reason := fmt.Sprintf("%s hook %d failed, %s", hctx.Phase, hidx, res.String())
+		if out := strings.TrimSpace(res.Output); out != "" {
+			reason = fmt.Sprintf("%s: %s", reason, out)
+		}
+		if hook.AbortOnFailure() {
+			hctx.log().Infof("%s, aborting.", reason)
+			return false, reason
+		}
+		hctx.log().Infof("%s, continuing.", reason)
+	}
+	return true, ""
+}
+
+func (cw *ContainerSyncWorker) recordHook(hctx *hookContext, hidx int, res *hookResult) {
+	if hctx.Target == nil {
+		return
+	}
+	outcome := audit.OutcomeOK
+	if !res.Success() {
+		outcome = audit.OutcomeFailed
+	}
+	cw.Audit.Record(&audit.Entry{
+		Type:      audit.TypeHook,
+		Outcome:   outcome,
+		Target:    hctx.Target.Id,
+		Container: hctx.ContainerID,
+		Image:     hctx.Image,
+		Tag:       hctx.Tag,
+		Message:   fmt.Sprintf("%s hook %d: %s", hctx.Phase, hidx, res.String()),
+	})
+	if cw.Status == nil {
+		return
+	}
+
+	hs := &state.HookStatus{
+		Time:        time.Now(),
+		Phase:       hctx.Phase,
+		Index:       hidx,
+		ContainerID: hctx.ContainerID,
+		Success:     res.Success(),
+		ExitCode:    res.ExitCode,
+		Output:      res.Output,
+	}
+	if res.Err != nil {
+		hs.Error = res.Err.Error()
+	}
+	cw.Status.RecordHook(hctx.Target.Id, hs)
+	cw.Status.AddEvent(hctx.Target.Id, "hook", fmt.Sprintf("%s hook %d: %s", hctx.Phase, hidx, res.String()))
+}
+
+func (cw *ContainerSyncWorker) runExecHook(hctx *hookContext, hook *config.LifecycleExecHook) hookResult {
+	execCtx, execCtxCancel := context.WithCancel(context.Background())
+	defer execCtxCancel()
+
+	exec, err := cw.DockerClient.ContainerExecCreate(execCtx, hctx.ContainerID, dct.ExecConfig{
+		Cmd: hook.Command,
+		Env: hctx.Env(),
+		Tty: true,
+	})
+	if err != nil {
+		return hookResult{Err: fmt.Errorf("error creating exec, %v", err)}
+	}
+	conn, err := cw.DockerClient.ContainerExecAttach(execCtx, exec.ID, dct.ExecConfig{
+		Tty: true,
+	})
+	if err != nil {
+		return hookResult{Err: fmt.Errorf("error starting exec, %v", err)}
+	}
+
+	var output []byte
+	closeChannel := make(chan bool)
+	go func() {
+		defer func() {
+			conn.Close()
+			close(closeChannel)
+		}()
+		dat, err := ioutil.ReadAll(conn.Reader)
+		if err != nil {
+			hctx.log().Errorf("Error waiting for finish exec for %s hook: %v", hctx.Phase, err)
+		}
+		output = dat
+	}()
+
+	select {
+	case _, _ = <-closeChannel:
+	case <-time.After(hookTimeout(hook.Timeout)):
+		return hookResult{Err: errors.New("exec hook timed out")}
+	}
+
+	res := hookResult{Output: truncateOutput(output)}
+	inspect, err := cw.DockerClient.ContainerExecInspect(context.Background(), exec.ID)
+	if err != nil {
+		res.Err = fmt.Errorf("error inspecting exec, %v", err)
+		return res
+	}
+	res.ExitCode = inspect.ExitCode
+	return res
+}
+
+// containerAddress finds an address to reach the container at.
+func (cw *ContainerSyncWorker) containerAddress(cid string) (string, error) {
+	ctr, err := cw.DockerClient.ContainerInspect(context.Background(), cid)
+	if err != nil {
+		return "", err
+	}
+	if ctr.HostConfig != nil && ctr.HostConfig.NetworkMode.IsHost() {
+		return "127.0.0.1", nil
+	}
+	if ctr.NetworkSettings != nil {
+		if ctr.NetworkSettings.IPAddress != "" {
+			return ctr.NetworkSettings.IPAddress, nil
+		}
+		for _, endp := range ctr.NetworkSettings.Networks {
+			if endp != nil && endp.IPAddress != "" {
+				return endp.IPAddress, nil
+			}
+		}
+	}
+	return "", errors.New("container has no ip address")
+}
+
+func (cw *ContainerSyncWorker) runHttpHook(hctx *hookContext, hook *config.LifecycleHttpHook) hookResult {
+	host := hook.Host
+	if host == "" {
+		addr, err := cw.containerAddress(hctx.ContainerID)
+		if err != nil {
+			return hookResult{Err: fmt.Errorf("unable to find container address, %v", err)}
+		}
+		host = addr
+	}
+	if hook.Port != 0 {
+		host = strings.Join([]string{host, strconv.Itoa(hook.Port)}, ":")
+	}
+	method := hook.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := hook.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	var body io.Reader
+	if hook.Body != "" {
+		body = bytes.NewBufferString(hook.Body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), fmt.Sprintf("http://%s%s", host, path), body)
+	if err != nil {
+		return hookResult{Err: err}
+	}
+	// DEVICED_OLD_TAG=x is sent as X-Deviced-Old-Tag: x
+	for _, env := range hctx.Env() {
+		kv := strings.SplitN(env, "=", 2)
+		parts := strings.Split(strings.ToLower(kv[0]), "_")
+		for i, part := range parts {
+			parts[i] = strings.Title(part)
+		}
+		req.Header.Set("X-"+strings.Join(parts, "-"), kv[1])
+	}
+
+	client := &http.Client{Timeout: hookTimeout(hook.Timeout)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return hookResult{Err: err}
+	}
+	defer resp.Body.Close()
+
+	dat, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxHookOutput)))
+	res := hookResult{Output: string(dat)}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		res.ExitCode = resp.StatusCode
+	}
+	return res
+}
+
+// runContainerHook runs the hook in a one-off helper container, removed afterwards.
+func (cw *ContainerSyncWorker) runContainerHook(hctx *hookContext, hook *config.LifecycleContainerHook) hookResult {
+	image := hook.Image
+	if image == "" {
+		image = strings.Join([]string{hctx.Image, hctx.Tag}, ":")
+	}
+	labels := map[string]string{}
+	if hctx.Target != nil {
+		labels[deviced_hook_label] = hctx.Target.Id
+	}
+
+	ctrConfig := &dcc.Config{
+		Image:  image,
+		Cmd:    hook.Command,
+		Env:    append(hctx.Env(), hook.Env...),
+		Labels: labels,
+	}
+	hostConfig := &dcc.HostConfig{
+		Binds:       hook.Binds,
+		NetworkMode: dcc.NetworkMode(hook.NetworkMode),
+	}
+	return cw.runOneShot(ctrConfig, hostConfig, "", hookTimeout(hook.Timeout))
+}
+
+// checkPreUpdateHooks asks the running container if it may be replaced now.
+// Any failing hook defers the replacement, whatever its failure policy.
+func (cw *ContainerSyncWorker) checkPreUpdateHooks(hctx *hookContext, hooks []config.LifecycleHook) (bool, string) {
+	for hidx := range hooks {
+		hctx.log().Infof("Running %s hook %d...", hctx.Phase, hidx)
+		res := cw.runHook(hctx, &hooks[hidx])
+		cw.recordHook(hctx, hidx, &res)
+		if !res.Success() {
+			reason := fmt.Sprintf("deferred by preUpdate hook %d, %s", hidx, res.String())
+			if out := strings.TrimSpace(res.Output); out != "" {
+				reason = fmt.Sprintf("%s: %s", reason, out)
+			}
+			return false, reason
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,209 @@
+package containersync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dct "github.com/docker/docker/api/types"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/state"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+// Label holding the run key of a job container.
+const deviced_job_key_label string = "deviced.job-key"
+
+// Default timeout for init containers.
+const defaultInitTimeout = time.Duration(10) * time.Minute
+
+// How long to wait before retrying failed init containers.
+const initRetryDelay = time.Duration(1) * time.Minute
+
+// bestAvailableTag picks the best eligible tag for the target from tags.
+func bestAvailableTag(tctr *config.TargetContainer, tags []string) (string, bool) {
+	best := ""
+	bestScore := uint(0)
+	found := false
+	for _, avail := range tags {
+		score := tctr.ContainerVersionScore(avail)
+		if !tctr.UseAnyVersion && score > 1000 {
+			continue
+		}
+		if tctr.IsPrefetchOnly(avail) {
+			continue
+		}
+		if !found || score < bestScore {
+			best = avail
+			bestScore = score
+			found = true
+		}
+	}
+	return best, found
+}
+
+// processJob collects finished runs of a job target and decides if it needs to run.
+func (cw *ContainerSyncWorker) processJob(tctr *config.TargetContainer, ctrs []dct.Container, tags []string, tstatus *state.TargetStatus) *containerCreation {
+	if cw.Store != nil {
+		tstatus.LastJob = cw.Store.JobResult(tctr.Id)
+	}
+
+	running := false
+	for _, ctr := range ctrs {
+		if ctr.State == "running" {
+			containerLog(tctr.Id, ctr.ID, "", "").Info("Job is running.")
+			running = true
+			tstatus.ContainerID = ctr.ID
+			tstatus.Image, tstatus.ImageTag = utils.ParseImageAndTag(ctr.Image)
+			continue
+		}
+		cw.collectJobResult(tctr, ctr, tstatus)
+	}
+	if running {
+		return nil
+	}
+
+	tag, ok := bestAvailableTag(tctr, tags)
+	if !ok {
+		targetLog(tctr.Id).Infof("Job %s has no suitable image, skipping.", tctr.Id)
+		tstatus.WaitingForImage = true
+		return nil
+	}
+	runKey := tctr.JobRunKey(tag)
+	if tstatus.LastJob != nil && tstatus.LastJob.RunKey == runKey {
+		return nil
+	}
+	if cw.Store == nil {
+		targetLog(tctr.Id).Infof("No state store, not running job %s.", tctr.Id)
+		return nil
+	}
+
+	targetLog(tctr.Id).WithFields(logrus.Fields{"image": tctr.Image, "tag": tag}).Infof("Running job, run key %s...", runKey)
+	creation := cw.buildContainerCreation(tctr, tctr.Image, tag, 0, 0)
+	creation.Options.Config.Labels[deviced_job_key_label] = runKey
+	tstatus.Image = tctr.Image
+	tstatus.ImageTag = tag
+	return creation
+}
+
+// collectJobResult records the result of an exited job container and removes it.
+func (cw *ContainerSyncWorker) collectJobResult(tctr *config.TargetContainer, ctr dct.Container, tstatus *state.TargetStatus) {
+	inspect, err := cw.DockerClient.ContainerInspect(context.Background(), ctr.ID)
+	if err != nil {
+		containerLog(tctr.Id, ctr.ID, "", "").Warnf("Unable to inspect job container, %v", err)
+		return
+	}
+	if inspect.State == nil || inspect.State.Status == "created" {
+		// Never started, drop it and decide again.
+		cw.removeContainer(tctr.Id, ctr.ID, "job container never started")
+		return
+	}
+
+	runKey := ctr.Labels[deviced_job_key_label]
+	if tctr.IsScheduled() {
+		runKey = ctr.Labels[deviced_schedule_run_label]
+	}
+	res := &state.JobResult{
+		DevicedID:   tctr.Id,
+		RunKey:      runKey,
+		ContainerID: ctr.ID,
+		ExitCode:    inspect.State.ExitCode,
+		Success:     inspect.State.ExitCode == 0,
+		LogTail:     cw.containerLogTail(ctr.ID, inspect.Config != nil && inspect.Config.Tty),
+	}
+	res.Image, res.ImageTag = utils.ParseImageAndTag(ctr.Image)
+	res.Started, _ = time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	res.Finished, _ = time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+
+	targetLog(tctr.Id).Infof("Job %s finished with exit code %d.", tctr.Id, res.ExitCode)
+	if cw.Store != nil {
+		var err error
+		if tctr.IsScheduled() {
+			err = cw.Store.AppendRunResult(res, tctr.EffectiveHistoryLimit())
+		} else {
+			err = cw.Store.SetJobResult(res)
+		}
+		if err != nil {
+			targetLog(tctr.Id).Warnf("Unable to store result of job %s, %v", tctr.Id, err)
+			return
+		}
+	}
+	if cw.Status != nil {
+		cw.Status.AddEvent(tctr.Id, "job", fmt.Sprintf("job %s:%s exited with code %d", res.Image, res.ImageTag, res.ExitCode))
+	}
+	tstatus.LastJob = res
+	cw.removeContainer(tctr.Id, ctr.ID, fmt.Sprintf("job finished with exit code %d", res.ExitCode))
+}
+
+// runInitContainers runs the target's init containers in order.
+// Returns false if one failed, the creation should then be skipped.
+func (cw *ContainerSyncWorker) runInitContainers(creation *containerCreation) bool {
+	tctr := creation.Target
+	if len(tctr.InitContainers) == 0 {
+		return true
+	}
+	if retryAfter, ok := cw.InitRetryAfter[tctr.Id]; ok && time.Now().Before(retryAfter) {
+		targetLog(tctr.Id).Infof("Init containers for %s failed recently, retrying after %s.", tctr.Id, retryAfter.Format(time.RFC3339))
+		cw.RecheckPending = true
+		return false
+	}
+
+	hctx := &hookContext{
+		Phase:  "init",
+		Target: tctr,
+		Image:  creation.Image,
+		Tag:    creation.Tag,
+	}
+	for idx, init := range tctr.InitContainers {
+		targetLog(tctr.Id).Infof("Running init container %d (%s) for %s...", idx, init.Name, tctr.Id)
+		ctrConfig := (&init.DockerConfig).ToAPI()
+		hostConfig := (&init.DockerHostConfig).ToAPI()
+		ctrConfig.Image = init.Image
+		if ctrConfig.Image == "" {
+			ctrConfig.Image = strings.Join([]string{creation.Image, creation.Tag}, ":")
+		}
+		if ctrConfig.Labels == nil {
+			ctrConfig.Labels = make(map[string]string)
+		}
+		ctrConfig.Labels[deviced_hook_label] = tctr.Id
+		ctrConfig.Env = append(hctx.Env(), ctrConfig.Env...)
+
+		timeout := defaultInitTimeout
+		if init.Timeout != "" {
+			timeout = hookTimeout(init.Timeout)
+		}
+		res := cw.runOneShot(ctrConfig, hostConfig, "", timeout)
+		cw.recordHook(hctx, idx, &res)
+		if !res.Success() {
+			targetLog(tctr.Id).Infof("Init container %d (%s) for %s failed, %s.", idx, init.Name, tctr.Id, res.String())
+			cw.InitRetryAfter[tctr.Id] = time.Now().Add(initRetryDelay)
+			cw.RecheckPending = true
+			return false
+		}
+	}
+	delete(cw.InitRetryAfter, tctr.Id)
+	return true
+}
+
+// runInitContainersUnlocked runs the init containers with the config and
+// worker locks released, so config reloads and the API are not held up
+// for as long as they run. The second result is false if the config was
+// reloaded meanwhile, the rest of the pass is then out of date.
+func (cw *ContainerSyncWorker) runInitContainersUnlocked(creation *containerCreation) (bool, bool) {
+	// Released and taken in the same order as the other workers.
+	cw.WorkerLock.Unlock()
+	cw.ConfigLock.Unlock()
+	ok := cw.runInitContainers(creation)
+	cw.ConfigLock.Lock()
+	cw.WorkerLock.Lock()
+
+	// A reload replaces every target in the config.
+	for _, tctr := range cw.Config.Containers {
+		if tctr == creation.Target {
+			return ok, true
+		}
+	}
+	return ok, false
+}
@@ -0,0 +1,452 @@
+package containersync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dct "github.com/docker/docker/api/types"
+	dcc "github.com/docker/docker/api/types/container"
+	dcn "github.com/docker/docker/api/types/network"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/metrics"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+// Set on networks created by deviced, the value is the network name.
+const deviced_network_label string = "deviced.network"
+
+// Hash of the network definition the network was created from.
+const deviced_network_hash_label string = "deviced.network-hash"
+
+// createNetwork creates a network from its definition, labelled as managed by deviced.
+func (cw *ContainerSyncWorker) createNetwork(net *dct.NetworkCreateRequest) (dct.NetworkResource, error) {
+	// Copy so the labels do not end up in the config.
+	opts := net.NetworkCreate
+	opts.Labels = make(map[string]string)
+	for k, v := range net.Labels {
+		opts.Labels[k] = v
+	}
+	opts.Labels[deviced_network_label] = net.Name
+	opts.Labels[deviced_network_hash_label] = config.NetworkHash(net)
+
+	cnet, err := cw.DockerClient.NetworkCreate(context.Background(), net.Name, opts)
+	if err != nil {
+		metrics.DockerErrors.Inc("network_create")
+		return dct.NetworkResource{}, err
+	}
+	resource, err := cw.DockerClient.NetworkInspect(context.Background(), cnet.ID)
+	if err != nil {
+		log.Errorf("Error fetching created network %s, %v!", cnet.ID, err)
+		return dct.NetworkResource{ID: cnet.ID, Name: net.Name}, nil
+	}
+	return resource, nil
+}
+
+// networkAttachment is a container endpoint on a network being recreated.
+type networkAttachment struct {
+	ContainerID string
+	Name        string
+	Settings    *dcn.EndpointSettings
+}
+
+// log returns a logger tagged with the attached container and a network.
+func (att *networkAttachment) log(network string) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"container": att.ContainerID,
+		"name":      att.Name,
+		"network":   network,
+	})
+}
+
+// networkAttachments returns the containers attached to a network, ordered by name.
+func (cw *ContainerSyncWorker) networkAttachments(existing dct.NetworkResource) ([]*networkAttachment, error) {
+	resource, err := cw.DockerClient.NetworkInspect(context.Background(), existing.ID)
+	if err != nil {
+		return nil, err
+	}
+	var attachments []*networkAttachment
+	for cid, endpoint := range resource.Containers {
+		att := &networkAttachment{ContainerID: cid, Name: endpoint.Name}
+		info, err := cw.DockerClient.ContainerInspect(context.Background(), cid)
+		if err == nil && info.NetworkSettings != nil {
+			att.Settings = info.NetworkSettings.Networks[existing.Name]
+		}
+		attachments = append(attachments, att)
+	}
+	sort.Sort(attachmentsByName(attachments))
+	return attachments, nil
+}
+
+type attachmentsByName []*networkAttachment
+
+func (a attachmentsByName) Len() int           { return len(a) }
+func (a attachmentsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a attachmentsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// connectAttachment attaches a container again, keeping its aliases and,
+// if still valid on the new network, its address.
+func (cw *ContainerSyncWorker) connectAttachment(networkID string, att *networkAttachment) error {
+	settings := &dcn.EndpointSettings{}
+	if att.Settings != nil {
+		settings.Aliases = att.Settings.Aliases
+		settings.Links = att.Settings.Links
+		settings.IPAMConfig = att.Settings.IPAMConfig
+	}
+	err := cw.DockerClient.NetworkConnect(context.Background(), networkID, att.ContainerID, settings)
+	if err != nil && settings.IPAMConfig != nil {
+		att.log(networkID).Warnf("Unable to keep address on network, %v", err)
+		settings.IPAMConfig = nil
+		err = cw.DockerClient.NetworkConnect(context.Background(), networkID, att.ContainerID, settings)
+	}
+	return err
+}
+
+// recreateNetwork replaces a managed network whose definition changed.
+// Attached containers are detached, and attached to the new network in order.
+// Returns the current network, with an empty ID if it no longer exists.
+func (cw *ContainerSyncWorker) recreateNetwork(net *dct.NetworkCreateRequest, existing dct.NetworkResource) (dct.NetworkResource, error) {
+	log.Infof("Definition of network %s changed, recreating it...", net.Name)
+	attachments, err := cw.networkAttachments(existing)
+	if err != nil {
+		return existing, err
+	}
+
+	// Put back what was detached if the network cannot be replaced.
+	rollback := func(networkID string, detached []*networkAttachment) {
+		for _, att := range detached {
+			if err := cw.connectAttachment(networkID, att); err != nil {
+				att.log(net.Name).Errorf("Error reattaching container to network, %v", err)
+			}
+		}
+	}
+
+	for i, att := range attachments {
+		att.log(net.Name).Info("Detaching container from network...")
+		if err := cw.DockerClient.NetworkDisconnect(context.Background(), existing.ID, att.ContainerID, true); err != nil {
+			rollback(existing.ID, attachments[:i])
+			return existing, err
+		}
+	}
+
+	if err := cw.DockerClient.NetworkRemove(context.Background(), existing.ID); err != nil {
+		metrics.DockerErrors.Inc("network_remove")
+		rollback(existing.ID, attachments)
+		return existing, err
+	}
+
+	resource, err := cw.createNetwork(net)
+	if err != nil {
+		log.Errorf("Error creating network %s, restoring the previous definition, %v", net.Name, err)
+		restored, rerr := cw.restoreNetwork(existing)
+		if rerr != nil {
+			log.Errorf("Error restoring network %s, reattaching %d containers once it exists, %v", net.Name, len(attachments), rerr)
+			cw.detachedNetworks[net.Name] = attachments
+			return dct.NetworkResource{}, err
+		}
+		rollback(restored.ID, attachments)
+		return restored, err
+	}
+
+	var errs []string
+	for _, att := range attachments {
+		att.log(net.Name).Info("Attaching container to network...")
+		if err := cw.connectAttachment(resource.ID, att); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", att.Name, err))
+		}
+	}
+	if cw.Status != nil {
+		cw.Status.AddEvent("", "network", fmt.Sprintf("recreated network %s, reattached %d containers", net.Name, len(attachments)-len(errs)))
+	}
+	if len(errs) != 0 {
+		return resource, fmt.Errorf("unable to reattach %v", errs)
+	}
+	return resource, nil
+}
+
+// reattachDetached attaches the containers left detached when a network
+// could not be recreated, once it exists again.
+func (cw *ContainerSyncWorker) reattachDetached(resource dct.NetworkResource) {
+	attachments := cw.detachedNetworks[resource.Name]
+	if len(attachments) == 0 {
+		return
+	}
+	delete(cw.detachedNetworks, resource.Name)
+	for _, att := range attachments {
+		alog := att.log(resource.Name)
+		alog.Info("Attaching container to network...")
+		if err := cw.connectAttachment(resource.ID, att); err != nil {
+			alog.Errorf("Error reattaching container to network, %v", err)
+		}
+	}
+}
+
+const (
+	// Delay before a network definition that failed to replace a network is tried again, doubled on each failure
+	failedNetworkRetryMin = time.Duration(1) * time.Minute
+	failedNetworkRetryMax = time.Duration(1) * time.Hour
+)
+
+// failedNetwork is a network definition that could not replace the existing network.
+type failedNetwork struct {
+	Hash       string
+	RetryAfter time.Time
+	backoff    utils.Backoff
+}
+
+// networkFailed remembers that a definition could not replace a network,
+// so the network is not torn down again for it until the backoff passed.
+func (cw *ContainerSyncWorker) networkFailed(name string, hash string) *failedNetwork {
+	fn, ok := cw.failedNetworks[name]
+	if !ok || fn.Hash != hash {
+		fn = &failedNetwork{
+			Hash:    hash,
+			backoff: utils.Backoff{Min: failedNetworkRetryMin, Max: failedNetworkRetryMax},
+		}
+		cw.failedNetworks[name] = fn
+	}
+	fn.RetryAfter = time.Now().Add(fn.backoff.Next())
+	return fn
+}
+
+// networkBackoff checks if replacing a network with a definition failed
+// recently. Returns when to try again, or a zero time.
+func (cw *ContainerSyncWorker) networkBackoff(name string, hash string) time.Time {
+	fn, ok := cw.failedNetworks[name]
+	if !ok || fn.Hash != hash || time.Now().After(fn.RetryAfter) {
+		return time.Time{}
+	}
+	return fn.RetryAfter
+}
+
+// restoreNetwork creates a removed network again as it was. It keeps the
+// labels of the old definition, so it is replaced again once the backoff passed.
+func (cw *ContainerSyncWorker) restoreNetwork(existing dct.NetworkResource) (dct.NetworkResource, error) {
+	ipam := existing.IPAM
+	cnet, err := cw.DockerClient.NetworkCreate(context.Background(), existing.Name, dct.NetworkCreate{
+		Driver:     existing.Driver,
+		EnableIPv6: existing.EnableIPv6,
+		IPAM:       &ipam,
+		Internal:   existing.Internal,
+		Attachable: existing.Attachable,
+		Options:    existing.Options,
+		Labels:     existing.Labels,
+	})
+	if err != nil {
+		metrics.DockerErrors.Inc("network_create")
+		return dct.NetworkResource{}, err
+	}
+	resource, err := cw.DockerClient.NetworkInspect(context.Background(), cnet.ID)
+	if err != nil {
+		return dct.NetworkResource{ID: cnet.ID, Name: existing.Name}, nil
+	}
+	return resource, nil
+}
+
+// removeOrphanedNetworks removes managed networks no longer in the config once unused.
+func (cw *ContainerSyncWorker) removeOrphanedNetworks(netMap map[string]dct.NetworkResource) {
+	for name, resource := range netMap {
+		if _, managed := resource.Labels[deviced_network_label]; !managed {
+			continue
+		}
+		if cw.Config.GetNetwork(name) != nil {
+			continue
+		}
+		inspected, err := cw.DockerClient.NetworkInspect(context.Background(), resource.ID)
+		if err != nil {
+			log.Warnf("Unable to inspect network %s, %v", name, err)
+			continue
+		}
+		if len(inspected.Containers) != 0 {
+			log.Infof("Network %s was removed from the config, waiting for %d containers to leave it.", name, len(inspected.Containers))
+			continue
+		}
+		log.Infof("Removing network %s, no longer in the config...", name)
+		if err := cw.DockerClient.NetworkRemove(context.Background(), resource.ID); err != nil {
+			metrics.DockerErrors.Inc("network_remove")
+			log.Errorf("Error removing network %s, %v", name, err)
+			continue
+		}
+		delete(netMap, name)
+	}
+}
+
+// referencedNetworks returns the networks a container would be attached to,
+// from the network mode and the endpoint configs.
+func referencedNetworks(hostConfig *dcc.HostConfig, netConfig *dcn.NetworkingConfig) []string {
+	var names []string
+	add := func(name string) {
+		for _, existing := range names {
+			if existing == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	if hostConfig != nil {
+		mode := hostConfig.NetworkMode
+		// "default" and "container:<id>" do not name a network
+		if mode != "" && !mode.IsDefault() && !mode.IsContainer() {
+			add(mode.NetworkName())
+		}
+	}
+	if netConfig != nil {
+		for name := range netConfig.EndpointsConfig {
+			add(name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missingNetworks returns the referenced networks that do not exist.
+func missingNetworks(netMap map[string]dct.NetworkResource, hostConfig *dcc.HostConfig, netConfig *dcn.NetworkingConfig) []string {
+	var missing []string
+	for _, name := range referencedNetworks(hostConfig, netConfig) {
+		if _, ok := netMap[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// primaryNetwork returns the network a container is attached to at creation.
+func primaryNetwork(hostConfig *dcc.HostConfig) string {
+	mode := hostConfig.NetworkMode
+	if mode == "" || mode.IsDefault() {
+		return "bridge"
+	}
+	return mode.NetworkName()
+}
+
+// splitEndpoints leaves only the endpoint of the primary network in the
+// create options, Docker ignores all but one at creation. Returns the
+// endpoints to connect after the container is created.
+func splitEndpoints(opts *dct.ContainerCreateConfig) map[string]*dcn.EndpointSettings {
+	if opts.NetworkingConfig == nil || len(opts.NetworkingConfig.EndpointsConfig) == 0 {
+		return nil
+	}
+	primary := primaryNetwork(opts.HostConfig)
+	extra := make(map[string]*dcn.EndpointSettings)
+	kept := make(map[string]*dcn.EndpointSettings)
+	for name, settings := range opts.NetworkingConfig.EndpointsConfig {
+		if name == primary {
+			kept[name] = settings
+		} else {
+			extra[name] = settings
+		}
+	}
+	opts.NetworkingConfig.EndpointsConfig = kept
+	return extra
+}
+
+// connectNetworks attaches a container to each network, in name order.
+func (cw *ContainerSyncWorker) connectNetworks(cid string, endpoints map[string]*dcn.EndpointSettings) error {
+	var names []string
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		settings := endpoints[name]
+		if settings == nil {
+			settings = &dcn.EndpointSettings{}
+		}
+		log.WithFields(logrus.Fields{"container": cid, "network": name}).Info("Connecting container to network...")
+		if err := cw.DockerClient.NetworkConnect(context.Background(), name, cid, settings); err != nil {
+			metrics.DockerErrors.Inc("network_connect")
+			return fmt.Errorf("unable to connect to network %s, %v", name, err)
+		}
+	}
+	return nil
+}
+
+// endpointMatches checks an attached endpoint has the configured aliases and address.
+func endpointMatches(current *dcn.EndpointSettings, target *dcn.EndpointSettings) bool {
+	if target == nil {
+		return true
+	}
+	for _, alias := range target.Aliases {
+		found := false
+		for _, calias := range current.Aliases {
+			if calias == alias {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if target.IPAMConfig != nil {
+		if target.IPAMConfig.IPv4Address != "" && target.IPAMConfig.IPv4Address != current.IPAddress {
+			return false
+		}
+		if target.IPAMConfig.IPv6Address != "" && target.IPAMConfig.IPv6Address != current.GlobalIPv6Address {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcileNetworks brings the network attachments of an existing container
+// in line with its target: missing networks are connected, changed endpoints
+// are reconnected and networks no longer referenced are disconnected.
+func (cw *ContainerSyncWorker) reconcileNetworks(tctr *config.TargetContainer, ctr *dct.Container, netMap map[string]dct.NetworkResource) {
+	hostConfig := (&tctr.DockerHostConfig).ToAPI()
+	mode := hostConfig.NetworkMode
+	// These cannot be connected to other networks.
+	if mode.IsHost() || mode.IsNone() || mode.IsContainer() {
+		return
+	}
+	if ctr.NetworkSettings == nil {
+		return
+	}
+	current := ctr.NetworkSettings.Networks
+	primary := primaryNetwork(hostConfig)
+	targetEndpoints := (&tctr.DockerNetworkingConfig).ToAPI().EndpointsConfig
+
+	clog := containerLog(tctr.Id, ctr.ID, "", "")
+	connect := make(map[string]*dcn.EndpointSettings)
+	for name, settings := range targetEndpoints {
+		if _, ok := netMap[name]; !ok {
+			continue
+		}
+		cur, attached := current[name]
+		if attached && endpointMatches(cur, settings) {
+			continue
+		}
+		if attached {
+			// The primary network cannot be swapped without recreating the container.
+			if name == primary {
+				continue
+			}
+			nlog := clog.WithField("network", name)
+			nlog.Info("Endpoint on network changed, reconnecting.")
+			if err := cw.DockerClient.NetworkDisconnect(context.Background(), name, ctr.ID, false); err != nil {
+				nlog.Warnf("Unable to disconnect from network, %v", err)
+				continue
+			}
+		}
+		connect[name] = settings
+	}
+	if err := cw.connectNetworks(ctr.ID, connect); err != nil {
+		clog.Warnf("Unable to reconcile networks, %v", err)
+	}
+
+	for name := range current {
+		if name == primary {
+			continue
+		}
+		if _, ok := targetEndpoints[name]; ok {
+			continue
+		}
+		nlog := clog.WithField("network", name)
+		nlog.Info("Disconnecting from network, no longer configured.")
+		if err := cw.DockerClient.NetworkDisconnect(context.Background(), name, ctr.ID, false); err != nil {
+			nlog.Warnf("Unable to disconnect from network, %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package containersync
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	dct "github.com/docker/docker/api/types"
+	dcc "github.com/docker/docker/api/types/container"
+	dcn "github.com/docker/docker/api/types/network"
+)
+
+func testEndpoints(names ...string) *dcn.NetworkingConfig {
+	nc := &dcn.NetworkingConfig{EndpointsConfig: make(map[string]*dcn.EndpointSettings)}
+	for _, name := range names {
+		nc.EndpointsConfig[name] = &dcn.EndpointSettings{Aliases: []string{name + "-alias"}}
+	}
+	return nc
+}
+
+func TestReferencedNetworks(t *testing.T) {
+	cases := []struct {
+		mode      dcc.NetworkMode
+		endpoints *dcn.NetworkingConfig
+		expected  []string
+	}{
+		{"", nil, nil},
+		{"default", nil, nil},
+		{"bridge", nil, []string{"bridge"}},
+		{"host", nil, []string{"host"}},
+		{"container:abc", nil, nil},
+		{"container:abc", testEndpoints("ros"), []string{"ros"}},
+		{"ros", nil, []string{"ros"}},
+		{"ros", testEndpoints("ros", "ctl"), []string{"ctl", "ros"}},
+		{"default", testEndpoints("ctl"), []string{"ctl"}},
+	}
+	for _, c := range cases {
+		res := referencedNetworks(&dcc.HostConfig{NetworkMode: c.mode}, c.endpoints)
+		if !reflect.DeepEqual(res, c.expected) {
+			t.Errorf("mode %q: expected %v, got %v", c.mode, c.expected, res)
+		}
+	}
+	if res := referencedNetworks(nil, testEndpoints("ros")); !reflect.DeepEqual(res, []string{"ros"}) {
+		t.Errorf("no host config: expected [ros], got %v", res)
+	}
+}
+
+func TestPrimaryNetwork(t *testing.T) {
+	cases := []struct {
+		mode     dcc.NetworkMode
+		expected string
+	}{
+		{"", "bridge"},
+		{"default", "bridge"},
+		{"bridge", "bridge"},
+		{"host", "host"},
+		{"ros", "ros"},
+	}
+	for _, c := range cases {
+		if res := primaryNetwork(&dcc.HostConfig{NetworkMode: c.mode}); res != c.expected {
+			t.Errorf("mode %q: expected %s, got %s", c.mode, c.expected, res)
+		}
+	}
+}
+
+func TestSplitEndpoints(t *testing.T) {
+	cases := []struct {
+		mode     dcc.NetworkMode
+		networks []string
+		kept     []string
+		extra    []string
+	}{
+		// The primary network of the default mode is bridge.
+		{"", []string{"ros", "ctl"}, nil, []string{"ctl", "ros"}},
+		{"default", []string{"bridge", "ros"}, []string{"bridge"}, []string{"ros"}},
+		{"ros", []string{"ros", "ctl"}, []string{"ros"}, []string{"ctl"}},
+		{"ros", []string{"ros"}, []string{"ros"}, nil},
+	}
+	for _, c := range cases {
+		opts := &dct.ContainerCreateConfig{
+			HostConfig:       &dcc.HostConfig{NetworkMode: c.mode},
+			NetworkingConfig: testEndpoints(c.networks...),
+		}
+		extra := splitEndpoints(opts)
+		if res := endpointNames(opts.NetworkingConfig.EndpointsConfig); !reflect.DeepEqual(res, c.kept) {
+			t.Errorf("mode %q: expected kept %v, got %v", c.mode, c.kept, res)
+		}
+		if res := endpointNames(extra); !reflect.DeepEqual(res, c.extra) {
+			t.Errorf("mode %q: expected extra %v, got %v", c.mode, c.extra, res)
+		}
+		for name, settings := range extra {
+			if len(settings.Aliases) != 1 || settings.Aliases[0] != name+"-alias" {
+				t.Errorf("mode %q: settings of %s not kept, got %v", c.mode, name, settings.Aliases)
+			}
+		}
+	}
+
+	opts := &dct.ContainerCreateConfig{HostConfig: &dcc.HostConfig{NetworkMode: "ros"}}
+	if extra := splitEndpoints(opts); extra != nil {
+		t.Errorf("no networking config: expected no extra endpoints, got %v", extra)
+	}
+}
+
+func endpointNames(endpoints map[string]*dcn.EndpointSettings) []string {
+	var names []string
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestEndpointMatches(t *testing.T) {
+	current := &dcn.EndpointSettings{
+		Aliases:           []string{"abc123", "ros", "master"},
+		IPAddress:         "172.30.0.5",
+		GlobalIPv6Address: "fd00::5",
+	}
+	cases := []struct {
+		name     string
+		target   *dcn.EndpointSettings
+		expected bool
+	}{
+		{"no target settings", nil, true},
+		{"empty target settings", &dcn.EndpointSettings{}, true},
+		{"alias subset", &dcn.EndpointSettings{Aliases: []string{"ros"}}, true},
+		{"all aliases", &dcn.EndpointSettings{Aliases: []string{"master", "ros"}}, true},
+		{"missing alias", &dcn.EndpointSettings{Aliases: []string{"ros", "control"}}, false},
+		{"matching ipv4", &dcn.EndpointSettings{IPAMConfig: &dcn.EndpointIPAMConfig{IPv4Address: "172.30.0.5"}}, true},
+		{"ipv4 mismatch", &dcn.EndpointSettings{IPAMConfig: &dcn.EndpointIPAMConfig{IPv4Address: "172.30.0.6"}}, false},
+		{"matching ipv6", &dcn.EndpointSettings{IPAMConfig: &dcn.EndpointIPAMConfig{IPv6Address: "fd00::5"}}, true},
+		{"ipv6 mismatch", &dcn.EndpointSettings{IPAMConfig: &dcn.EndpointIPAMConfig{IPv6Address: "fd00::6"}}, false},
+		{"ipv4 match, ipv6 mismatch", &dcn.EndpointSettings{IPAMConfig: &dcn.EndpointIPAMConfig{
+			IPv4Address: "172.30.0.5",
+			IPv6Address: "fd00::6",
+		}}, false},
+		{"empty ipam", &dcn.EndpointSettings{IPAMConfig: &dcn.EndpointIPAMConfig{}}, true},
+	}
+	for _, c := range cases {
+		if res := endpointMatches(current, c.target); res != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, res)
+		}
+	}
+}
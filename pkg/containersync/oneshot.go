@@ -0,0 +1,79 @@
+package containersync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	dct "github.com/docker/docker/api/types"
+	dcc "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// runOneShot creates a container, waits for it to exit and removes it.
+// The output is the tail of the container log.
+func (cw *ContainerSyncWorker) runOneShot(ctrConfig *dcc.Config, hostConfig *dcc.HostConfig, name string, timeout time.Duration) hookResult {
+	// Without a tty the log stream is multiplexed, keep it readable.
+	ctrConfig.Tty = true
+	created, err := cw.DockerClient.ContainerCreate(context.Background(), ctrConfig, hostConfig, nil, name)
+	if err != nil {
+		return hookResult{Err: fmt.Errorf("error creating container, %v", err)}
+	}
+	defer func() {
+		opts := dct.ContainerRemoveOptions{Force: true}
+		if err := cw.DockerClient.ContainerRemove(context.Background(), created.ID, opts); err != nil {
+			log.WithField("container", created.ID).Errorf("Error removing one-shot container, %v", err)
+		}
+	}()
+
+	if err := cw.DockerClient.ContainerStart(context.Background(), created.ID, dct.ContainerStartOptions{}); err != nil {
+		return hookResult{Err: fmt.Errorf("error starting container, %v", err)}
+	}
+
+	exitCode, err := cw.waitContainerExit(created.ID, timeout)
+	res := hookResult{ExitCode: exitCode, Err: err}
+	res.Output = cw.containerLogTail(created.ID, true)
+	return res
+}
+
+// waitContainerExit polls until the container exits, returning the exit code.
+func (cw *ContainerSyncWorker) waitContainerExit(cid string, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		inspect, err := cw.DockerClient.ContainerInspect(context.Background(), cid)
+		if err != nil {
+			return 0, err
+		}
+		if inspect.State != nil && !inspect.State.Running && inspect.State.Status != "created" {
+			return inspect.State.ExitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, errors.New("timed out waiting for container to exit")
+		}
+		time.Sleep(time.Duration(500) * time.Millisecond)
+	}
+}
+
+// containerLogTail returns the end of a container's output.
+func (cw *ContainerSyncWorker) containerLogTail(cid string, tty bool) string {
+	rc, err := cw.DockerClient.ContainerLogs(context.Background(), cid, dct.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       "50",
+	})
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+
+	if tty {
+		dat, _ := ioutil.ReadAll(rc)
+		return truncateOutput(dat)
+	}
+	var buf bytes.Buffer
+	stdcopy.StdCopy(&buf, &buf, rc)
+	return truncateOutput(buf.Bytes())
+}
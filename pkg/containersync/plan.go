@@ -0,0 +1,210 @@
+package containersync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dct "github.com/docker/docker/api/types"
+	dcn "github.com/docker/docker/api/types/network"
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/state"
+)
+
+// containerUpgrade describes a container being replaced with a new version.
+type containerUpgrade struct {
+	OldTag string
+	NewTag string
+	// Volume snapshot to restore, set for rollbacks
+	Restore *snapshotManifest
+	// Snapshot taken of the old container's volumes, put back if the
+	// new container does not come up after Restore replaced them
+	Taken *snapshotManifest
+}
+
+// containerRemoval is a container scheduled for deletion.
+type containerRemoval struct {
+	// nil if no target matches the container
+	Target *config.TargetContainer
+	Image  string
+	Tag    string
+	// Replica index of the container
+	Replica int
+	// The container may be running, run the OnStop hooks
+	RunStopHooks bool
+	Running      bool
+	// Set when replaced by a newer version
+	Upgrade *containerUpgrade
+}
+
+func newContainerRemoval(target *config.TargetContainer, rc *state.RunningContainer) *containerRemoval {
+	return &containerRemoval{
+		Target:       target,
+		Image:        rc.Image,
+		Tag:          rc.ImageTag,
+		Replica:      rc.Replica,
+		RunStopHooks: true,
+		Running:      rc.ApiContainer != nil && rc.ApiContainer.State == "running",
+	}
+}
+
+func (cr *containerRemoval) hookContext(cid string, phase string) *hookContext {
+	hctx := &hookContext{
+		Phase:       phase,
+		Target:      cr.Target,
+		ContainerID: cid,
+		Running:     cr.Running,
+		Image:       cr.Image,
+		Tag:         cr.Tag,
+		Replica:     cr.Replica,
+	}
+	if cr.Upgrade != nil {
+		hctx.OldTag = cr.Upgrade.OldTag
+		hctx.NewTag = cr.Upgrade.NewTag
+	}
+	return hctx
+}
+
+// log returns a logger tagged with the target, image and tag of the removed container.
+func (cr *containerRemoval) log(cid string) *logrus.Entry {
+	target := ""
+	if cr.Target != nil {
+		target = cr.Target.Id
+	}
+	return containerLog(target, cid, cr.Image, cr.Tag)
+}
+
+func (cr *containerRemoval) auditEntry(cid string, err error) *audit.Entry {
+	entry := &audit.Entry{
+		Type:      audit.TypeRemove,
+		Outcome:   audit.Outcome(err),
+		Container: cid,
+		Image:     cr.Image,
+		Tag:       cr.Tag,
+	}
+	if cr.Target != nil {
+		entry.Target = cr.Target.Id
+	} else {
+		entry.Message = "no matching target"
+	}
+	if cr.Upgrade != nil {
+		entry.Message = fmt.Sprintf("replaced by %s", cr.Upgrade.NewTag)
+	}
+	if err != nil {
+		entry.Message = err.Error()
+	}
+	return entry
+}
+
+// containerCreation is a container scheduled for creation.
+type containerCreation struct {
+	Target  *config.TargetContainer
+	Options dct.ContainerCreateConfig
+	// Networks to connect after creation, see splitEndpoints
+	ExtraEndpoints map[string]*dcn.EndpointSettings
+	Image          string
+	Tag            string
+	Replica        int
+	Generation     int
+	Upgrade        *containerUpgrade
+	// ID of the container being replaced, set with Upgrade
+	Replaces string
+	// Set for a scheduled run, recorded as the last run once created
+	ScheduledAt time.Time
+}
+
+// log returns a logger tagged with the target, image, tag and name of the new container.
+func (cc *containerCreation) log() *logrus.Entry {
+	return targetLog(cc.Target.Id).WithFields(logrus.Fields{
+		"image": cc.Image,
+		"tag":   cc.Tag,
+		"name":  cc.Options.Name,
+	})
+}
+
+// restores checks if volumes are restored from a snapshot before creation,
+// which needs the replaced container to be removed first.
+func (cc *containerCreation) restores() bool {
+	return cc.Upgrade != nil && cc.Upgrade.Restore != nil
+}
+
+func (cc *containerCreation) auditEntry(cid string, err error) *audit.Entry {
+	entry := &audit.Entry{
+		Type:      audit.TypeCreate,
+		Outcome:   audit.Outcome(err),
+		Target:    cc.Target.Id,
+		Container: cid,
+		Image:     cc.Image,
+		Tag:       cc.Tag,
+	}
+	if cc.Upgrade != nil {
+		entry.Type = audit.TypeReplace
+		entry.Message = fmt.Sprintf("%s to %s", cc.Upgrade.OldTag, cc.Upgrade.NewTag)
+	}
+	if err != nil {
+		entry.Message = err.Error()
+	}
+	return entry
+}
+
+// networkingConfig returns all the endpoints of the container,
+// including those connected after creation.
+func (cc *containerCreation) networkingConfig() *dcn.NetworkingConfig {
+	conf := &dcn.NetworkingConfig{EndpointsConfig: make(map[string]*dcn.EndpointSettings)}
+	if cc.Options.NetworkingConfig != nil {
+		for name, settings := range cc.Options.NetworkingConfig.EndpointsConfig {
+			conf.EndpointsConfig[name] = settings
+		}
+	}
+	for name, settings := range cc.ExtraEndpoints {
+		conf.EndpointsConfig[name] = settings
+	}
+	return conf
+}
+
+// containerStart is a container scheduled to be started.
+type containerStart struct {
+	Target  *config.TargetContainer
+	Image   string
+	Tag     string
+	Replica int
+	Running bool
+	Upgrade *containerUpgrade
+	// Created in this pass, otherwise an existing container is restarted
+	Created bool
+	// Set when Created, to undo a creation that does not come up
+	Creation *containerCreation
+}
+
+func newContainerStart(target *config.TargetContainer, rc *state.RunningContainer) *containerStart {
+	return &containerStart{
+		Target:  target,
+		Image:   rc.Image,
+		Tag:     rc.ImageTag,
+		Replica: rc.Replica,
+		Running: rc.ApiContainer != nil && rc.ApiContainer.State == "running",
+	}
+}
+
+// log returns a logger tagged with the target, image and tag of the started container.
+func (cs *containerStart) log(cid string) *logrus.Entry {
+	return containerLog(cs.Target.Id, cid, cs.Image, cs.Tag)
+}
+
+func (cs *containerStart) hookContext(cid string, phase string) *hookContext {
+	hctx := &hookContext{
+		Phase:       phase,
+		Target:      cs.Target,
+		ContainerID: cid,
+		Running:     cs.Running,
+		Image:       cs.Image,
+		Tag:         cs.Tag,
+		Replica:     cs.Replica,
+	}
+	if cs.Upgrade != nil {
+		hctx.OldTag = cs.Upgrade.OldTag
+		hctx.NewTag = cs.Upgrade.NewTag
+	}
+	return hctx
+}
@@ -0,0 +1,52 @@
+package containersync
+
+import (
+	"strconv"
+	"strings"
+
+	dct "github.com/docker/docker/api/types"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/stringid"
+)
+
+// Replica index of a service container, missing means 0.
+const deviced_replica_label string = "deviced.replica"
+
+// Incremented each time a replica is replaced, used in the container name.
+const deviced_generation_label string = "deviced.generation"
+
+// slotKey identifies one replica of a target.
+func slotKey(id string, replica int) string {
+	return id + "#" + strconv.Itoa(replica)
+}
+
+// labelInt parses an integer label, returning 0 if missing or invalid.
+func labelInt(ctr *dct.Container, label string) int {
+	val, err := strconv.Atoi(ctr.Labels[label])
+	if err != nil || val < 0 {
+		return 0
+	}
+	return val
+}
+
+// containerName builds the deterministic name for a replica generation.
+// Single replica targets are named devd_<id>_<generation>,
+// others devd_<id>_<replica>_<generation>.
+func containerName(tctr *config.TargetContainer, replica int, generation int) string {
+	parts := []string{"devd", tctr.Id}
+	if tctr.EffectiveReplicas() > 1 {
+		parts = append(parts, strconv.Itoa(replica))
+	}
+	parts = append(parts, strconv.Itoa(generation))
+	return strings.Join(parts, "_")
+}
+
+// isNameConflict checks if a create error was caused by the name being taken.
+func isNameConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "is already in use")
+}
+
+// uniqueContainerName appends a random suffix to a name that is already taken.
+func uniqueContainerName(name string) string {
+	return name + "_" + stringid.TruncateID(stringid.GenerateNonCryptoID())
+}
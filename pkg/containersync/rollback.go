@@ -0,0 +1,119 @@
+package containersync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dct "github.com/docker/docker/api/types"
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/fuserobotics/deviced/pkg/metrics"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+const (
+	// Delay before a tag that failed to come up is tried again, doubled on each failure
+	failedTagRetryMin = time.Duration(1) * time.Minute
+	failedTagRetryMax = time.Duration(1) * time.Hour
+)
+
+// failedTag is a tag whose container did not come up in a slot.
+type failedTag struct {
+	Tag        string
+	Reason     string
+	RetryAfter time.Time
+	backoff    utils.Backoff
+}
+
+// tagFailed remembers that the container of a creation did not come up, so
+// its tag is not tried again in the slot until the backoff passed.
+func (cw *ContainerSyncWorker) tagFailed(creation *containerCreation, reason string) *failedTag {
+	slot := slotKey(creation.Target.Id, creation.Replica)
+	ft, ok := cw.failedTags[slot]
+	if !ok || ft.Tag != creation.Tag {
+		ft = &failedTag{
+			Tag:     creation.Tag,
+			backoff: utils.Backoff{Min: failedTagRetryMin, Max: failedTagRetryMax},
+		}
+		cw.failedTags[slot] = ft
+	}
+	ft.Reason = reason
+	ft.RetryAfter = time.Now().Add(ft.backoff.Next())
+	cw.RecheckPending = true
+	return ft
+}
+
+// tagBackoff returns why tag is not tried in the slot yet, or an empty string.
+func (cw *ContainerSyncWorker) tagBackoff(slot string, tag string) string {
+	ft, ok := cw.failedTags[slot]
+	if !ok || ft.Tag != tag || time.Now().After(ft.RetryAfter) {
+		return ""
+	}
+	return fmt.Sprintf("%s failed, retrying after %s, %s", tag, ft.RetryAfter.Format(time.RFC3339), ft.Reason)
+}
+
+// tagSucceeded forgets an earlier failure once the container of a tag came up.
+func (cw *ContainerSyncWorker) tagSucceeded(slot string, tag string) {
+	if ft, ok := cw.failedTags[slot]; ok && ft.Tag == tag {
+		delete(cw.failedTags, slot)
+	}
+}
+
+// restorePrevious brings back the container a failed replacement stopped or
+// removed, at its previous tag. The old container is started again if it
+// still exists, otherwise it is recreated. Hooks are not run, the previous
+// version went through them when it was first started.
+// Returns the ID of the running container.
+func (cw *ContainerSyncWorker) restorePrevious(creation *containerCreation) (string, error) {
+	upgrade := creation.Upgrade
+	entry := &audit.Entry{
+		Type:    audit.TypeRollback,
+		Target:  creation.Target.Id,
+		Image:   creation.Image,
+		Tag:     upgrade.OldTag,
+		Message: fmt.Sprintf("%s did not come up, back to %s", upgrade.NewTag, upgrade.OldTag),
+	}
+	cid, err := cw.startPrevious(creation)
+	entry.Container = cid
+	entry.Outcome = audit.Outcome(err)
+	if err != nil {
+		entry.Message = err.Error()
+	}
+	cw.Audit.Record(entry)
+	return cid, err
+}
+
+func (cw *ContainerSyncWorker) startPrevious(creation *containerCreation) (string, error) {
+	if creation.Replaces != "" {
+		if _, err := cw.DockerClient.ContainerInspect(context.Background(), creation.Replaces); err == nil {
+			containerLog(creation.Target.Id, creation.Replaces, creation.Image, creation.Upgrade.OldTag).Info("Starting previous container again...")
+			if err := cw.DockerClient.ContainerStart(context.Background(), creation.Replaces, dct.ContainerStartOptions{}); err != nil {
+				metrics.DockerErrors.Inc("container_start")
+				return creation.Replaces, err
+			}
+			return creation.Replaces, nil
+		}
+	}
+
+	previous := cw.buildContainerCreation(creation.Target, creation.Image, creation.Upgrade.OldTag, creation.Replica, creation.Generation+1)
+	ctr := &previous.Options
+	plog := previous.log()
+	plog.Info("Recreating previous container...")
+	created, err := cw.DockerClient.ContainerCreate(context.Background(), ctr.Config, ctr.HostConfig, ctr.NetworkingConfig, ctr.Name)
+	if isNameConflict(err) {
+		ctr.Name = uniqueContainerName(ctr.Name)
+		created, err = cw.DockerClient.ContainerCreate(context.Background(), ctr.Config, ctr.HostConfig, ctr.NetworkingConfig, ctr.Name)
+	}
+	if err != nil {
+		metrics.DockerErrors.Inc("container_create")
+		return "", err
+	}
+	if err := cw.connectNetworks(created.ID, previous.ExtraEndpoints); err != nil {
+		plog.WithField("container", created.ID).Warnf("Previous container network error, starting it anyway, %v", err)
+	}
+	if err := cw.DockerClient.ContainerStart(context.Background(), created.ID, dct.ContainerStartOptions{}); err != nil {
+		metrics.DockerErrors.Inc("container_start")
+		return created.ID, err
+	}
+	return created.ID, nil
+}
@@ -0,0 +1,118 @@
+package containersync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dct "github.com/docker/docker/api/types"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/schedule"
+	"github.com/fuserobotics/deviced/pkg/state"
+)
+
+// Label holding the time a scheduled run was due.
+const deviced_schedule_run_label string = "deviced.schedule-run"
+
+// noteScheduledRun keeps the earliest upcoming scheduled run, so the worker wakes for it.
+func (cw *ContainerSyncWorker) noteScheduledRun(t time.Time) {
+	if cw.NextScheduledRun.IsZero() || t.Before(cw.NextScheduledRun) {
+		cw.NextScheduledRun = t
+	}
+}
+
+// processScheduled collects finished runs of a scheduled target and starts a run when one is due.
+func (cw *ContainerSyncWorker) processScheduled(tctr *config.TargetContainer, ctrs []dct.Container, tags []string, tstatus *state.TargetStatus) *containerCreation {
+	sched, err := schedule.Parse(tctr.Schedule)
+	if err != nil {
+		targetLog(tctr.Id).Warnf("Invalid schedule for %s, %v", tctr.Id, err)
+		return nil
+	}
+	if cw.Store == nil {
+		targetLog(tctr.Id).Infof("No state store, not scheduling %s.", tctr.Id)
+		return nil
+	}
+
+	running := 0
+	for _, ctr := range ctrs {
+		if ctr.State == "running" {
+			running++
+			tstatus.ContainerID = ctr.ID
+			continue
+		}
+		cw.collectJobResult(tctr, ctr, tstatus)
+	}
+	defer func() {
+		tstatus.RunHistory = cw.Store.RunHistory(tctr.Id)
+	}()
+
+	now := time.Now()
+	last, ok := cw.Store.LastScheduled(tctr.Id)
+	if !ok {
+		// Start counting from the first time we see the schedule.
+		last = now
+		if err := cw.Store.SetLastScheduled(tctr.Id, now); err != nil {
+			targetLog(tctr.Id).Warnf("Unable to store schedule state for %s, %v", tctr.Id, err)
+		}
+	}
+	due := sched.Next(last)
+	if due.IsZero() {
+		targetLog(tctr.Id).Infof("Schedule %q for %s never matches.", tctr.Schedule, tctr.Id)
+		return nil
+	}
+	if due.After(now) {
+		cw.noteScheduledRun(due)
+		tstatus.NextRun = &due
+		return nil
+	}
+
+	// Runs missed while we were not running collapse into this one.
+	following := sched.Next(now)
+	if !following.IsZero() {
+		cw.noteScheduledRun(following)
+		tstatus.NextRun = &following
+	}
+	if running > 0 && !tctr.AllowOverlap {
+		if err := cw.Store.SetLastScheduled(tctr.Id, now); err != nil {
+			targetLog(tctr.Id).Warnf("Unable to store schedule state for %s, %v", tctr.Id, err)
+			return nil
+		}
+		targetLog(tctr.Id).Infof("Scheduled run of %s due at %s skipped, previous run still active.", tctr.Id, due.Format(time.RFC3339))
+		if cw.Status != nil {
+			cw.Status.AddEvent(tctr.Id, "schedule", fmt.Sprintf("run due at %s skipped, previous run still active", due.Format(time.RFC3339)))
+		}
+		return nil
+	}
+
+	// The run is only recorded once its container is created, until then it stays due.
+	tag, ok := bestAvailableTag(tctr, tags)
+	if !ok {
+		targetLog(tctr.Id).Infof("Scheduled target %s has no suitable image yet, run due at %s is waiting.", tctr.Id, due.Format(time.RFC3339))
+		tstatus.WaitingForImage = true
+		return nil
+	}
+
+	targetLog(tctr.Id).WithFields(logrus.Fields{"image": tctr.Image, "tag": tag}).Infof("Starting scheduled run due at %s...", due.Format(time.RFC3339))
+	creation := cw.buildContainerCreation(tctr, tctr.Image, tag, 0, 0)
+	creation.Options.Name = strings.Join([]string{"devd", tctr.Id, strconv.FormatInt(due.Unix(), 10)}, "_")
+	creation.Options.Config.Labels[deviced_schedule_run_label] = due.Format(time.RFC3339)
+	creation.ScheduledAt = now
+	return creation
+}
+
+// recordScheduledRun stores the time of a scheduled run once its container was created.
+// A run that could not be created is retried on the next recheck.
+func (cw *ContainerSyncWorker) recordScheduledRun(creation *containerCreation, err error) {
+	if creation.ScheduledAt.IsZero() {
+		return
+	}
+	if err != nil {
+		cw.RecheckPending = true
+		return
+	}
+	if err := cw.Store.SetLastScheduled(creation.Target.Id, creation.ScheduledAt); err != nil {
+		targetLog(creation.Target.Id).Warnf("Unable to store schedule state for %s, %v", creation.Target.Id, err)
+	}
+}
@@ -0,0 +1,134 @@
+package containersync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	dcc "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+	"github.com/fuserobotics/deviced/pkg/secrets"
+)
+
+// targetSecretsDir is the dir holding the secret files of a target as seen
+// by deviced, shared by its replicas.
+func (cw *ContainerSyncWorker) targetSecretsDir(tctr *config.TargetContainer) string {
+	return path.Join(cw.Config.ContainerConfig.SecretsDir, tctr.Id)
+}
+
+// secretsHostDir returns the path dockerd sees for the secrets dir. When
+// deviced runs in a container, the dir must be bind mounted from the host,
+// a dir or tmpfs inside our own container is not visible to dockerd.
+func (cw *ContainerSyncWorker) secretsHostDir() (string, error) {
+	dir := path.Clean(cw.Config.ContainerConfig.SecretsDir)
+	if cw.Reflection == nil {
+		return dir, nil
+	}
+	for _, mp := range cw.Reflection.Container.Mounts {
+		if mp.Type != mount.TypeBind {
+			continue
+		}
+		dest := path.Clean(mp.Destination)
+		if dir == dest || strings.HasPrefix(dir, dest+"/") {
+			return path.Join(mp.Source, strings.TrimPrefix(dir, dest)), nil
+		}
+	}
+	return "", fmt.Errorf("deviced runs in a container and %s is not bind mounted from the host, mount a host tmpfs there", dir)
+}
+
+// addSecretsMount mounts the secrets dir of a target read-only. The dir is
+// mounted rather than the files, so rewritten files show up in the container.
+func (cw *ContainerSyncWorker) addSecretsMount(tctr *config.TargetContainer, hostConfig *dcc.HostConfig) {
+	if len(tctr.Secrets) == 0 {
+		return
+	}
+	// An unusable dir fails in writeSecrets, before the container is created.
+	hostDir, err := cw.secretsHostDir()
+	if err != nil {
+		hostDir = cw.Config.ContainerConfig.SecretsDir
+	}
+	hostConfig.Binds = append(hostConfig.Binds, path.Join(hostDir, tctr.Id)+":"+config.ContainerSecretsPath+":ro")
+}
+
+// prepareSecretsDir makes sure the secrets dir is on a tmpfs dockerd can
+// bind. On the host a tmpfs is mounted if needed. In a container the host
+// must provide it, a tmpfs mounted by us would hide the bind mount.
+func (cw *ContainerSyncWorker) prepareSecretsDir() error {
+	dir := cw.Config.ContainerConfig.SecretsDir
+	if _, err := cw.secretsHostDir(); err != nil {
+		return err
+	}
+	if cw.Reflection == nil {
+		return secrets.EnsureTmpfs(dir)
+	}
+	ok, err := secrets.IsTmpfs(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not on a tmpfs, bind mount a tmpfs from the host there", dir)
+	}
+	return nil
+}
+
+// writeSecrets resolves the secrets of a target into its dir on the secrets
+// tmpfs, removing files of secrets no longer in the config.
+func (cw *ContainerSyncWorker) writeSecrets(tctr *config.TargetContainer) error {
+	if len(tctr.Secrets) == 0 {
+		return nil
+	}
+	if err := cw.prepareSecretsDir(); err != nil {
+		return fmt.Errorf("unable to use %s for secrets, %v", cw.Config.ContainerConfig.SecretsDir, err)
+	}
+	dir := cw.targetSecretsDir(tctr)
+	// Readable by any user in the container, the parent dir is root only.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, secret := range tctr.Secrets {
+		val, err := cw.Secrets.Resolve(secret.From)
+		if err != nil {
+			return fmt.Errorf("secret %s: %v", secret.Name, err)
+		}
+		if err := ioutils.AtomicWriteFile(path.Join(dir, secret.Name), val, 0444); err != nil {
+			return fmt.Errorf("secret %s: %v", secret.Name, err)
+		}
+		names[secret.Name] = true
+	}
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if !names[info.Name()] {
+			os.Remove(path.Join(dir, info.Name()))
+		}
+	}
+	return nil
+}
+
+// pruneSecrets removes the secret files of targets that no longer have secrets.
+func (cw *ContainerSyncWorker) pruneSecrets() {
+	dir := cw.Config.ContainerConfig.SecretsDir
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, tctr := range cw.Config.Containers {
+		if len(tctr.Secrets) != 0 {
+			keep[tctr.Id] = true
+		}
+	}
+	for _, info := range infos {
+		if keep[info.Name()] {
+			continue
+		}
+		log.Infof("Removing secret files of %s...", info.Name())
+		if err := os.RemoveAll(path.Join(dir, info.Name())); err != nil {
+			log.Warnf("Unable to remove secret files of %s, %v", info.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package containersync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dct "github.com/docker/docker/api/types"
+	dcc "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+	"github.com/fuserobotics/deviced/pkg/tarsum"
+)
+
+// Where volumes are mounted in snapshot helper containers.
+const snapshotMountPoint string = "/deviced-volume"
+
+const snapshotManifestFile string = "snapshot.json"
+
+// snapshotManifest describes a snapshot of the volumes of a target.
+type snapshotManifest struct {
+	Target string `json:"target"`
+	// Tag of the container the volumes were used by
+	Tag string `json:"tag"`
+	// Tag the container was replaced with
+	NextTag string    `json:"nextTag"`
+	Created time.Time `json:"created"`
+	// Taken while rolling back, never restored
+	Rollback bool `json:"rollback,omitempty"`
+	// Volume name to tarsum of the archive
+	Volumes map[string]string `json:"volumes"`
+
+	dir string
+}
+
+// snapshotDir is where the snapshots of a target are kept.
+func (cw *ContainerSyncWorker) snapshotDir(tctr *config.TargetContainer) string {
+	return path.Join(cw.Config.DataDir, "snapshots", tctr.Id)
+}
+
+// createVolumeHelper creates, but does not start, a container with the volume
+// mounted so its contents can be copied in and out.
+func (cw *ContainerSyncWorker) createVolumeHelper(tctr *config.TargetContainer, image string, volume string) (string, error) {
+	ctrConfig := &dcc.Config{
+		Image: image,
+		// never started, but the daemon wants a command
+		Entrypoint: strslice.StrSlice{"true"},
+		Labels:     map[string]string{deviced_hook_label: tctr.Id},
+	}
+	hostConfig := &dcc.HostConfig{
+		Binds: []string{volume + ":" + snapshotMountPoint},
+	}
+	created, err := cw.DockerClient.ContainerCreate(context.Background(), ctrConfig, hostConfig, nil, "")
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// snapshotVolume writes the contents of a volume to a tar file, returning its tarsum.
+func (cw *ContainerSyncWorker) snapshotVolume(tctr *config.TargetContainer, image string, volume string, dest string) (string, error) {
+	cid, err := cw.createVolumeHelper(tctr, image, volume)
+	if err != nil {
+		return "", err
+	}
+	defer cw.DockerClient.ContainerRemove(context.Background(), cid, dct.ContainerRemoveOptions{Force: true})
+
+	rc, _, err := cw.DockerClient.CopyFromContainer(context.Background(), cid, snapshotMountPoint)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	ts, err := tarsum.NewTarSum(rc, true, tarsum.Version1)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, ts); err != nil {
+		return "", err
+	}
+	return ts.Sum(nil), f.Sync()
+}
+
+// snapshotVolumes snapshots the configured volumes of a target whose
+// container at image:tag has been stopped for an upgrade.
+func (cw *ContainerSyncWorker) snapshotVolumes(tctr *config.TargetContainer, image string, tag string, upgrade *containerUpgrade) error {
+	volumes := cw.Config.SnapshotVolumes(tctr)
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	manifest := &snapshotManifest{
+		Target:   tctr.Id,
+		Tag:      tag,
+		NextTag:  upgrade.NewTag,
+		Created:  now,
+		Rollback: upgrade.Restore != nil,
+		Volumes:  make(map[string]string),
+		dir:      path.Join(cw.snapshotDir(tctr), strings.Join([]string{now.UTC().Format("20060102T150405Z"), tag}, "_")),
+	}
+	if err := os.MkdirAll(manifest.dir, 0700); err != nil {
+		return err
+	}
+
+	for _, volume := range volumes {
+		targetLog(tctr.Id).Infof("Snapshotting volume %s of %s...", volume, tctr.Id)
+		sum, err := cw.snapshotVolume(tctr, strings.Join([]string{image, tag}, ":"), volume, path.Join(manifest.dir, volume+".tar"))
+		if err != nil {
+			os.RemoveAll(manifest.dir)
+			return fmt.Errorf("snapshot of volume %s failed, %v", volume, err)
+		}
+		manifest.Volumes[volume] = sum
+	}
+
+	dat, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(path.Join(manifest.dir, snapshotManifestFile), dat, 0600); err != nil {
+		os.RemoveAll(manifest.dir)
+		return err
+	}
+	targetLog(tctr.Id).WithFields(logrus.Fields{"image": image, "tag": tag}).Infof("Snapshot written to %s.", manifest.dir)
+	upgrade.Taken = manifest
+
+	cw.pruneSnapshots(tctr)
+	return nil
+}
+
+// listSnapshots returns the complete snapshots of a target, newest first.
+func (cw *ContainerSyncWorker) listSnapshots(tctr *config.TargetContainer) []*snapshotManifest {
+	dir := cw.snapshotDir(tctr)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var manifests []*snapshotManifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		sdir := path.Join(dir, entry.Name())
+		dat, err := ioutil.ReadFile(path.Join(sdir, snapshotManifestFile))
+		if err != nil {
+			continue
+		}
+		manifest := &snapshotManifest{}
+		if err := json.Unmarshal(dat, manifest); err != nil {
+			log.Warnf("Ignoring invalid snapshot %s, %v", sdir, err)
+			continue
+		}
+		manifest.dir = sdir
+		manifests = append(manifests, manifest)
+	}
+	sort.Sort(snapshotsNewestFirst(manifests))
+	return manifests
+}
+
+type snapshotsNewestFirst []*snapshotManifest
+
+func (s snapshotsNewestFirst) Len() int           { return len(s) }
+func (s snapshotsNewestFirst) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotsNewestFirst) Less(i, j int) bool { return s[i].Created.After(s[j].Created) }
+
+// pruneSnapshots removes the oldest snapshots beyond the retention limit.
+func (cw *ContainerSyncWorker) pruneSnapshots(tctr *config.TargetContainer) {
+	manifests := cw.listSnapshots(tctr)
+	for i := tctr.Snapshot.EffectiveKeep(); i < len(manifests); i++ {
+		log.Infof("Removing old snapshot %s.", manifests[i].dir)
+		if err := os.RemoveAll(manifests[i].dir); err != nil {
+			log.Warnf("Unable to remove snapshot %s, %v", manifests[i].dir, err)
+		}
+	}
+}
+
+// findRollbackSnapshot returns the snapshot to restore when replacing a
+// container at oldTag with newTag. This is a rollback if the newest snapshot
+// from newTag was taken when upgrading to oldTag. Snapshots taken during a
+// rollback are not restored, going forward again runs the upgrade again.
+func (cw *ContainerSyncWorker) findRollbackSnapshot(tctr *config.TargetContainer, oldTag string, newTag string) *snapshotManifest {
+	for _, manifest := range cw.listSnapshots(tctr) {
+		if manifest.Tag != newTag {
+			continue
+		}
+		if manifest.NextTag == oldTag && !manifest.Rollback {
+			return manifest
+		}
+		return nil
+	}
+	return nil
+}
+
+// verifySnapshotFile checks a snapshot archive against its recorded tarsum.
+func verifySnapshotFile(file string, expected string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ts, err := tarsum.NewTarSum(f, true, tarsum.Version1)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+		return err
+	}
+	if sum := ts.Sum(nil); sum != expected {
+		return fmt.Errorf("checksum mismatch, expected %s got %s", expected, sum)
+	}
+	return nil
+}
+
+// recreateVolume removes a managed volume and creates it again empty.
+func (cw *ContainerSyncWorker) recreateVolume(name string) error {
+	vol := cw.Config.GetVolume(name)
+	if vol == nil {
+		return errors.New("volume is not managed")
+	}
+	if err := cw.DockerClient.VolumeRemove(context.Background(), name, false); err != nil {
+		return err
+	}
+	_, err := cw.createVolume(vol)
+	return err
+}
+
+// verifySnapshot checks the archives of a snapshot against their checksums.
+func verifySnapshot(manifest *snapshotManifest) error {
+	for volume, sum := range manifest.Volumes {
+		file := path.Join(manifest.dir, volume+".tar")
+		if err := verifySnapshotFile(file, sum); err != nil {
+			return fmt.Errorf("snapshot of volume %s is invalid, %v", volume, err)
+		}
+	}
+	return nil
+}
+
+// restoreSnapshot replaces the contents of the snapshotted volumes.
+// The containers using the volumes must have been removed.
+func (cw *ContainerSyncWorker) restoreSnapshot(tctr *config.TargetContainer, manifest *snapshotManifest, image string) error {
+	if err := verifySnapshot(manifest); err != nil {
+		return err
+	}
+
+	for volume := range manifest.Volumes {
+		targetLog(tctr.Id).Infof("Restoring volume %s of %s from %s...", volume, tctr.Id, manifest.dir)
+		// Start from an empty volume, fall back to extracting over the
+		// current contents if the volume is still in use.
+		if err := cw.recreateVolume(volume); err != nil {
+			log.Warnf("Unable to recreate volume %s, restoring over existing contents, %v", volume, err)
+		}
+		if err := cw.restoreVolume(tctr, image, volume, path.Join(manifest.dir, volume+".tar")); err != nil {
+			return fmt.Errorf("restore of volume %s failed, %v", volume, err)
+		}
+	}
+	return nil
+}
+
+// restoreVolume extracts a snapshot archive into a volume.
+func (cw *ContainerSyncWorker) restoreVolume(tctr *config.TargetContainer, image string, volume string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cid, err := cw.createVolumeHelper(tctr, image, volume)
+	if err != nil {
+		return err
+	}
+	defer cw.DockerClient.ContainerRemove(context.Background(), cid, dct.ContainerRemoveOptions{Force: true})
+
+	// The archive entries are rooted at the mount point directory.
+	return cw.DockerClient.CopyToContainer(context.Background(), cid, path.Dir(snapshotMountPoint), f, dct.CopyToContainerOptions{})
+}
@@ -0,0 +1,76 @@
+package containersync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+)
+
+// writeTestSnapshot writes a snapshot manifest of tctr, age before now.
+func writeTestSnapshot(t *testing.T, cw *ContainerSyncWorker, tctr *config.TargetContainer, age int, manifest *snapshotManifest) {
+	manifest.Target = tctr.Id
+	manifest.Created = time.Now().Add(-time.Duration(age) * time.Minute)
+	dir := path.Join(cw.snapshotDir(tctr), strconv.Itoa(age))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err.Error())
+	}
+	dat, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(path.Join(dir, snapshotManifestFile), dat, 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestFindRollbackSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	cw := &ContainerSyncWorker{Config: &config.DevicedConfig{DataDir: dir}}
+	tctr := &config.TargetContainer{Id: "ros"}
+
+	if res := cw.findRollbackSnapshot(tctr, "v2", "v1"); res != nil {
+		t.Fatalf("expected no snapshot without any taken, got %s", res.dir)
+	}
+
+	// Upgrade from v1 to v2.
+	writeTestSnapshot(t, cw, tctr, 30, &snapshotManifest{Tag: "v1", NextTag: "v2"})
+	if res := cw.findRollbackSnapshot(tctr, "v1", "v2"); res != nil {
+		t.Fatalf("expected no snapshot for a forward upgrade, got %s", res.dir)
+	}
+
+	// Back from v2 to v1 restores the volumes v1 left.
+	res := cw.findRollbackSnapshot(tctr, "v2", "v1")
+	if res == nil || res.Tag != "v1" || res.NextTag != "v2" {
+		t.Fatalf("expected the v1 snapshot for a rollback, got %v", res)
+	}
+	if res.dir != path.Join(cw.snapshotDir(tctr), "30") {
+		t.Fatalf("unexpected snapshot dir %s", res.dir)
+	}
+
+	// The rollback snapshots what v2 left, forward to v2 again runs the upgrade again.
+	writeTestSnapshot(t, cw, tctr, 20, &snapshotManifest{Tag: "v2", NextTag: "v1", Rollback: true})
+	if res := cw.findRollbackSnapshot(tctr, "v1", "v2"); res != nil {
+		t.Fatalf("expected a rollback snapshot not to be restored, got %s", res.dir)
+	}
+
+	// A newer upgrade from v1 to v3 means v1 data no longer matches v2.
+	writeTestSnapshot(t, cw, tctr, 10, &snapshotManifest{Tag: "v1", NextTag: "v3"})
+	if res := cw.findRollbackSnapshot(tctr, "v2", "v1"); res != nil {
+		t.Fatalf("expected only the newest v1 snapshot to count, got %s", res.dir)
+	}
+	res = cw.findRollbackSnapshot(tctr, "v3", "v1")
+	if res == nil || res.NextTag != "v3" {
+		t.Fatalf("expected the newest v1 snapshot for a rollback from v3, got %v", res)
+	}
+}
@@ -0,0 +1,111 @@
+package containersync
+
+import (
+	"context"
+
+	dct "github.com/docker/docker/api/types"
+	dcf "github.com/docker/docker/api/types/filters"
+	dcv "github.com/docker/docker/api/types/volume"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/metrics"
+)
+
+// Set on volumes created by deviced, the value is the volume name.
+const deviced_volume_label string = "deviced.volume"
+
+// processVolumes creates missing managed volumes.
+// Returns the existing volumes by name, or nil on error.
+func (cw *ContainerSyncWorker) processVolumes() map[string]*dct.Volume {
+	log.Info("ContainerSyncWorker checking volumes...")
+
+	list, err := cw.DockerClient.VolumeList(context.Background(), dcf.NewArgs())
+	if err != nil {
+		metrics.DockerErrors.Inc("volume_list")
+		log.Warnf("Unable to sync volumes, error: %v", err)
+		return nil
+	}
+
+	volMap := make(map[string]*dct.Volume)
+	for _, vol := range list.Volumes {
+		volMap[vol.Name] = vol
+	}
+
+	for _, vol := range cw.Config.Volumes {
+		if vol.Name == "" {
+			log.Warn("invalid volume definition in config with empty name.")
+			continue
+		}
+		if _, ok := volMap[vol.Name]; ok {
+			continue
+		}
+
+		log.Infof("Attempting to create volume %s...", vol.Name)
+		created, err := cw.createVolume(vol)
+		if err != nil {
+			log.Errorf("Error creating volume %s, %v!", vol.Name, err)
+			continue
+		}
+		log.Infof("Created volume %s succesfully.", vol.Name)
+		volMap[vol.Name] = &created
+	}
+
+	return volMap
+}
+
+// createVolume creates a managed volume, labelled as owned by deviced.
+func (cw *ContainerSyncWorker) createVolume(vol *config.VolumeConfig) (dct.Volume, error) {
+	labels := make(map[string]string)
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	labels[deviced_volume_label] = vol.Name
+	return cw.DockerClient.VolumeCreate(context.Background(), dcv.VolumesCreateBody{
+		Name:       vol.Name,
+		Driver:     vol.Driver,
+		DriverOpts: vol.DriverOpts,
+		Labels:     labels,
+	})
+}
+
+// missingVolume returns the first managed volume used by the target that does not exist.
+func (cw *ContainerSyncWorker) missingVolume(volMap map[string]*dct.Volume, tctr *config.TargetContainer) string {
+	for _, name := range cw.Config.TargetVolumes(tctr) {
+		if _, ok := volMap[name]; !ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// volumesBlocked returns why the target cannot be created because of its
+// managed volumes, or an empty string. A nil volMap means the volumes could
+// not be listed, the target waits rather than risk losing its container.
+func (cw *ContainerSyncWorker) volumesBlocked(volMap map[string]*dct.Volume, tctr *config.TargetContainer) string {
+	if len(cw.Config.TargetVolumes(tctr)) == 0 {
+		return ""
+	}
+	if volMap == nil {
+		return "unable to list volumes"
+	}
+	if missing := cw.missingVolume(volMap, tctr); missing != "" {
+		return "waiting for volume " + missing
+	}
+	return ""
+}
+
+// pruneVolumes removes volumes created by deviced that are no longer in the config.
+// Volumes still in use by a container are left alone by the daemon.
+func (cw *ContainerSyncWorker) pruneVolumes(volMap map[string]*dct.Volume) {
+	for name, vol := range volMap {
+		if _, ok := vol.Labels[deviced_volume_label]; !ok {
+			continue
+		}
+		if cw.Config.GetVolume(name) != nil {
+			continue
+		}
+		log.Infof("Pruning orphaned volume %s...", name)
+		if err := cw.DockerClient.VolumeRemove(context.Background(), name, false); err != nil {
+			log.Warnf("Unable to remove volume %s, %v", name, err)
+		}
+	}
+}
@@ -3,26 +3,54 @@ package containersync
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	dct "github.com/docker/docker/api/types"
 	dce "github.com/docker/docker/api/types/events"
 	dcf "github.com/docker/docker/api/types/filters"
 	dc "github.com/docker/docker/client"
+	"github.com/fuserobotics/deviced/pkg/audit"
 	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/metrics"
 	"github.com/fuserobotics/deviced/pkg/reflection"
+	"github.com/fuserobotics/deviced/pkg/secrets"
 	"github.com/fuserobotics/deviced/pkg/state"
 	"github.com/fuserobotics/deviced/pkg/utils"
 )
 
+var log = logging.Component("containersync")
+
+// targetLog returns a logger tagged with the target id.
+func targetLog(id string) *logrus.Entry {
+	return log.WithField("target", id)
+}
+
+// containerLog returns a logger tagged with a container, and its target
+// and image if known.
+func containerLog(target string, cid string, image string, tag string) *logrus.Entry {
+	fields := logrus.Fields{"container": cid}
+	if target != "" {
+		fields["target"] = target
+	}
+	if image != "" {
+		fields["image"] = image
+	}
+	if tag != "" {
+		fields["tag"] = tag
+	}
+	return log.WithFields(fields)
+}
+
 const deviced_id_label string = "deviced.id"
 
-/* Container Sync Worker
+/*
+	Container Sync Worker
+
 This worker periodically compares the list of
 target containers, the list of running containers,
 and attempts to reconcile by deleting / creating.
@@ -43,38 +71,56 @@ type ContainerSyncWorker struct {
 	WorkerLock   *sync.Mutex
 	DockerClient *dc.Client
 	Reflection   *reflection.DevicedReflection
+	Status       *state.Status
+	Store        *state.Store
+	Audit        *audit.Log
+	Secrets      *secrets.Store
 
 	EventsContext       context.Context
 	EventsContextCancel context.CancelFunc
 	Running             bool
+	// Guards Running against Wake racing Quit
+	wakeMtx sync.Mutex
 
 	EventsChannel <-chan dce.Message
 	ErrorsChannel <-chan error
 	WakeChannel   chan bool
+
+	// Set when a replacement was deferred or an init container failed,
+	// triggers periodic rechecks
+	RecheckPending bool
+	InitRetryAfter map[string]time.Time
+	// Tags whose container did not come up, by slot
+	failedTags map[string]*failedTag
+	// Network definitions that could not replace a network, by name
+	failedNetworks map[string]*failedNetwork
+	// Attachments of networks that could be neither recreated nor restored, by name
+	detachedNetworks map[string][]*networkAttachment
+	// Earliest upcoming scheduled run, zero if none
+	NextScheduledRun time.Time
 }
 
+// pendingRecheckPeriod is how often deferred work is re-evaluated.
+const pendingRecheckPeriod = time.Duration(1) * time.Minute
+
 // Init the worker
 func (cw *ContainerSyncWorker) Init() error {
 	cw.Running = true
-	cw.WakeChannel = make(chan bool)
+	cw.WakeChannel = make(chan bool, 1)
+	cw.InitRetryAfter = make(map[string]time.Time)
+	cw.failedTags = make(map[string]*failedTag)
+	cw.failedNetworks = make(map[string]*failedNetwork)
+	cw.detachedNetworks = make(map[string][]*networkAttachment)
 	cw.startEventStream()
 	return nil
 }
 
-func (cw *ContainerSyncWorker) startEventStream() {
-	cw.stopEventStream()
-
-	fmt.Printf("Registering event listeners...\n")
-	cw.EventsContext, cw.EventsContextCancel = context.WithCancel(context.Background())
-	cw.EventsChannel, cw.ErrorsChannel = cw.DockerClient.Events(cw.EventsContext, dct.EventsOptions{})
-}
-
 func (cw *ContainerSyncWorker) stopEventStream() {
 	if cw.EventsContextCancel == nil {
 		return
 	}
 
-	fmt.Printf("Closing event listeners...\n")
+	log.Info("Closing event listeners...")
 	cw.EventsContextCancel()
 	cw.EventsContextCancel = nil
 	cw.EventsContext = nil
@@ -95,6 +141,8 @@ func buildRunningContainer(ctr dct.Container, mt *config.TargetContainer, score
 	nrc.Image, nrc.ImageTag = utils.ParseImageAndTag(ctr.Image)
 	nrc.ApiContainer = &ctr
 	nrc.Score = score
+	nrc.Replica = labelInt(&ctr, deviced_replica_label)
+	nrc.Generation = labelInt(&ctr, deviced_generation_label)
 	return nrc
 }
 
@@ -109,12 +157,18 @@ func (cw *ContainerSyncWorker) processNetworks() map[string]dct.NetworkResource
 		}
 	*/
 
-	fmt.Printf("ContainerSyncWorker checking networks...\n")
+	log.Info("ContainerSyncWorker checking networks...")
+	started := time.Now()
+	defer func() {
+		metrics.ReconcileTotal.Inc(metrics.WorkerNetwork)
+		metrics.ReconcileDuration.Observe(time.Since(started).Seconds(), metrics.WorkerNetwork)
+	}()
 
 	// Load the current network list
 	list, err := cw.DockerClient.NetworkList(context.Background(), dct.NetworkListOptions{})
 	if err != nil {
-		fmt.Printf("Unable to sync networks, error: %v\n", err)
+		metrics.DockerErrors.Inc("network_list")
+		log.Warnf("Unable to sync networks, error: %v", err)
 		return nil
 	}
 
@@ -126,47 +180,100 @@ func (cw *ContainerSyncWorker) processNetworks() map[string]dct.NetworkResource
 	targetNetworks := cw.Config.Networks
 	for _, net := range targetNetworks {
 		if net.Name == "" {
-			fmt.Printf("Warning: invalid network definition in config with empty name.\n")
+			log.Warn("invalid network definition in config with empty name.")
 			continue
 		}
-		if _, ok := netMap[net.Name]; ok {
+		if existing, ok := netMap[net.Name]; ok {
+			want := config.NetworkHash(net)
+			if hash, managed := existing.Labels[deviced_network_hash_label]; managed && hash != want {
+				// Recreating emits network events, do not loop on a definition that keeps failing.
+				if retryAfter := cw.networkBackoff(net.Name, want); !retryAfter.IsZero() {
+					log.Infof("Not recreating network %s until %s, the last attempt failed.", net.Name, retryAfter.Format(time.RFC3339))
+					continue
+				}
+				resource, err := cw.recreateNetwork(net, existing)
+				if err != nil {
+					fn := cw.networkFailed(net.Name, want)
+					log.Errorf("Error recreating network %s, retrying after %s, %v!", net.Name, fn.RetryAfter.Format(time.RFC3339), err)
+				} else {
+					delete(cw.failedNetworks, net.Name)
+				}
+				if resource.ID == "" {
+					delete(netMap, net.Name)
+				} else {
+					netMap[net.Name] = resource
+				}
+			}
 			continue
 		}
 
-		fmt.Printf("Attempting to create network %s...\n", net.Name)
-		cnet, err := cw.DockerClient.NetworkCreate(context.Background(), net.Name, net.NetworkCreate)
-		if err != nil {
-			fmt.Printf("Error creating network %s, %v!\n", net.Name, err)
-			continue
-		}
-		fmt.Printf("Created network %s succesfully.\n", net.Name)
-		resource, err := cw.DockerClient.NetworkInspect(context.Background(), cnet.ID)
+		log.Infof("Attempting to create network %s...", net.Name)
+		resource, err := cw.createNetwork(net)
 		if err != nil {
-			fmt.Printf("Error fetching created network %s, %v!\n", cnet.ID, err)
-			netMap[net.Name] = dct.NetworkResource{ID: cnet.ID}
+			log.Errorf("Error creating network %s, %v!", net.Name, err)
 			continue
 		}
+		log.Infof("Created network %s succesfully.", net.Name)
 		netMap[net.Name] = resource
+		cw.reattachDetached(resource)
 	}
 
+	for name := range cw.failedNetworks {
+		if cw.Config.GetNetwork(name) == nil {
+			delete(cw.failedNetworks, name)
+		}
+	}
+	cw.removeOrphanedNetworks(netMap)
+
 	return netMap
 }
 
+// replacementAllowed checks if a running container for the target may be replaced now.
+func (cw *ContainerSyncWorker) replacementAllowed(tctr *config.TargetContainer, current *state.RunningContainer) (bool, string) {
+	if cw.Status != nil && cw.Status.IsHeld(tctr.Id) {
+		return false, "replacement is held"
+	}
+	windows := tctr.EffectiveUpdateWindows(cw.Config.ContainerConfig.UpdateWindows)
+	if !config.InUpdateWindow(windows, time.Now()) {
+		return false, "outside of update window"
+	}
+	// Let the application veto, only a running container can answer.
+	if current.ApiContainer != nil && current.ApiContainer.State == "running" {
+		hctx := newContainerRemoval(tctr, current).hookContext(current.ApiContainer.ID, hookPhasePreUpdate)
+		return cw.checkPreUpdateHooks(hctx, tctr.LifecycleHooks.PreUpdate)
+	}
+	return true, ""
+}
+
+// processOnce reconciles all targets.
 func (cw *ContainerSyncWorker) processOnce() {
+	cw.processTargets(nil)
+}
+
+// processTargets reconciles the targets with the given lower case IDs,
+// or all of them if nil. Containers of other targets are left alone.
+func (cw *ContainerSyncWorker) processTargets(only map[string]bool) {
 	// Lock config
 	cw.ConfigLock.Lock()
 	defer cw.ConfigLock.Unlock()
 	cw.WorkerLock.Lock()
 	defer cw.WorkerLock.Unlock()
 
+	started := time.Now()
+	defer func() {
+		metrics.ReconcileTotal.Inc(metrics.WorkerContainer)
+		metrics.ReconcileDuration.Observe(time.Since(started).Seconds(), metrics.WorkerContainer)
+	}()
+
 	netMap := cw.processNetworks()
+	volMap := cw.processVolumes()
 
-	fmt.Printf("ContainerSyncWorker checking containers...\n")
+	log.Info("ContainerSyncWorker checking containers...")
 
 	// Load the current container list
 	args, err := dcf.ParseFlag("label="+deviced_id_label, dcf.NewArgs())
 	if err != nil {
-		fmt.Printf("Unable to build label filter! %v\n", err)
+		log.Warnf("Unable to build label filter! %v", err)
 		return
 	}
 
@@ -175,29 +282,41 @@ func (cw *ContainerSyncWorker) processOnce() {
 		Filters: args,
 	})
 	if err != nil {
-		fmt.Printf("Unable to list containers, error: %v\n", err)
-		if cw.sleepShouldQuit(time.Duration(2 * time.Second)) {
-			return
-		}
+		metrics.DockerErrors.Inc("container_list")
+		// Docker may be restarting, the event stream reconnect or the
+		// pending recheck will try again.
+		log.Warnf("Unable to list containers, error: %v", err)
+		cw.RecheckPending = true
+		return
 	}
 
 	// Initially grab the available images list.
 	images, err := cw.DockerClient.ImageList(context.Background(), dct.ImageListOptions{All: true})
 	if err != nil {
-		fmt.Printf("Error fetching images list %v\n", err)
+		metrics.DockerErrors.Inc("image_list")
+		log.Errorf("Error fetching images list %v", err)
+		cw.RecheckPending = true
 		return
 	}
 
 	availableTagMap := utils.BuildImageMap(images)
 
 	// Sync containers to running containers list.
+	// Keyed by slot, see slotKey.
 	devicedIdToContainer := make(map[string]state.RunningContainer)
-	containersToDelete := make(map[string][]config.LifecycleHook)
-	containersToStart := make(map[string]bool)
-	containersToCreate := []dct.ContainerCreateConfig{}
+	// Highest generation seen for each slot
+	slotGenerations := make(map[string]int)
+	containersToDelete := make(map[string]*containerRemoval)
+	containersToStart := make(map[string]*containerStart)
+	containersToCreate := []*containerCreation{}
+	jobContainers := make(map[string][]dct.Container)
 	for _, ctr := range containers {
-		fmt.Printf("Container name: %s tag: %s\n", ctr.Names[0], ctr.Image)
-		_, imageTag := utils.ParseImageAndTag(ctr.Image)
+		if !inScope(only, ctr.Labels[deviced_id_label]) {
+			continue
+		}
+		image, imageTag := utils.ParseImageAndTag(ctr.Image)
+		clog := containerLog(ctr.Labels[deviced_id_label], ctr.ID, image, imageTag)
+		clog.Infof("Found container %s.", ctr.Names[0])
 
 		// try to match the container to a target container
 		// match by tag
@@ -210,19 +329,39 @@ func (cw *ContainerSyncWorker) processOnce() {
 		}
 
 		if matchingTarget == nil {
-			fmt.Printf("Cannot find match for container %s (%s), scheduling delete.\n", ctr.Names[0], ctr.Image)
-			containersToDelete[ctr.ID] = []config.LifecycleHook{}
+			clog.Warnf("Cannot find a target for container %s, scheduling delete.", ctr.Names[0])
+			containersToDelete[ctr.ID] = &containerRemoval{}
+			continue
+		}
+
+		// Jobs are expected to exit, handled separately.
+		if matchingTarget.RunsToCompletion() {
+			jobContainers[matchingTarget.Id] = append(jobContainers[matchingTarget.Id], ctr)
 			continue
 		}
 
 		if ctr.State != "running" && !matchingTarget.RestartExited {
-			fmt.Printf("Container %s (%s) not running and RestartExited not set, killing.\n", ctr.Names[0], ctr.Image)
-			containersToDelete[ctr.ID] = []config.LifecycleHook{}
+			clog.Infof("Container %s not running and RestartExited not set, killing.", ctr.Names[0])
+			metrics.ContainerRestarts.Inc(matchingTarget.Id)
+			containersToDelete[ctr.ID] = &containerRemoval{
+				Target: matchingTarget,
+				Image:  image,
+				Tag:    imageTag,
+			}
 			continue
 		}
 
 		runningContainer := buildRunningContainer(ctr, matchingTarget, matchingTarget.ContainerVersionScore(imageTag))
-		if val, ok := devicedIdToContainer[matchingTarget.Id]; ok {
+		slot := slotKey(matchingTarget.Id, runningContainer.Replica)
+		if gen, ok := slotGenerations[slot]; !ok || runningContainer.Generation > gen {
+			slotGenerations[slot] = runningContainer.Generation
+		}
+		if runningContainer.Replica >= matchingTarget.EffectiveReplicas() {
+			clog.Infof("Container %s is replica %d of a target with %d replicas, scheduling delete.", ctr.Names[0], runningContainer.Replica, matchingTarget.EffectiveReplicas())
+			containersToDelete[ctr.ID] = newContainerRemoval(matchingTarget, runningContainer)
+			continue
+		}
+		if val, ok := devicedIdToContainer[slot]; ok {
 			// We have an existing container that satisfies this target
 			// Pick one. Compare versions.
 			// Lower is better.
@@ -230,187 +369,608 @@ func (cw *ContainerSyncWorker) processOnce() {
 			otherScore := matchingTarget.ContainerVersionScore(oimageTag)
 			thisScore := matchingTarget.ContainerVersionScore(imageTag)
 			if thisScore < otherScore {
-				fmt.Printf("Choosing container %s (%s) over container %s (%s).\n", ctr.ID, imageTag, val.ApiContainer.ID, oimageTag)
-				devicedIdToContainer[matchingTarget.Id] = *runningContainer
-				containersToDelete[val.ApiContainer.ID] = matchingTarget.LifecycleHooks.OnStop
-				containersToStart[ctr.ID] = true
+				clog.WithFields(logrus.Fields{"duplicate": val.ApiContainer.ID, "duplicateTag": oimageTag}).Info("Choosing container over a duplicate.")
+				devicedIdToContainer[slot] = *runningContainer
+				containersToDelete[val.ApiContainer.ID] = newContainerRemoval(matchingTarget, &val)
+				containersToStart[ctr.ID] = newContainerStart(matchingTarget, runningContainer)
 			} else {
-				fmt.Printf("Choosing container %s (%s) over container %s (%s).\n", val.ApiContainer.ID, oimageTag, ctr.ID, imageTag)
-				containersToDelete[ctr.ID] = matchingTarget.LifecycleHooks.OnStop
-				containersToStart[val.ApiContainer.ID] = true
+				containerLog(matchingTarget.Id, val.ApiContainer.ID, image, oimageTag).WithFields(logrus.Fields{"duplicate": ctr.ID, "duplicateTag": imageTag}).Info("Choosing container over a duplicate.")
+				containersToDelete[ctr.ID] = newContainerRemoval(matchingTarget, runningContainer)
+				containersToStart[val.ApiContainer.ID] = newContainerStart(matchingTarget, &val)
 			}
 		} else {
-			devicedIdToContainer[matchingTarget.Id] = *runningContainer
+			devicedIdToContainer[slot] = *runningContainer
+		}
+	}
+
+	targetStatuses := make(map[string]*state.TargetStatus)
+	for _, tctr := range cw.Config.Containers {
+		if !inScope(only, tctr.Id) {
+			continue
+		}
+		tstatus := &state.TargetStatus{
+			DevicedID: tctr.Id,
+			Kind:      config.TargetKindService,
+			Source:    tctr.Source,
+			Volumes:   cw.Config.TargetVolumes(tctr),
+		}
+		if tctr.IsScheduled() {
+			tstatus.Kind = config.TargetKindScheduled
+		} else if tctr.IsJob() {
+			tstatus.Kind = config.TargetKindJob
+		}
+		for replica := 0; replica < tctr.EffectiveReplicas(); replica++ {
+			currentCtr, ok := devicedIdToContainer[slotKey(tctr.Id, replica)]
+			if ok && replica == 0 {
+				tstatus.ContainerID = currentCtr.ApiContainer.ID
+				tstatus.State = currentCtr.ApiContainer.State
+				tstatus.Image = currentCtr.Image
+				tstatus.ImageTag = currentCtr.ImageTag
+				metrics.VersionScore.Set(float64(currentCtr.Score), tctr.Id)
+			} else if replica == 0 {
+				metrics.VersionScore.Delete(tctr.Id)
+			}
+			if tctr.EffectiveReplicas() > 1 {
+				rstatus := tstatus.Replica(replica)
+				if ok {
+					rstatus.ContainerID = currentCtr.ApiContainer.ID
+					rstatus.Name = strings.TrimPrefix(currentCtr.ApiContainer.Names[0], "/")
+					rstatus.ImageTag = currentCtr.ImageTag
+					rstatus.Generation = currentCtr.Generation
+				}
+			}
+		}
+		targetStatuses[tctr.Id] = tstatus
+	}
+	// A targeted pass keeps the pending state of the other targets.
+	if only == nil {
+		// Networks that failed to be recreated are retried once their backoff passed.
+		cw.RecheckPending = len(cw.failedNetworks) != 0
+		cw.NextScheduledRun = time.Time{}
+		if cw.Status != nil {
+			defer cw.Status.SetTargets(targetStatuses)
+		}
+	} else if cw.Status != nil {
+		defer cw.Status.UpdateTargets(targetStatuses)
+	}
+
+	// Bring network attachments of existing containers in line with the config.
+	for _, tctr := range cw.Config.Containers {
+		if tctr.RunsToCompletion() || !inScope(only, tctr.Id) {
+			continue
+		}
+		for replica := 0; replica < tctr.EffectiveReplicas(); replica++ {
+			if currentCtr, ok := devicedIdToContainer[slotKey(tctr.Id, replica)]; ok {
+				cw.reconcileNetworks(tctr, currentCtr.ApiContainer, netMap)
+			}
 		}
 	}
 
 	// Decide if there's a better image for each target
 	for _, tctr := range cw.Config.Containers {
-		currentCtr, ok := devicedIdToContainer[tctr.Id]
-		okn := false
-		if ok && currentCtr.Score == 0 {
+		if !inScope(only, tctr.Id) {
 			continue
 		}
-		images := availableTagMap[tctr.Image]
-		if len(images) == 0 {
-			fmt.Printf("Container %s has no available tags yet.\n", tctr.Image)
+		if tctr.IsScheduled() {
+			if creation := cw.processScheduled(tctr, jobContainers[tctr.Id], availableTagMap[tctr.Image], targetStatuses[tctr.Id]); creation != nil {
+				containersToCreate = append(containersToCreate, creation)
+			}
+			continue
+		}
+		if tctr.IsJob() {
+			if creation := cw.processJob(tctr, jobContainers[tctr.Id], availableTagMap[tctr.Image], targetStatuses[tctr.Id]); creation != nil {
+				containersToCreate = append(containersToCreate, creation)
+			}
 			continue
 		}
-		selectedCtr := currentCtr
-		fmt.Printf("Container %s available tags:\n", tctr.Image)
-		for _, avail := range images {
-			score := tctr.ContainerVersionScore(avail)
-			fmt.Printf(" => %s score %d\n", avail, score)
-			// will be int.max if invalid
-			if !tctr.UseAnyVersion && score > 1000 {
+
+		for replica := 0; replica < tctr.EffectiveReplicas(); replica++ {
+			slot := slotKey(tctr.Id, replica)
+			currentCtr, ok := devicedIdToContainer[slot]
+			okn := false
+			if ok && currentCtr.Score == 0 {
 				continue
 			}
-			if ok && avail == currentCtr.ImageTag {
+			ilog := targetLog(tctr.Id).WithField("image", tctr.Image)
+			images := availableTagMap[tctr.Image]
+			if len(images) == 0 {
+				ilog.Info("No tags available yet.")
+				if !ok {
+					targetStatuses[tctr.Id].WaitingForImage = true
+				}
 				continue
 			}
-			if ok && currentCtr.Score < score {
+			selectedCtr := currentCtr
+			for _, avail := range images {
+				score := tctr.ContainerVersionScore(avail)
+				ilog.WithField("tag", avail).Infof("Available tag, score %d.", score)
+				// will be int.max if invalid
+				if !tctr.UseAnyVersion && score > 1000 {
+					continue
+				}
+				// staged for later, wait until it is promoted
+				if tctr.IsPrefetchOnly(avail) {
+					continue
+				}
+				if ok && avail == currentCtr.ImageTag {
+					continue
+				}
+				if ok && currentCtr.Score < score {
+					continue
+				}
+				selectedCtr = state.RunningContainer{
+					DevicedID:    tctr.Id,
+					Image:        tctr.Image,
+					ImageTag:     avail,
+					Score:        score,
+					ApiContainer: nil,
+				}
+				okn = true
+			}
+			if !ok && !okn {
+				ilog.Info("No suitable tag, skipping.")
+				targetStatuses[tctr.Id].WaitingForImage = true
 				continue
 			}
-			selectedCtr = state.RunningContainer{
-				DevicedID:    tctr.Id,
-				Image:        tctr.Image,
-				ImageTag:     avail,
-				Score:        score,
-				ApiContainer: nil,
+			if ok && currentCtr == selectedCtr {
+				ilog.Info("No better tag than the current, skipping.")
+				continue
+			}
+			slog := ilog.WithField("tag", selectedCtr.ImageTag)
+			if reason := cw.tagBackoff(slot, selectedCtr.ImageTag); reason != "" {
+				slog.Infof("Not starting, %s.", reason)
+				if ok {
+					targetStatuses[tctr.Id].PendingTag = selectedCtr.ImageTag
+					targetStatuses[tctr.Id].PendingReason = reason
+				} else {
+					targetStatuses[tctr.Id].Blocked = reason
+				}
+				cw.RecheckPending = true
+				continue
+			}
+			// Keep the current container until the new one can be created.
+			reason := cw.volumesBlocked(volMap, tctr)
+			if missing := missingNetworks(netMap, (&tctr.DockerHostConfig).ToAPI(), (&tctr.DockerNetworkingConfig).ToAPI()); len(missing) != 0 {
+				reason = "waiting for networks " + strings.Join(missing, ", ")
+			}
+			if reason != "" {
+				slog.Infof("Not starting, %s.", reason)
+				targetStatuses[tctr.Id].Blocked = reason
+				if ok {
+					targetStatuses[tctr.Id].PendingTag = selectedCtr.ImageTag
+					targetStatuses[tctr.Id].PendingReason = reason
+				}
+				if volMap == nil {
+					cw.RecheckPending = true
+				}
+				continue
+			}
+			var upgrade *containerUpgrade
+			if ok && selectedCtr != currentCtr {
+				if allowed, reason := cw.replacementAllowed(tctr, &currentCtr); !allowed {
+					slog.WithField("oldTag", currentCtr.ImageTag).Infof("Deferring replacement, %s.", reason)
+					targetStatuses[tctr.Id].PendingTag = selectedCtr.ImageTag
+					targetStatuses[tctr.Id].PendingReason = reason
+					if tctr.EffectiveReplicas() > 1 {
+						targetStatuses[tctr.Id].Replica(replica).PendingTag = selectedCtr.ImageTag
+					}
+					cw.RecheckPending = true
+					continue
+				}
+				slog.WithFields(logrus.Fields{"container": currentCtr.ApiContainer.ID, "oldTag": currentCtr.ImageTag}).Info("Replacing container with a new version.")
+				upgrade = &containerUpgrade{OldTag: currentCtr.ImageTag, NewTag: selectedCtr.ImageTag}
+				metrics.ContainerReplacements.Inc(tctr.Id)
+				// Volumes are shared between replicas, only the first one snapshots.
+				if tctr.Snapshot != nil && replica == 0 {
+					upgrade.Restore = cw.findRollbackSnapshot(tctr, currentCtr.ImageTag, selectedCtr.ImageTag)
+				}
+				removal := newContainerRemoval(tctr, &currentCtr)
+				removal.Upgrade = upgrade
+				containersToDelete[currentCtr.ApiContainer.ID] = removal
+			}
+			// The new container always gets a new generation so its
+			// name cannot collide with a container still being replaced.
+			generation := 0
+			if gen, ok := slotGenerations[slot]; ok {
+				generation = gen + 1
+			}
+			selectedCtr.Replica = replica
+			selectedCtr.Generation = generation
+			slog.WithField("replica", replica).Info("Starting container...")
+			creation := cw.buildContainerCreation(tctr, selectedCtr.Image, selectedCtr.ImageTag, replica, generation)
+			creation.Upgrade = upgrade
+			if upgrade != nil {
+				creation.Replaces = currentCtr.ApiContainer.ID
+			}
+			containersToCreate = append(containersToCreate, creation)
+			devicedIdToContainer[slot] = selectedCtr
+			if replica == 0 {
+				targetStatuses[tctr.Id].Image = selectedCtr.Image
+				targetStatuses[tctr.Id].ImageTag = selectedCtr.ImageTag
+				targetStatuses[tctr.Id].ContainerID = ""
+				targetStatuses[tctr.Id].State = ""
+			}
+			if tctr.EffectiveReplicas() > 1 {
+				rstatus := targetStatuses[tctr.Id].Replica(replica)
+				rstatus.ContainerID = ""
+				rstatus.Name = creation.Options.Name
+				rstatus.ImageTag = selectedCtr.ImageTag
+				rstatus.Generation = generation
 			}
-			okn = true
 		}
-		if !ok && !okn {
-			fmt.Printf("Container %s has no suitable image, skipping.\n", tctr.Image)
-			continue
+	}
+
+	// Replicas whose replacement was aborted keep their old container.
+	// Keyed by slot.
+	abortedSlots := make(map[string]bool)
+	// showKept reports a replica at its old tag, with the new tag pending.
+	showKept := func(tctr *config.TargetContainer, replica int, cid string, upgrade *containerUpgrade, reason string) {
+		tstatus := targetStatuses[tctr.Id]
+		if replica == 0 {
+			tstatus.ContainerID = cid
+			tstatus.ImageTag = upgrade.OldTag
 		}
-		if ok && currentCtr == selectedCtr {
-			fmt.Printf("Container %s has no better image than the current, skipping.\n", tctr.Image)
-			continue
+		tstatus.PendingTag = upgrade.NewTag
+		tstatus.PendingReason = reason
+		if tctr.EffectiveReplicas() > 1 {
+			rstatus := tstatus.Replica(replica)
+			rstatus.ContainerID = cid
+			rstatus.ImageTag = upgrade.OldTag
+			rstatus.PendingTag = upgrade.NewTag
+		}
+		cw.RecheckPending = true
+	}
+	keepContainer := func(cid string, removal *containerRemoval, reason string) {
+		removal.log(cid).Infof("Keeping container, %s.", reason)
+		if removal.Upgrade == nil {
+			return
+		}
+		abortedSlots[slotKey(removal.Target.Id, removal.Replica)] = true
+		showKept(removal.Target, removal.Replica, cid, removal.Upgrade, reason)
+	}
+	// failCreation removes a new container that did not come up and brings
+	// back the container it replaces. Its tag is not tried again for a while.
+	failCreation := func(creation *containerCreation, cid string, reason string) {
+		clog := creation.log()
+		if cid != "" {
+			clog = clog.WithField("container", cid)
+		}
+		clog.Warnf("Container did not come up, %s.", reason)
+		if cid != "" {
+			cw.removeContainer(creation.Target.Id, cid, reason)
 		}
-		if ok && selectedCtr != currentCtr {
-			fmt.Printf("Replacing container %s:%s with new container at %s:%s\n", currentCtr.Image, currentCtr.ImageTag, selectedCtr.Image, selectedCtr.ImageTag)
-			containersToDelete[currentCtr.ApiContainer.ID] = tctr.LifecycleHooks.OnStop
+		ft := cw.tagFailed(creation, reason)
+		tstatus, ok := targetStatuses[creation.Target.Id]
+		if !ok {
+			return
+		}
+		if creation.Upgrade == nil {
+			tstatus.Blocked = reason
+			return
+		}
+		if taken := creation.Upgrade.Taken; creation.restores() && taken != nil {
+			// The volumes hold the restored data, put back what the old container left.
+			oldImage := strings.Join([]string{creation.Image, creation.Upgrade.OldTag}, ":")
+			if err := cw.restoreSnapshot(creation.Target, taken, oldImage); err != nil {
+				creation.log().WithField("oldTag", creation.Upgrade.OldTag).Errorf("Unable to restore snapshot %s, not bringing back the old version, %v", taken.dir, err)
+				tstatus.Blocked = fmt.Sprintf("%s, restoring the volumes of %s failed, %v", reason, creation.Upgrade.OldTag, err)
+				return
+			}
+		}
+		previous, err := cw.restorePrevious(creation)
+		if err != nil {
+			creation.log().WithField("oldTag", creation.Upgrade.OldTag).Errorf("Unable to bring back the old version, %v", err)
+			tstatus.Blocked = fmt.Sprintf("%s, bringing back %s failed, %v", reason, creation.Upgrade.OldTag, err)
+			return
+		}
+		showKept(creation.Target, creation.Replica, previous, creation.Upgrade, fmt.Sprintf("%s, retrying after %s", reason, ft.RetryAfter.Format(time.RFC3339)))
+		if creation.Replica == 0 {
+			tstatus.State = "running"
 		}
-		fmt.Printf("Starting container (%s) %s:%s...\n", tctr.Id, selectedCtr.Image, selectedCtr.ImageTag)
-		opts := dct.ContainerCreateConfig{
-			Name:             strings.Join([]string{"devd", tctr.Id, strconv.Itoa(rand.Int() % 100)}, "_"),
-			Config:           (&tctr.DockerConfig).ToAPI(),
-			HostConfig:       (&tctr.DockerHostConfig).ToAPI(),
-			NetworkingConfig: (&tctr.DockerNetworkingConfig).ToAPI(),
+	}
+
+	// Prepare the new containers while the ones they replace still run.
+	// A replacement that cannot be prepared keeps the old container.
+	prepared := containersToCreate[:0]
+	for _, creation := range containersToCreate {
+		reason := ""
+		if err := cw.writeSecrets(creation.Target); err != nil {
+			cw.Audit.Record(creation.auditEntry("", err))
+			reason = err.Error()
+		} else if creation.restores() {
+			// Restored once the old container is gone, the init containers
+			// run after that. Check the snapshot before the old one goes.
+			if err := verifySnapshot(creation.Upgrade.Restore); err != nil {
+				reason = err.Error()
+			}
+		} else if len(creation.Target.InitContainers) != 0 {
+			initOk, current := cw.runInitContainersUnlocked(creation)
+			if !current {
+				log.Info("Config changed while init containers ran, re-checking with the new config.")
+				return
+			}
+			if !initOk {
+				reason = "init containers did not succeed"
+			}
 		}
-		if opts.Config.Labels == nil {
-			opts.Config.Labels = make(map[string]string)
+		if reason != "" {
+			creation.log().Warnf("Not creating container, %s.", reason)
+			if removal, ok := containersToDelete[creation.Replaces]; ok {
+				delete(containersToDelete, creation.Replaces)
+				keepContainer(creation.Replaces, removal, reason)
+			} else if tstatus, ok := targetStatuses[creation.Target.Id]; ok {
+				tstatus.Blocked = reason
+			}
+			continue
 		}
-		opts.Config.Labels["deviced.id"] = tctr.Id
-		opts.Config.Image = strings.Join([]string{selectedCtr.Image, selectedCtr.ImageTag}, ":")
-		containersToCreate = append(containersToCreate, opts)
-		devicedIdToContainer[tctr.Id] = selectedCtr
+		prepared = append(prepared, creation)
 	}
+	containersToCreate = prepared
 
 	// We have picked the containers to keep. Delete the others.
-	for cid, hooks := range containersToDelete {
+	for cid, removal := range containersToDelete {
 		if cw.Reflection != nil && cw.Reflection.Container.ID == cid {
+			entry := &audit.Entry{Type: audit.TypeSelfUpdate, Container: cid, Outcome: audit.OutcomeOK}
+			if removal.Target != nil {
+				entry.Target = removal.Target.Id
+			}
 			if !cw.Config.ContainerConfig.AllowSelfDelete {
-				fmt.Printf("Preventing deletion of ourselves...\n")
+				log.Info("Preventing deletion of ourselves...")
+				entry.Outcome = audit.OutcomeSkipped
+				entry.Message = "self deletion not allowed by allowSelfDelete"
+				cw.Audit.Record(entry)
 				continue
 			}
-			fmt.Printf("Allowing self deletion...\n")
+			log.Info("Allowing self deletion...")
+			cw.Audit.Record(entry)
 		}
 
-		// Run stop hooks
-		fmt.Printf("Stopping container %s (running stop hooks)...\n", cid)
-		for hidx, hook := range hooks {
-			fmt.Printf("Running stop hook %d...\n", hidx)
-			if hook.Exec != nil {
-				fmt.Printf("Running stop hook %d exec...\n", hidx)
-				execCtx, execCtxCancel := context.WithCancel(context.Background())
-				exec, err := cw.DockerClient.ContainerExecCreate(execCtx, cid, dct.ExecConfig{
-					Cmd: hook.Exec.Command,
-					Tty: true,
-				})
-				if err != nil {
-					fmt.Printf("Error creating exec for %s onexit hook: %v\n", cid, err)
-					execCtxCancel()
-					continue
-				}
-				conn, err := cw.DockerClient.ContainerExecAttach(execCtx, exec.ID, dct.ExecConfig{
-					Tty: true,
-				})
-				if err != nil {
-					fmt.Printf("Error starting exec for %s onexit hook: %v\n", cid, err)
-					execCtxCancel()
-					continue
-				}
-				closeChannel := make(chan bool)
-				go func() {
-					defer func() {
-						conn.Close()
-						close(closeChannel)
-					}()
-					_, err := ioutil.ReadAll(conn.Reader)
-					if err != nil {
-						fmt.Printf("Error waiting for finish exec for %s onexit hook: %v\n", cid, err)
-					}
-				}()
-
-				waitDur, err := time.ParseDuration(hook.Exec.Timeout)
-				if err != nil || hook.Exec.Timeout == "" {
-					fmt.Printf("Using default wait time of 30 seconds for hook...\n")
-					waitDur = time.Duration(30) * time.Second
-				}
-				select {
-				case _, _ = <-closeChannel:
-				case <-time.After(waitDur):
-					fmt.Printf("Exec stop hook timed out, continuing.")
-				}
-				execCtxCancel()
+		if removal.Target != nil {
+			hooks := &removal.Target.LifecycleHooks
+			proceed, reason := true, ""
+			if removal.Upgrade != nil {
+				proceed, reason = cw.runHooks(removal.hookContext(cid, hookPhaseOnUpgrade), hooks.OnUpgrade)
+			}
+			if proceed && removal.RunStopHooks {
+				// Run stop hooks
+				removal.log(cid).Info("Stopping container (running stop hooks)...")
+				proceed, reason = cw.runHooks(removal.hookContext(cid, hookPhaseOnStop), hooks.OnStop)
+			}
+			if !proceed {
+				keepContainer(cid, removal, reason)
+				continue
 			}
 		}
 
-		fmt.Printf("Stopping container %s...\n", cid)
+		removal.log(cid).Info("Stopping container...")
 		secThirty := time.Duration(30) * time.Second
 		if err := cw.DockerClient.ContainerStop(context.Background(), cid, &secThirty); err != nil {
-			fmt.Printf("Error stopping container %s, %v\n", cid, err)
+			metrics.DockerErrors.Inc("container_stop")
+			removal.log(cid).Errorf("Error stopping container, %v", err)
+		}
+		if removal.Target != nil && removal.Target.Snapshot != nil && removal.Upgrade != nil && removal.Replica == 0 {
+			if err := cw.snapshotVolumes(removal.Target, removal.Image, removal.Tag, removal.Upgrade); err != nil {
+				if cw.Status != nil {
+					cw.Status.AddEvent(removal.Target.Id, "snapshot", err.Error())
+				}
+				if err := cw.DockerClient.ContainerStart(context.Background(), cid, dct.ContainerStartOptions{}); err != nil {
+					removal.log(cid).Errorf("Error restarting container, %v", err)
+				}
+				keepContainer(cid, removal, err.Error())
+				continue
+			}
 		}
 		opts := dct.ContainerRemoveOptions{Force: true}
-		if err := cw.DockerClient.ContainerRemove(context.Background(), cid, opts); err != nil {
-			fmt.Printf("Error attempting to remove container, %v\n", err)
+		err := cw.DockerClient.ContainerRemove(context.Background(), cid, opts)
+		cw.Audit.Record(removal.auditEntry(cid, err))
+		if err != nil {
+			metrics.DockerErrors.Inc("container_remove")
+			removal.log(cid).Errorf("Error attempting to remove container, %v", err)
+			continue
+		}
+
+		if removal.Target != nil {
+			removal.Running = false
+			cw.runHooks(removal.hookContext(cid, hookPhaseOnRemove), removal.Target.LifecycleHooks.OnRemove)
 		}
 	}
 
-	for _, ctr := range containersToCreate {
-		if ctr.HostConfig.NetworkMode != "" {
-			if _, ok := netMap[ctr.HostConfig.NetworkMode.NetworkName()]; !ok {
-				fmt.Printf("Cannot find network %s in available networks. Skipping creation of %s.\n", ctr.HostConfig.NetworkMode, ctr.Name)
+	for _, creation := range containersToCreate {
+		ctr := &creation.Options
+		if abortedSlots[slotKey(creation.Target.Id, creation.Replica)] {
+			creation.log().Info("Skipping creation, replacement was aborted.")
+			continue
+		}
+		if missing := missingNetworks(netMap, ctr.HostConfig, creation.networkingConfig()); len(missing) != 0 {
+			reason := "waiting for networks " + strings.Join(missing, ", ")
+			creation.log().Infof("Not creating container, %s.", reason)
+			if tstatus, ok := targetStatuses[creation.Target.Id]; ok {
+				tstatus.Blocked = reason
+			}
+			continue
+		}
+		if reason := cw.volumesBlocked(volMap, creation.Target); reason != "" {
+			creation.log().Warnf("Not creating container, %s.", reason)
+			if tstatus, ok := targetStatuses[creation.Target.Id]; ok {
+				tstatus.Blocked = reason
+			}
+			continue
+		}
+		if creation.restores() {
+			restore := creation.Upgrade.Restore
+			if err := cw.restoreSnapshot(creation.Target, restore, strings.Join([]string{creation.Image, creation.Tag}, ":")); err != nil {
+				creation.log().Warnf("Unable to restore snapshot %s, %v", restore.dir, err)
+				if cw.Status != nil {
+					cw.Status.AddEvent(creation.Target.Id, "snapshot", err.Error())
+				}
+				failCreation(creation, "", "snapshot restore failed, "+err.Error())
+				continue
+			}
+			if cw.Status != nil {
+				cw.Status.AddEvent(creation.Target.Id, "snapshot", fmt.Sprintf("restored volumes from %s snapshot taken %s", restore.Tag, restore.Created.Format(time.RFC3339)))
+			}
+			// The init containers of a rollback run on the restored volumes.
+			initOk, current := cw.runInitContainersUnlocked(creation)
+			if !current {
+				log.Info("Config changed while init containers ran, re-checking with the new config.")
+				return
+			}
+			if !initOk {
+				failCreation(creation, "", "init containers did not succeed")
 				continue
 			}
 		}
 		created, err := cw.DockerClient.ContainerCreate(context.Background(), ctr.Config, ctr.HostConfig, ctr.NetworkingConfig, ctr.Name)
+		if isNameConflict(err) {
+			// Something outside deviced holds the name, fall back to a unique one.
+			name := uniqueContainerName(ctr.Name)
+			creation.log().Infof("Container name is taken, using %s.", name)
+			ctr.Name = name
+			created, err = cw.DockerClient.ContainerCreate(context.Background(), ctr.Config, ctr.HostConfig, ctr.NetworkingConfig, ctr.Name)
+		}
+		cw.Audit.Record(creation.auditEntry(created.ID, err))
+		cw.recordScheduledRun(creation, err)
 		if err != nil {
-			fmt.Printf("Container creation error: %v\n", err)
+			metrics.DockerErrors.Inc("container_create")
+			failCreation(creation, "", "create failed, "+err.Error())
 			continue
 		}
-		containersToStart[created.ID] = true
+		if err := cw.connectNetworks(created.ID, creation.ExtraEndpoints); err != nil {
+			failCreation(creation, created.ID, "network error, "+err.Error())
+			continue
+		}
+		if tstatus, ok := targetStatuses[creation.Target.Id]; ok {
+			if creation.Replica == 0 {
+				tstatus.ContainerID = created.ID
+			}
+			if creation.Target.EffectiveReplicas() > 1 {
+				tstatus.Replica(creation.Replica).ContainerID = created.ID
+				tstatus.Replica(creation.Replica).Name = ctr.Name
+			}
+		}
+
+		start := &containerStart{
+			Target:   creation.Target,
+			Image:    creation.Image,
+			Tag:      creation.Tag,
+			Replica:  creation.Replica,
+			Upgrade:  creation.Upgrade,
+			Created:  true,
+			Creation: creation,
+		}
+		if ok, reason := cw.runHooks(start.hookContext(created.ID, hookPhasePreStart), creation.Target.LifecycleHooks.PreStart); !ok {
+			failCreation(creation, created.ID, reason)
+			continue
+		}
+		containersToStart[created.ID] = start
 	}
 
-	for ctr := range containersToStart {
-		err = cw.DockerClient.ContainerStart(context.Background(), ctr, dct.ContainerStartOptions{})
+	for cid, start := range containersToStart {
+		if start.Running {
+			continue
+		}
+		err = cw.DockerClient.ContainerStart(context.Background(), cid, dct.ContainerStartOptions{})
 		if err != nil {
 			if !strings.Contains(err.Error(), "already running") {
-				fmt.Printf("Container start error: %v\n", err)
+				metrics.DockerErrors.Inc("container_start")
+				start.log(cid).Errorf("Container start error: %v", err)
+				if start.Creation != nil {
+					failCreation(start.Creation, cid, "start failed, "+err.Error())
+				}
 			}
+			continue
+		}
+		if !start.Created {
+			metrics.ContainerRestarts.Inc(start.Target.Id)
+		}
+		start.Running = true
+		if tstatus, ok := targetStatuses[start.Target.Id]; ok && start.Replica == 0 {
+			tstatus.State = "running"
+		}
+		ok, reason := cw.runHooks(start.hookContext(cid, hookPhasePostStart), start.Target.LifecycleHooks.PostStart)
+		if !ok && start.Creation != nil {
+			failCreation(start.Creation, cid, reason)
+		} else if !ok {
+			cw.removeContainer(start.Target.Id, cid, reason)
+		} else if start.Created {
+			cw.tagSucceeded(slotKey(start.Target.Id, start.Replica), start.Tag)
 		}
 	}
 	containersToStart = nil
+
+	if cw.Config.ContainerConfig.PruneVolumes && volMap != nil {
+		cw.pruneVolumes(volMap)
+	}
+	if only == nil {
+		cw.pruneSecrets()
+	}
+}
+
+// buildContainerCreation builds the create options for a replica of a target at image:tag.
+func (cw *ContainerSyncWorker) buildContainerCreation(tctr *config.TargetContainer, image string, tag string, replica int, generation int) *containerCreation {
+	opts := dct.ContainerCreateConfig{
+		Name:             containerName(tctr, replica, generation),
+		Config:           (&tctr.DockerConfig).ToAPI(),
+		HostConfig:       (&tctr.DockerHostConfig).ToAPI(),
+		NetworkingConfig: (&tctr.DockerNetworkingConfig).ToAPI(),
+	}
+	if opts.Config.Labels == nil {
+		opts.Config.Labels = make(map[string]string)
+	}
+	opts.Config.Labels[deviced_id_label] = tctr.Id
+	opts.Config.Labels[deviced_replica_label] = strconv.Itoa(replica)
+	opts.Config.Labels[deviced_generation_label] = strconv.Itoa(generation)
+	opts.Config.Image = strings.Join([]string{image, tag}, ":")
+	cw.addSecretsMount(tctr, opts.HostConfig)
+	extra := splitEndpoints(&opts)
+	return &containerCreation{
+		Target:         tctr,
+		Options:        opts,
+		ExtraEndpoints: extra,
+		Image:          image,
+		Tag:            tag,
+		Replica:        replica,
+		Generation:     generation,
+	}
+}
+
+// removeContainer stops and removes a container without running hooks.
+func (cw *ContainerSyncWorker) removeContainer(target string, cid string, reason string) {
+	clog := containerLog(target, cid, "", "")
+	clog.Info("Removing container...")
+	secThirty := time.Duration(30) * time.Second
+	if err := cw.DockerClient.ContainerStop(context.Background(), cid, &secThirty); err != nil {
+		metrics.DockerErrors.Inc("container_stop")
+		clog.Errorf("Error stopping container, %v", err)
+	}
+	opts := dct.ContainerRemoveOptions{Force: true}
+	err := cw.DockerClient.ContainerRemove(context.Background(), cid, opts)
+	cw.Audit.Record(&audit.Entry{
+		Type:      audit.TypeRemove,
+		Outcome:   audit.Outcome(err),
+		Target:    target,
+		Container: cid,
+		Message:   reason,
+	})
+	if err != nil {
+		metrics.DockerErrors.Inc("container_remove")
+		clog.Errorf("Error attempting to remove container, %v", err)
+	}
 }
 
 func (cw *ContainerSyncWorker) Run() {
+	// Targets to reconcile next, nil for all
+	var only map[string]bool
 	for cw.Running {
 		hasEvents := true
 		for hasEvents {
 			select {
-			case _ = <-cw.WakeChannel:
+			case _, ok := <-cw.WakeChannel:
+				if !ok {
+					log.Info("ContainerSyncWorker exiting...")
+					return
+				}
+				only = nil
 				continue
 			default:
 				hasEvents = false
@@ -418,7 +978,7 @@ func (cw *ContainerSyncWorker) Run() {
 			}
 		}
 
-		cw.processOnce()
+		cw.processTargets(only)
 
 		// Flush the events
 		hasEvents = true
@@ -432,38 +992,99 @@ func (cw *ContainerSyncWorker) Run() {
 			}
 		}
 
-		fmt.Printf("ContainerSyncWorker sleeping...\n")
+		log.Info("ContainerSyncWorker sleeping...")
+		var pendingRecheck <-chan time.Time
+		if cw.RecheckPending {
+			pendingRecheck = time.After(pendingRecheckPeriod)
+		}
+		var scheduledRun <-chan time.Time
+		if !cw.NextScheduledRun.IsZero() {
+			scheduledRun = time.After(cw.NextScheduledRun.Sub(time.Now()))
+		}
+		// Events are coalesced until the debounce window closes.
+		var debounce <-chan time.Time
+		eventTargets := make(map[string]bool)
+		fullResync := false
 		doRecheck := false
 		for !doRecheck {
 			select {
+			case <-scheduledRun:
+				log.Info("ContainerSyncWorker woken for scheduled run...")
+				fullResync = true
+				doRecheck = true
+				break
+			case <-pendingRecheck:
+				log.Info("ContainerSyncWorker re-checking deferred work...")
+				fullResync = true
+				doRecheck = true
+				break
 			case _, ok := <-cw.WakeChannel:
 				if !ok {
-					fmt.Printf("ContainerSyncWorker exiting...\n")
+					log.Info("ContainerSyncWorker exiting...")
 					return
 				}
 
-				fmt.Printf("ContainerSyncWorker woken, re-checking...\n")
+				log.Info("ContainerSyncWorker woken, re-checking...")
+				fullResync = true
+				doRecheck = true
+				break
+			case err := <-cw.ErrorsChannel:
+				// The stream ends when dockerd restarts, nothing would wake us again.
+				log.Infof("Docker event stream closed, %v", err)
+				metrics.DockerErrors.Inc("events")
+				if !cw.reconnectEvents() {
+					log.Info("ContainerSyncWorker exiting...")
+					return
+				}
+				log.Info("ContainerSyncWorker reconnected, re-checking...")
+				fullResync = true
 				doRecheck = true
 				break
-				// We want to re-check with the following events:
-				// - pull
-				// - tag
-				// - import
 			case event := <-cw.EventsChannel:
-				fmt.Printf("Docker event type triggered: %s\n", event.Type)
-				// use continue to ignore event
-				if event.Type == "image" || event.Type == "network" || event.Type == "container" {
-					fmt.Printf("Rechecking in %d seconds due to %s event.\n", 1, event.Type)
-					doRecheck = true
-					time.Sleep(1 * time.Second)
+				// Only relevant events are subscribed to, see eventSubscriptions.
+				log.Infof("Docker event triggered: %s %s", event.Type, event.Action)
+				if target := eventTarget(event); target != "" {
+					eventTargets[target] = true
+				} else {
+					fullResync = true
+				}
+				if debounce == nil {
+					debounce = time.After(eventDebounce)
 				}
 				break
+			case <-debounce:
+				doRecheck = true
+				break
 			}
 		}
+		if fullResync {
+			only = nil
+		} else {
+			log.Infof("ContainerSyncWorker re-checking %d targets due to container events.", len(eventTargets))
+			only = eventTargets
+		}
+	}
+}
+
+// Wake re-checks all targets once the current pass is done.
+// It never blocks, and does nothing after Quit.
+func (cw *ContainerSyncWorker) Wake() {
+	cw.wakeMtx.Lock()
+	defer cw.wakeMtx.Unlock()
+
+	if !cw.Running {
+		return
+	}
+	select {
+	case cw.WakeChannel <- true:
+	default:
 	}
 }
 
 func (cw *ContainerSyncWorker) Quit() {
+	cw.wakeMtx.Lock()
+	defer cw.wakeMtx.Unlock()
+
 	if !cw.Running {
 		return
 	}
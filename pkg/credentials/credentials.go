@@ -0,0 +1,110 @@
+// Package credentials resolves the registry credentials of a repo from the
+// deviced config, a Docker config.json and its credential helpers.
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/docker/engine-api/types"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/redact"
+	"github.com/fuserobotics/deviced/pkg/registry"
+	"github.com/fuserobotics/deviced/pkg/secrets"
+)
+
+var log = logging.Component("credentials")
+
+// Resolver builds the auth config of repos. A nil resolver has no secret
+// store and does not keep renewed tokens.
+type Resolver struct {
+	Secrets *secrets.Store
+	Tokens  *TokenCache
+}
+
+// Auth is the resolved auth of a repo.
+type Auth struct {
+	Config types.AuthConfig
+	// Identity token as configured, before any renewal
+	configured string
+	key        string
+	tokens     *TokenCache
+}
+
+// AuthConfig returns the auth of a repo. Credentials set on the repo win,
+// otherwise the Docker config.json at dockerConfigPath is used, if set.
+// A renewed identity token replaces the configured one.
+func (r *Resolver) AuthConfig(repo *config.RemoteRepository, dockerConfigPath string) (*Auth, error) {
+	var store *secrets.Store
+	var tokens *TokenCache
+	if r != nil {
+		store, tokens = r.Secrets, r.Tokens
+	}
+	password, err := repo.ResolvePassword(store)
+	if err != nil {
+		return nil, err
+	}
+	ac := types.AuthConfig{
+		Username:      repo.Username,
+		Password:      password,
+		IdentityToken: repo.IdentityToken,
+		RegistryToken: repo.RegistryToken,
+	}
+	if !repo.HasCredentials() && dockerConfigPath != "" {
+		ac, err = dockerAuthConfig(repo, dockerConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, val := range []string{ac.Password, ac.IdentityToken, ac.RegistryToken} {
+		redact.Add(val)
+	}
+	auth := &Auth{Config: ac, configured: ac.IdentityToken, key: repo.Url, tokens: tokens}
+	if ac.IdentityToken != "" {
+		auth.Config.IdentityToken = tokens.Get(repo.Url, ac.IdentityToken)
+	}
+	return auth, nil
+}
+
+func dockerAuthConfig(repo *config.RemoteRepository, dockerConfigPath string) (types.AuthConfig, error) {
+	u, err := url.Parse(repo.Url)
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	index, err := registry.IndexInfoForHost(u.Host)
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	dc, err := LoadDockerConfig(dockerConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return types.AuthConfig{}, nil
+		}
+		return types.AuthConfig{}, err
+	}
+	ac, err := dc.ResolveAuthConfig(index)
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("credentials of %s: %v", repo.Url, err)
+	}
+	return ac, nil
+}
+
+// TokenRefreshed keeps an identity token renewed by the token server.
+func (a *Auth) TokenRefreshed(token string) {
+	a.Config.IdentityToken = token
+	if err := a.tokens.Set(a.key, a.configured, token); err != nil {
+		log.Warnf("Unable to save the renewed identity token of %s, %v", a.key, err)
+		return
+	}
+	log.Infof("Saved the renewed identity token of %s.", a.key)
+}
+
+// Encode returns the auth as the base64 JSON expected by the Docker API.
+func (a *Auth) Encode() string {
+	dat, _ := json.Marshal(&a.Config)
+	return base64.URLEncoding.EncodeToString(dat)
+}
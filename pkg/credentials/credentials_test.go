@@ -0,0 +1,116 @@
+package credentials
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+)
+
+const testDockerConfig = `{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "aHViOmh1Yi1wYXNzd29yZA=="},
+    "https://registry.local:5000": {"auth": "cm9ib3Q6bG9jYWwtcGFzc3dvcmQ="},
+    "tokens.example.com": {"identitytoken": "id-token-1"}
+  },
+  "credHelpers": {"ecr.example.com": "ecr-login"}
+}`
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	fpath := path.Join(dir, name)
+	if err := ioutil.WriteFile(fpath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fpath
+}
+
+func TestResolveDockerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confPath := writeTestFile(t, dir, "config.json", testDockerConfig)
+
+	defer func(orig func(string, string, string) ([]byte, error)) { runHelper = orig }(runHelper)
+	runHelper = func(helper string, action string, input string) ([]byte, error) {
+		if helper != "ecr-login" || action != "get" {
+			t.Fatalf("unexpected helper call %s %s", helper, action)
+		}
+		if input != "ecr.example.com" {
+			return nil, errors.New("credentials not found in native keychain")
+		}
+		return []byte(`{"ServerURL": "ecr.example.com", "Username": "AWS", "Secret": "ecr-password"}`), nil
+	}
+
+	cases := []struct {
+		url      string
+		username string
+		password string
+		token    string
+	}{
+		{"https://registry-1.docker.io/", "hub", "hub-password", ""},
+		// Legacy keys with a scheme still match
+		{"https://registry.local:5000", "robot", "local-password", ""},
+		{"https://tokens.example.com", "", "", "id-token-1"},
+		{"https://ecr.example.com", "AWS", "ecr-password", ""},
+		{"https://unknown.example.com", "", "", ""},
+	}
+	var r *Resolver
+	for _, c := range cases {
+		auth, err := r.AuthConfig(&config.RemoteRepository{Url: c.url}, confPath)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", c.url, err)
+		}
+		ac := auth.Config
+		if ac.Username != c.username || ac.Password != c.password || ac.IdentityToken != c.token {
+			t.Fatalf("%s: unexpected auth %+v", c.url, ac)
+		}
+	}
+
+	// Credentials on the repo win over the Docker config.
+	auth, err := r.AuthConfig(&config.RemoteRepository{Url: "https://registry.local:5000", Username: "deviced", Password: "own"}, confPath)
+	if err != nil || auth.Config.Username != "deviced" || auth.Config.Password != "own" {
+		t.Fatalf("expected the repo credentials, got %+v %v", auth, err)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokensPath := path.Join(dir, "registry-tokens.json")
+
+	tokens, err := OpenTokenCache(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &config.RemoteRepository{Url: "https://registry.local", IdentityToken: "id-token-1"}
+	r := &Resolver{Tokens: tokens}
+	auth, err := r.AuthConfig(repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.TokenRefreshed("id-token-2")
+
+	// Reopened after a restart
+	tokens, err = OpenTokenCache(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &Resolver{Tokens: tokens}
+	if auth, _ = r.AuthConfig(repo, ""); auth.Config.IdentityToken != "id-token-2" {
+		t.Fatalf("expected the renewed token, got %s", auth.Config.IdentityToken)
+	}
+
+	// A newly configured token replaces the renewed one.
+	repo.IdentityToken = "id-token-3"
+	if auth, _ = r.AuthConfig(repo, ""); auth.Config.IdentityToken != "id-token-3" {
+		t.Fatalf("expected the configured token, got %s", auth.Config.IdentityToken)
+	}
+}
@@ -0,0 +1,85 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	registrytypes "github.com/docker/engine-api/types/registry"
+	"github.com/fuserobotics/deviced/pkg/registry"
+)
+
+// DockerConfig is the registry auth part of a docker CLI config.json.
+type DockerConfig struct {
+	// By registry, "https://index.docker.io/v1/" for the Docker Hub
+	AuthConfigs map[string]types.AuthConfig `json:"auths"`
+	// Helper used for every registry, docker-credential-<name>
+	CredentialsStore string `json:"credsStore,omitempty"`
+	// Helper by registry, overrides the store
+	CredentialHelpers map[string]string `json:"credHelpers,omitempty"`
+}
+
+// LoadDockerConfig reads a config.json, decoding the base64 auth of each entry.
+func LoadDockerConfig(name string) (*DockerConfig, error) {
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	dc := &DockerConfig{}
+	if err := json.Unmarshal(dat, dc); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for key, ac := range dc.AuthConfigs {
+		if err := decodeAuth(&ac); err != nil {
+			return nil, fmt.Errorf("%s: auth of %s: %v", name, key, err)
+		}
+		ac.ServerAddress = key
+		dc.AuthConfigs[key] = ac
+	}
+	return dc, nil
+}
+
+// decodeAuth fills in the username and password from the "user:password" auth.
+func decodeAuth(ac *types.AuthConfig) error {
+	if ac.Auth == "" {
+		return nil
+	}
+	dat, err := base64.StdEncoding.DecodeString(ac.Auth)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(string(dat), ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected user:password")
+	}
+	ac.Username, ac.Password = parts[0], strings.Trim(parts[1], "\x00")
+	ac.Auth = ""
+	return nil
+}
+
+// helper returns the credential helper for a config key, if any.
+func (dc *DockerConfig) helper(key string) string {
+	if helper, ok := dc.CredentialHelpers[key]; ok {
+		return helper
+	}
+	return dc.CredentialsStore
+}
+
+// ResolveAuthConfig returns the credentials for an index, asking its
+// credential helper first and falling back to the auths.
+func (dc *DockerConfig) ResolveAuthConfig(index *registrytypes.IndexInfo) (types.AuthConfig, error) {
+	key := registry.GetAuthConfigKey(index)
+	if helper := dc.helper(key); helper != "" {
+		ac, found, err := helperGet(helper, key)
+		if err != nil {
+			return types.AuthConfig{}, err
+		}
+		if found {
+			return ac, nil
+		}
+	}
+	return registry.ResolveAuthConfig(dc.AuthConfigs, index), nil
+}
@@ -0,0 +1,65 @@
+package credentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+)
+
+// helperPrefix is prepended to the helper name to get its binary.
+const helperPrefix string = "docker-credential-"
+
+// tokenUsername marks an identity token in helper credentials.
+const tokenUsername string = "<token>"
+
+// helperCredentials is the reply of "docker-credential-<name> get".
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// runHelper runs a helper action with input on stdin, replaced in tests.
+var runHelper = func(helper string, action string, input string) ([]byte, error) {
+	cmd := exec.Command(helperPrefix+helper, action)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Helpers report errors such as "credentials not found" on stdout.
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = strings.TrimSpace(stderr.String())
+		}
+		return nil, fmt.Errorf("%s%s %s: %v %s", helperPrefix, helper, action, err, msg)
+	}
+	return out, nil
+}
+
+// helperGet asks a helper for the credentials of a server. A helper without
+// credentials for it is not an error.
+func helperGet(helper string, serverURL string) (types.AuthConfig, bool, error) {
+	out, err := runHelper(helper, "get", serverURL)
+	if err != nil {
+		if strings.Contains(err.Error(), "credentials not found") {
+			return types.AuthConfig{}, false, nil
+		}
+		return types.AuthConfig{}, false, err
+	}
+	var hc helperCredentials
+	if err := json.Unmarshal(out, &hc); err != nil {
+		return types.AuthConfig{}, false, fmt.Errorf("%s%s get: %v", helperPrefix, helper, err)
+	}
+	ac := types.AuthConfig{ServerAddress: serverURL}
+	if hc.Username == tokenUsername {
+		ac.IdentityToken = hc.Secret
+	} else {
+		ac.Username, ac.Password = hc.Username, hc.Secret
+	}
+	return ac, true, nil
+}
@@ -0,0 +1,91 @@
+package credentials
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+	"github.com/fuserobotics/deviced/pkg/redact"
+)
+
+// cachedToken is an identity token renewed by a token server.
+type cachedToken struct {
+	// Digest of the configured token the renewed one replaces
+	Origin  string    `json:"origin"`
+	Token   string    `json:"token"`
+	Updated time.Time `json:"updated"`
+}
+
+// TokenCache persists renewed identity tokens by registry, so a restart
+// does not fall back to a configured token the server already replaced.
+type TokenCache struct {
+	Path string
+
+	mtx    sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+// OpenTokenCache loads the cache at path, starting empty if there is none.
+func OpenTokenCache(path string) (*TokenCache, error) {
+	c := &TokenCache{Path: path, tokens: make(map[string]*cachedToken)}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(dat, &c.tokens); err != nil {
+		return nil, err
+	}
+	for _, ct := range c.tokens {
+		redact.Add(ct.Token)
+	}
+	return c, nil
+}
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the renewed token of a configured one, or the configured
+// token if it was not renewed or was changed since.
+func (c *TokenCache) Get(key string, configured string) string {
+	if c == nil {
+		return configured
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if ct, ok := c.tokens[key]; ok && ct.Origin == tokenDigest(configured) {
+		return ct.Token
+	}
+	return configured
+}
+
+// Set stores the token renewing a configured one.
+func (c *TokenCache) Set(key string, configured string, token string) error {
+	if c == nil {
+		return nil
+	}
+	redact.Add(token)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.tokens[key] = &cachedToken{
+		Origin:  tokenDigest(configured),
+		Token:   token,
+		Updated: time.Now(),
+	}
+	dat, err := json.MarshalIndent(c.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(c.Path, dat, 0600)
+}
@@ -5,20 +5,33 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"sync"
 	"syscall"
 	"time"
 
 	dc "github.com/docker/docker/client"
+	"github.com/fuserobotics/deviced/pkg/api"
 	"github.com/fuserobotics/deviced/pkg/arch"
+	"github.com/fuserobotics/deviced/pkg/audit"
 	"github.com/fuserobotics/deviced/pkg/config"
 	"github.com/fuserobotics/deviced/pkg/containersync"
+	"github.com/fuserobotics/deviced/pkg/credentials"
 	"github.com/fuserobotics/deviced/pkg/imagesync"
+	"github.com/fuserobotics/deviced/pkg/logcollect"
+	"github.com/fuserobotics/deviced/pkg/logging"
 	"github.com/fuserobotics/deviced/pkg/reflection"
+	"github.com/fuserobotics/deviced/pkg/secrets"
+	"github.com/fuserobotics/deviced/pkg/state"
+	"github.com/fuserobotics/deviced/pkg/utils"
 )
 
+var log = logging.Component("daemon")
+
 type System struct {
 	ConfigPath string
+	// Optional dir of config fragments merged into the config
+	ConfigDir string
 
 	Config        config.DevicedConfig
 	ConfigLock    sync.Mutex
@@ -28,69 +41,188 @@ type System struct {
 
 	ContainerWorker *containersync.ContainerSyncWorker
 	ImageWorker     *imagesync.ImageSyncWorker
+	LogCollector    *logcollect.Collector
 	Reflection      *reflection.DevicedReflection
+	Status          *state.Status
+	Store           *state.Store
+	Audit           *audit.Log
+	Secrets         *secrets.Store
+	ApiServer       *api.ApiServer
+
+	// Applied config files, nil if the history is unavailable
+	History *config.History
+	// Revision of the running config
+	Applied *config.Revision
+	// Set while a new config is on trial
+	Trial *configTrial
 }
 
 func (s *System) initConfig() int {
-	if !s.Config.CreateOrRead(s.ConfigPath) {
-		fmt.Printf("Failed to create/read config at %s", s.ConfigPath)
+	if !config.ConfigFileExists(s.ConfigPath) && !s.Config.CreateOrRead(s.ConfigPath) {
+		log.Errorf("Failed to create config at %s", s.ConfigPath)
+		return 1
+	}
+	files, err := config.ReadConfigFiles(s.ConfigPath, s.ConfigDir)
+	if err != nil {
+		log.Errorf("Failed to read config at %s, %v", s.ConfigPath, err)
 		return 1
 	}
+	if err := s.Config.LoadFiles(files); err != nil {
+		log.Errorf("Failed to load config at %s", s.ConfigPath)
+		return 1
+	}
+	s.applyLogConfig()
 	return 0
 }
 
+// applyLogConfig applies the log settings from the config.
+func (s *System) applyLogConfig() {
+	if err := s.Config.LogConfig.Apply(); err != nil {
+		log.Warnf("Unable to apply log config, %v", err)
+	}
+}
+
 func (s *System) initWorkers() int {
-	fmt.Printf("Initializing workers...\n")
+	log.Info("Initializing workers...")
 	var err error
 
 	s.DockerClient, err = s.Config.DockerConfig.BuildClient()
 	if err != nil {
-		fmt.Printf("Unable to create docker client, %v\n", err)
+		log.Errorf("Unable to create docker client, %v", err)
 		return 1
 	}
 
-	_, err = s.DockerClient.Ping(context.Background())
-	if err != nil {
-		fmt.Printf("Unable to ping Docker, %v\n", err)
-		return 1
-	}
+	s.waitForDocker()
 
 	refl, err := reflection.BuildReflection(s.DockerClient)
 	if err != nil || refl == nil {
-		fmt.Printf("Unable to locate our container, continuing without reflection.\n")
-		fmt.Printf("Error locating container was: %v\n", err)
+		log.Warn("Unable to locate our container, continuing without reflection.")
+		log.Warnf("Error locating container was: %v", err)
 	} else {
-		fmt.Printf("Located our container, continuing with reflection.\n")
+		log.WithField("container", refl.Container.ID).Info("Located our container, continuing with reflection.")
 		s.Reflection = refl
 	}
 
+	s.Status = state.NewStatus()
+	storePath := path.Join(s.Config.DataDir, "state.json")
+	s.Store, err = state.OpenStore(storePath)
+	if err != nil {
+		log.Errorf("Unable to open state store at %s, %v", storePath, err)
+		return 1
+	}
+	s.Status.PersistHolds(s.Store)
+
+	if auditConf := s.Config.Audit; !auditConf.Disabled {
+		s.Audit, err = audit.Open(auditConf.Path, int64(auditConf.MaxSizeMB)*1024*1024, auditConf.MaxFiles)
+		if err != nil {
+			log.Warnf("Unable to open audit log at %s, continuing without it, %v", auditConf.Path, err)
+		}
+	}
+	s.Audit.Record(&audit.Entry{
+		Type:    audit.TypeConfig,
+		Outcome: audit.OutcomeOK,
+		Message: "loaded " + s.ConfigPath + " at startup",
+	})
+
+	if machineId, err := utils.MachineId(); err != nil {
+		log.Warnf("Unable to open the secret store, continuing without it, %v", err)
+	} else if s.Secrets, err = secrets.OpenStore(s.Config.SecretStoreDir(), machineId); err != nil {
+		log.Warnf("Unable to open the secret store at %s, continuing without it, %v", s.Config.SecretStoreDir(), err)
+	}
+
 	s.ContainerWorker = &containersync.ContainerSyncWorker{
 		ConfigLock:   &s.ConfigLock,
 		WorkerLock:   &s.WorkerLock,
 		DockerClient: s.DockerClient,
 		Config:       &s.Config,
 		Reflection:   s.Reflection,
+		Status:       s.Status,
+		Store:        s.Store,
+		Audit:        s.Audit,
+		Secrets:      s.Secrets,
 	}
 	if err = s.ContainerWorker.Init(); err != nil {
-		fmt.Printf("Error initializing ContainerWorker, %v\n", err)
+		log.Errorf("Error initializing ContainerWorker, %v", err)
 		return 1
 	}
 
 	s.ImageWorker = &imagesync.ImageSyncWorker{
-		ConfigLock:           &s.ConfigLock,
-		WorkerLock:           &s.WorkerLock,
-		DockerClient:         s.DockerClient,
-		Config:               &s.Config,
-		WakeContainerChannel: &s.ContainerWorker.WakeChannel,
+		ConfigLock:          &s.ConfigLock,
+		WorkerLock:          &s.WorkerLock,
+		DockerClient:        s.DockerClient,
+		Config:              &s.Config,
+		Audit:               s.Audit,
+		Credentials:         s.credentialResolver(),
+		WakeContainerWorker: s.ContainerWorker.Wake,
 	}
 	s.ImageWorker.Init()
 
+	s.LogCollector = &logcollect.Collector{
+		ConfigLock:   &s.ConfigLock,
+		DockerClient: s.DockerClient,
+		Config:       &s.Config,
+	}
+	s.LogCollector.Init()
+
+	return 0
+}
+
+// credentialResolver builds the registry credential resolver, renewed
+// identity tokens are kept in <dataDir>/registry-tokens.json.
+func (s *System) credentialResolver() *credentials.Resolver {
+	r := &credentials.Resolver{Secrets: s.Secrets}
+	tokensPath := path.Join(s.Config.DataDir, "registry-tokens.json")
+	tokens, err := credentials.OpenTokenCache(tokensPath)
+	if err != nil {
+		log.Warnf("Unable to open the registry token cache at %s, renewed tokens are not kept, %v", tokensPath, err)
+		tokens = nil
+	}
+	r.Tokens = tokens
+	return r
+}
+
+// waitForDocker blocks until the Docker daemon answers. Docker may start
+// after deviced at boot, the workers need it to locate our own container.
+func (s *System) waitForDocker() {
+	backoff := utils.Backoff{Min: time.Duration(1) * time.Second, Max: time.Duration(30) * time.Second}
+	for {
+		_, err := s.DockerClient.Ping(context.Background())
+		if err == nil {
+			return
+		}
+		delay := backoff.Next()
+		log.Warnf("Unable to ping Docker, retrying in %s, %v", delay.String(), err)
+		time.Sleep(delay)
+	}
+}
+
+func (s *System) initApi() int {
+	if !s.Config.ApiConfig.Enabled() {
+		log.Info("API disabled in config.")
+		return 0
+	}
+
+	s.ApiServer = &api.ApiServer{
+		Config:              &s.Config,
+		ConfigLock:          &s.ConfigLock,
+		Status:              s.Status,
+		Logs:                s.LogCollector,
+		Audit:               s.Audit,
+		History:             s.History,
+		WakeContainerWorker: s.ContainerWorker.Wake,
+	}
+	if err := s.ApiServer.Init(); err != nil {
+		log.Errorf("Unable to start API, %v", err)
+		return 1
+	}
 	return 0
 }
 
 func (s *System) initWatchers() int {
 	s.ConfigWatcher = new(config.DevicedConfigWatcher)
 	s.ConfigWatcher.ConfigPath = &s.ConfigPath
+	s.ConfigWatcher.ConfigDir = &s.ConfigDir
+	s.ConfigWatcher.FactsFile = s.Config.EffectiveFactsFile()
 	if res := s.ConfigWatcher.Init(); res != 0 {
 		return res
 	}
@@ -99,19 +231,76 @@ func (s *System) initWatchers() int {
 
 // Wake the workers upon a config change
 func (s *System) wakeWorkers() {
-	fmt.Printf("Config changed, waking workers...\n")
+	log.Info("Config changed, waking workers...")
 	s.ImageWorker.WakeChannel <- true
-	s.ContainerWorker.WakeChannel <- true
+	s.ContainerWorker.Wake()
+	s.LogCollector.Wake()
+}
+
+// reloadConfig applies the config files after they changed.
+func (s *System) reloadConfig() {
+	files, err := config.ReadConfigFiles(s.ConfigPath, s.ConfigDir)
+	if err != nil {
+		log.Warnf("Unable to read config at %s, %v", s.ConfigPath, err)
+		s.recordConfigChange("", "", err)
+		return
+	}
+	// Unchanged files still render differently when the facts changed.
+	sameFiles := s.Applied != nil && s.Applied.Hash == files.Digest()
+
+	s.ConfigLock.Lock()
+	before, _ := s.Config.MarshalRedacted()
+	err = s.Config.LoadFiles(files)
+	after, _ := s.Config.MarshalRedacted()
+	s.ConfigLock.Unlock()
+	// Written by a revert, or touched without changes.
+	if err == nil && sameFiles && string(before) == string(after) {
+		log.Infof("Config at %s is already applied.", s.ConfigPath)
+		return
+	}
+	s.recordConfigChange(string(before), string(after), err)
+	if err != nil {
+		return
+	}
+	if !sameFiles {
+		s.recordRevision(files)
+	}
+	s.applyLogConfig()
+	s.triggerConfRecheck()
+	s.wakeWorkers()
+}
+
+// recordConfigChange adds a config reload to the audit log.
+func (s *System) recordConfigChange(before string, after string, err error) {
+	entry := &audit.Entry{
+		Type:    audit.TypeConfig,
+		Outcome: audit.Outcome(err),
+		Message: "reloaded " + s.ConfigPath,
+	}
+	if err != nil {
+		entry.Message = fmt.Sprintf("rejected %s, keeping the running config: %v", s.ConfigPath, err)
+	} else {
+		entry.Diff = audit.Diff(before, after)
+		if entry.Diff == "" {
+			entry.Message += ", no changes"
+		}
+	}
+	s.Audit.Record(entry)
 }
 
 func (s *System) triggerConfRecheck() {
-	fmt.Printf("Config changed, rechecking config...\n")
+	log.Info("Config changed, rechecking config...")
 	s.ImageWorker.RecheckConfig()
 }
 
 func (s *System) closeWorkers() {
+	if s.ApiServer != nil {
+		s.ApiServer.Quit()
+	}
 	s.ContainerWorker.Quit()
 	s.ImageWorker.Quit()
+	s.LogCollector.Quit()
+	s.Audit.Close()
 }
 
 func (s *System) closeWatchers() {
@@ -127,47 +316,60 @@ func (s *System) Main() int {
 		return res
 	}
 
+	if res := s.initHistory(); res != 0 {
+		return res
+	}
+
+	if res := s.initApi(); res != 0 {
+		return res
+	}
+
 	if res := s.initWatchers(); res != 0 {
 		return res
 	}
 
 	archTag := arch.GetArchTagSuffix()
 	if archTag != "" {
-		fmt.Printf("Using arch tag suffix: %s\n", archTag)
+		log.Infof("Using arch tag suffix: %s", archTag)
 	} else {
-		fmt.Printf("Using no arch tag suffix, arch is %s\n", arch.GetArch())
+		log.Infof("Using no arch tag suffix, arch is %s", arch.GetArch())
 	}
 
-	fmt.Printf("Starting image worker...\n")
+	log.Info("Starting image worker...")
 	go s.ImageWorker.Run()
-	fmt.Printf("Starting container worker...\n")
+	log.Info("Starting container worker...")
 	go s.ContainerWorker.Run()
+	log.Info("Starting log collector...")
+	go s.LogCollector.Run()
+	if s.ApiServer != nil {
+		log.Info("Starting API...")
+		go s.ApiServer.Run()
+	}
 
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	trialTicker := time.NewTicker(trialCheckPeriod)
+	defer trialTicker.Stop()
+
 	keepRunning := true
 	for keepRunning {
 		select {
 		case <-c:
 			keepRunning = false
 			break
+		case <-trialTicker.C:
+			s.checkTrial()
 		case event := <-s.ConfigWatcher.ConfigWatcher.Events:
-			fmt.Printf("event:%s\n", event)
+			log.Infof("event:%s", event)
 			s.closeWatchers()
 			time.Sleep(1 * time.Second)
-			s.ConfigLock.Lock()
-			err := s.Config.ReadFrom(s.ConfigPath)
-			s.ConfigLock.Unlock()
-			if err == nil {
-				s.triggerConfRecheck()
-				s.wakeWorkers()
-			}
+			s.reloadConfig()
 			s.initWatchers()
 			continue
 		}
 	}
-	fmt.Println("Exiting...")
+	log.Info("Exiting...")
 	s.closeWorkers()
 	s.closeWatchers()
 	return 0
@@ -0,0 +1,239 @@
+package daemon
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/audit"
+	"github.com/fuserobotics/deviced/pkg/config"
+)
+
+// trialCheckPeriod is how often target health is checked during a trial.
+const trialCheckPeriod = time.Duration(5) * time.Second
+
+// configTrial is a config revision that is applied but not trusted yet.
+type configTrial struct {
+	Revision *config.Revision
+	Started  time.Time
+	// When each target was first seen unhealthy in a row
+	UnhealthySince map[string]time.Time
+	// Targets that were already unhealthy when the trial started,
+	// not held against the config until they recover
+	Baseline map[string]bool
+}
+
+func (s *System) initHistory() int {
+	dir := path.Join(s.Config.DataDir, "config-history")
+	var err error
+	s.History, err = config.OpenHistory(dir, s.Config.Rollback.HistoryLimit)
+	if err != nil {
+		log.Warnf("Unable to open config history at %s, continuing without rollback, %v", dir, err)
+		s.History = nil
+		return 0
+	}
+	files, err := config.ReadConfigFiles(s.ConfigPath, s.ConfigDir)
+	if err != nil {
+		log.Warnf("Unable to read config at %s for the history, %v", s.ConfigPath, err)
+		return 0
+	}
+	s.recordRevision(files)
+	return 0
+}
+
+// recordRevision adds newly applied config files to the history,
+// putting them on trial if there is a good revision to fall back to.
+func (s *System) recordRevision(files *config.ConfigFiles) {
+	if s.History == nil {
+		return
+	}
+	dat, err := files.Marshal()
+	if err != nil {
+		log.Warnf("Unable to encode config for the history, %v", err)
+		return
+	}
+	hash := config.ConfigDigest(dat)
+	if s.Trial != nil {
+		s.History.SetState(s.Trial.Revision.Version, config.RevisionSuperseded, "replaced by a newer config during its trial")
+		s.Trial = nil
+	}
+	// Restarted during a trial, start it again.
+	if latest := s.History.Latest(); latest != nil && latest.Hash == hash && latest.State == config.RevisionTrial {
+		s.Applied = latest
+		s.startTrial(latest)
+		return
+	}
+	// Back to the last good config, e.g. after a revert.
+	if good := s.History.LastGood(0); good != nil && good.Hash == hash {
+		s.Applied = good
+		return
+	}
+
+	state, message := config.RevisionTrial, ""
+	if s.Config.Rollback.Disabled {
+		state, message = config.RevisionGood, "applied without a trial, rollback is disabled"
+	} else if s.History.LastGood(0) == nil {
+		state, message = config.RevisionGood, "applied without a trial, there is no earlier config"
+	}
+	rev, err := s.History.Add(dat, state, message)
+	if err != nil {
+		log.Warnf("Unable to add config to the history, %v", err)
+		return
+	}
+	s.Applied = rev
+	if state == config.RevisionTrial {
+		s.startTrial(rev)
+	}
+}
+
+func (s *System) startTrial(rev *config.Revision) {
+	s.Trial = &configTrial{
+		Revision:       rev,
+		Started:        time.Now(),
+		UnhealthySince: make(map[string]time.Time),
+		Baseline:       s.unhealthyTargets(),
+	}
+	msg := fmt.Sprintf("Config revision %d is on trial for %s.", rev.Version, s.Config.Rollback.TrialPeriod)
+	if s.Config.Rollback.RequireConfirm {
+		msg = fmt.Sprintf("Config revision %d is on trial, confirm it within %s.", rev.Version, s.Config.Rollback.TrialPeriod)
+	}
+	s.configEvent(msg, audit.OutcomeOK, "")
+}
+
+// unhealthyTargets returns the targets that are currently unhealthy.
+func (s *System) unhealthyTargets() map[string]bool {
+	res := make(map[string]bool)
+	if s.Status == nil {
+		return res
+	}
+	for id, ts := range s.Status.Snapshot().Targets {
+		if ts.Unhealthy() != "" {
+			res[id] = true
+		}
+	}
+	return res
+}
+
+// configEvent logs a config history change to the log, events and audit log.
+func (s *System) configEvent(msg string, outcome string, diff string) {
+	log.Info(msg)
+	if s.Status != nil {
+		s.Status.AddEvent("", "config", msg)
+	}
+	s.Audit.Record(&audit.Entry{
+		Type:    audit.TypeConfig,
+		Outcome: outcome,
+		Message: msg,
+		Diff:    diff,
+	})
+}
+
+// checkTrial ends the running trial if it was confirmed, passed or failed.
+func (s *System) checkTrial() {
+	trial := s.Trial
+	if trial == nil {
+		return
+	}
+	version := trial.Revision.Version
+	rev := s.History.Get(version)
+	if rev == nil || rev.State != config.RevisionTrial {
+		s.Trial = nil
+		s.configEvent(fmt.Sprintf("Config revision %d was confirmed.", version), audit.OutcomeOK, "")
+		return
+	}
+
+	s.ConfigLock.Lock()
+	conf := s.Config.Rollback
+	s.ConfigLock.Unlock()
+
+	now := time.Now()
+	snap := s.Status.Snapshot()
+	// Only judge targets once the workers have seen the new config.
+	if snap.Updated.After(trial.Started) {
+		for id, ts := range snap.Targets {
+			reason := ts.Unhealthy()
+			// A target still waiting for its image has not been tried yet.
+			if reason == "" || ts.WaitingForImage {
+				delete(trial.Baseline, id)
+				delete(trial.UnhealthySince, id)
+				continue
+			}
+			if trial.Baseline[id] {
+				continue
+			}
+			since, ok := trial.UnhealthySince[id]
+			if !ok {
+				trial.UnhealthySince[id] = now
+				continue
+			}
+			if now.Sub(since) >= conf.UnhealthyDuration() {
+				s.revertTrial(fmt.Sprintf("target %s was unhealthy for %s, %s", id, conf.UnhealthyTimeout, reason))
+				return
+			}
+		}
+		for id := range trial.UnhealthySince {
+			if _, ok := snap.Targets[id]; !ok {
+				delete(trial.UnhealthySince, id)
+			}
+		}
+	}
+
+	if now.Sub(trial.Started) < conf.TrialDuration() {
+		return
+	}
+	if conf.RequireConfirm {
+		s.revertTrial("not confirmed within " + conf.TrialPeriod)
+		return
+	}
+	s.Trial = nil
+	if err := s.History.SetState(version, config.RevisionGood, "passed its trial"); err != nil {
+		log.Warnf("Unable to update config history, %v", err)
+	}
+	s.configEvent(fmt.Sprintf("Config revision %d passed its trial.", version), audit.OutcomeOK, "")
+}
+
+// revertTrial applies the last good config again, and writes its files back
+// so a restart does not apply the failed config again.
+func (s *System) revertTrial(reason string) {
+	version := s.Trial.Revision.Version
+	s.Trial = nil
+
+	good := s.History.LastGood(version)
+	if good == nil {
+		s.History.SetState(version, config.RevisionGood, "kept, there is no earlier config to revert to")
+		s.configEvent(fmt.Sprintf("Unable to revert config revision %d, there is no earlier config: %s", version, reason), audit.OutcomeFailed, "")
+		return
+	}
+	var files *config.ConfigFiles
+	dat, err := s.History.Read(good.Version)
+	if err == nil {
+		files, err = config.UnmarshalConfigFiles(dat)
+	}
+	if err == nil {
+		s.ConfigLock.Lock()
+		before, _ := s.Config.MarshalRedacted()
+		err = s.Config.LoadFiles(files)
+		after, _ := s.Config.MarshalRedacted()
+		s.ConfigLock.Unlock()
+		if err == nil {
+			s.History.SetState(version, config.RevisionReverted, reason)
+			s.Applied = good
+			s.configEvent(
+				fmt.Sprintf("Reverted config revision %d to revision %d, %s.", version, good.Version, reason),
+				audit.OutcomeOK,
+				audit.Diff(string(before), string(after)),
+			)
+		}
+	}
+	if err != nil {
+		s.configEvent(fmt.Sprintf("Unable to revert config revision %d to revision %d, %v", version, good.Version, err), audit.OutcomeFailed, "")
+		return
+	}
+
+	if err := files.Write(); err != nil {
+		log.Warnf("Unable to write the reverted config to %s, %v", files.Main, err)
+	}
+	s.applyLogConfig()
+	s.triggerConfRecheck()
+	s.wakeWorkers()
+}
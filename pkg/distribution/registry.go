@@ -19,7 +19,8 @@ import (
 )
 
 type dumbCredentialStore struct {
-	auth *types.AuthConfig
+	auth      *types.AuthConfig
+	onRefresh func(token string)
 }
 
 func (dcs dumbCredentialStore) Basic(*url.URL) (string, string) {
@@ -30,13 +31,22 @@ func (dcs dumbCredentialStore) RefreshToken(*url.URL, string) string {
 	return dcs.auth.IdentityToken
 }
 
-func (dcs dumbCredentialStore) SetRefreshToken(*url.URL, string, string) {
+// SetRefreshToken keeps an identity token renewed by the token server.
+func (dcs dumbCredentialStore) SetRefreshToken(realm *url.URL, service string, token string) {
+	if token == "" || token == dcs.auth.IdentityToken {
+		return
+	}
+	dcs.auth.IdentityToken = token
+	if dcs.onRefresh != nil {
+		dcs.onRefresh(token)
+	}
 }
 
 // NewV2Repository returns a repository (v2 only). It creates a HTTP transport
 // providing timeout settings and authentication support, and also verifies the
-// remote API version.
-func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, endpoint registry.APIEndpoint, metaHeaders http.Header, authConfig *types.AuthConfig, actions ...string) (repo distribution.Repository, foundVersion bool, err error) {
+// remote API version. onRefresh, if set, is called when the identity token in
+// authConfig is replaced by a new one from the token server.
+func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, endpoint registry.APIEndpoint, metaHeaders http.Header, authConfig *types.AuthConfig, onRefresh func(token string), actions ...string) (repo distribution.Repository, foundVersion bool, err error) {
 	repoName := repoInfo.Name()
 	// If endpoint does not support CanonicalName, use the RemoteName instead
 	if endpoint.TrimHostname {
@@ -85,7 +95,7 @@ func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, end
 		passThruTokenHandler := &existingTokenHandler{token: authConfig.RegistryToken}
 		modifiers = append(modifiers, auth.NewAuthorizer(challengeManager, passThruTokenHandler))
 	} else {
-		creds := dumbCredentialStore{auth: authConfig}
+		creds := dumbCredentialStore{auth: authConfig, onRefresh: onRefresh}
 		tokenHandlerOptions := auth.TokenHandlerOptions{
 			Transport:   authTransport,
 			Credentials: creds,
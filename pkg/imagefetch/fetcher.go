@@ -0,0 +1,305 @@
+package imagefetch
+
+/*
+Image Fetcher
+=============
+
+Fetches an image directly from a registry through the
+distribution.Repository blob store, rather than asking
+the Docker daemon to pull it.
+
+Blobs are downloaded into a local cache directory. If a
+download is interrupted the partial file is kept, and the
+next attempt seeks past the bytes we already have, which
+issues a Range request for the remainder.
+
+Once every blob is present and its digest verified, the
+image is assembled into a `docker save` style tarball and
+handed to the daemon with ImageLoad.
+*/
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	dc "github.com/docker/docker/client"
+	"github.com/fuserobotics/deviced/pkg/logging"
+)
+
+var log = logging.Component("imagefetch")
+
+const partialSuffix string = ".partial"
+
+type Fetcher struct {
+	// Directory where blobs are cached
+	CacheDir string
+	// Number of attempts per blob before giving up
+	MaxRetries int
+	// Keep blobs in the cache after a successful load
+	KeepCache bool
+	// Called with the number of bytes downloaded, optional
+	Progress func(n int64)
+}
+
+// loadManifest is the entry written to manifest.json in the load tarball.
+type loadManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// FetchAndLoad downloads image:tag from repo and loads it into the daemon.
+func (f *Fetcher) FetchAndLoad(ctx context.Context, client *dc.Client, repo distribution.Repository, image string, tag string) error {
+	manifest, err := f.fetchManifest(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	blobs := append([]distribution.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, desc := range blobs {
+		if err := f.fetchBlob(ctx, repo, desc); err != nil {
+			return err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(f.writeLoadTarball(pw, manifest, strings.Join([]string{image, tag}, ":")))
+	}()
+
+	resp, err := client.ImageLoad(ctx, pr, true)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		return err
+	}
+
+	if !f.KeepCache {
+		for _, desc := range blobs {
+			os.Remove(f.blobPath(desc.Digest))
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) fetchManifest(ctx context.Context, repo distribution.Repository, tag string) (*schema2.DeserializedManifest, error) {
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ms.Get(ctx, "", distribution.WithTag(tag))
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve a manifest list to the entry for our platform.
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		var match *manifestlist.ManifestDescriptor
+		for i, desc := range list.Manifests {
+			if desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH {
+				match = &list.Manifests[i]
+				break
+			}
+		}
+		if match == nil {
+			return nil, fmt.Errorf("no manifest for %s/%s in manifest list", runtime.GOOS, runtime.GOARCH)
+		}
+		manifest, err = ms.Get(ctx, match.Digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s2, ok := manifest.(*schema2.DeserializedManifest)
+	if !ok {
+		return nil, errors.New("only schema2 manifests can be fetched directly")
+	}
+	return s2, nil
+}
+
+func (f *Fetcher) blobPath(dgst digest.Digest) string {
+	return path.Join(f.CacheDir, string(dgst.Algorithm()), dgst.Hex())
+}
+
+// fetchBlob downloads a blob into the cache, resuming a partial download if one exists.
+func (f *Fetcher) fetchBlob(ctx context.Context, repo distribution.Repository, desc distribution.Descriptor) error {
+	finalPath := f.blobPath(desc.Digest)
+	if _, err := os.Stat(finalPath); err == nil {
+		if err := verifyBlob(finalPath, desc.Digest); err == nil {
+			return nil
+		}
+		log.Infof("Cached blob %s failed verification, fetching again.", desc.Digest)
+		os.Remove(finalPath)
+	}
+
+	if err := os.MkdirAll(path.Dir(finalPath), 0755); err != nil {
+		return err
+	}
+
+	partialPath := finalPath + partialSuffix
+	maxRetries := f.MaxRetries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		err = f.fetchBlobAttempt(ctx, repo, desc, partialPath)
+		if err == nil {
+			break
+		}
+		log.Infof("Download of blob %s interrupted (attempt %d/%d), %v", desc.Digest, attempt, maxRetries, err)
+		if attempt == maxRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 5 * time.Second):
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := verifyBlob(partialPath, desc.Digest); err != nil {
+		// The partial data is bad, start over next time.
+		os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, finalPath)
+}
+
+func (f *Fetcher) fetchBlobAttempt(ctx context.Context, repo distribution.Repository, desc distribution.Descriptor, partialPath string) error {
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && offset >= desc.Size {
+		return nil
+	}
+
+	rsc, err := repo.Blobs(ctx).Open(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rsc.Close()
+
+	if offset > 0 {
+		log.Infof("Resuming blob %s at %d/%d bytes.", desc.Digest, offset, desc.Size)
+		if _, err := rsc.Seek(offset, os.SEEK_SET); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.Copy(file, rsc)
+	if f.Progress != nil {
+		f.Progress(n)
+	}
+	return err
+}
+
+func verifyBlob(blobPath string, dgst digest.Digest) error {
+	if dgst.Algorithm() != digest.SHA256 {
+		return fmt.Errorf("unsupported digest algorithm %s", dgst.Algorithm())
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != dgst.Hex() {
+		return fmt.Errorf("digest mismatch for %s, got sha256:%s", dgst, sum)
+	}
+	return nil
+}
+
+// writeLoadTarball writes a tarball in the format accepted by ImageLoad.
+func (f *Fetcher) writeLoadTarball(w io.Writer, manifest *schema2.DeserializedManifest, repoTag string) error {
+	tw := tar.NewWriter(w)
+
+	lm := loadManifest{
+		Config:   manifest.Config.Digest.Hex() + ".json",
+		RepoTags: []string{repoTag},
+	}
+	if err := addFileToTar(tw, lm.Config, f.blobPath(manifest.Config.Digest)); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		// The daemon decompresses layers on load, so the blob can be added as-is.
+		layerName := path.Join(layer.Digest.Hex(), "layer.tar")
+		if err := addFileToTar(tw, layerName, f.blobPath(layer.Digest)); err != nil {
+			return err
+		}
+		lm.Layers = append(lm.Layers, layerName)
+	}
+
+	manifestDat, err := json.Marshal([]loadManifest{lm})
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "manifest.json",
+		Mode: 0644,
+		Size: int64(len(manifestDat)),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestDat); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func addFileToTar(tw *tar.Writer, name string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: info.Size(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
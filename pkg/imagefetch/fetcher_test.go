@@ -0,0 +1,184 @@
+package imagefetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+)
+
+// testRepository serves a single blob, other repository methods are not used.
+type testRepository struct {
+	distribution.Repository
+	blobs *testBlobStore
+}
+
+func (r *testRepository) Blobs(ctx dcontext.Context) distribution.BlobStore {
+	return r.blobs
+}
+
+type testBlobStore struct {
+	distribution.BlobStore
+	data []byte
+	// Fail reads after this many bytes of the blob, 0 never fails
+	failAt int64
+	opens  int
+	seeks  []int64
+}
+
+func (s *testBlobStore) Open(ctx dcontext.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	s.opens++
+	return &testBlob{r: bytes.NewReader(s.data), store: s}, nil
+}
+
+// testBlob only reads through Read, so io.Copy cannot skip the failure.
+type testBlob struct {
+	r     *bytes.Reader
+	store *testBlobStore
+}
+
+func (b *testBlob) Seek(offset int64, whence int) (int64, error) {
+	b.store.seeks = append(b.store.seeks, offset)
+	return b.r.Seek(offset, whence)
+}
+
+func (b *testBlob) Read(p []byte) (int, error) {
+	if failAt := b.store.failAt; failAt > 0 {
+		pos := int64(len(b.store.data)) - int64(b.r.Len())
+		if pos >= failAt {
+			return 0, errors.New("connection reset")
+		}
+		if remaining := failAt - pos; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	return b.r.Read(p)
+}
+
+func (b *testBlob) Close() error {
+	return nil
+}
+
+func newTestFetcher(t *testing.T) (*Fetcher, func()) {
+	dir, err := ioutil.TempDir("", "imagefetch")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &Fetcher{CacheDir: dir, MaxRetries: 1}, func() { os.RemoveAll(dir) }
+}
+
+func testBlobData() []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), 1024)
+}
+
+func TestFetchBlobResume(t *testing.T) {
+	f, cleanup := newTestFetcher(t)
+	defer cleanup()
+
+	data := testBlobData()
+	desc := distribution.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	store := &testBlobStore{data: data, failAt: 5000}
+	repo := &testRepository{blobs: store}
+
+	var downloaded int64
+	f.Progress = func(n int64) { downloaded += n }
+
+	// The first attempt is interrupted, the partial file is kept.
+	if err := f.fetchBlob(context.Background(), repo, desc); err == nil {
+		t.Fatal("expected the interrupted download to fail")
+	}
+	partial, err := ioutil.ReadFile(f.blobPath(desc.Digest) + partialSuffix)
+	if err != nil {
+		t.Fatalf("expected a partial file, %v", err)
+	}
+	if !bytes.Equal(partial, data[:5000]) {
+		t.Fatalf("expected 5000 bytes in the partial file, got %d", len(partial))
+	}
+
+	// The next attempt continues where the first one stopped.
+	store.failAt = 0
+	if err := f.fetchBlob(context.Background(), repo, desc); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(store.seeks) != 1 || store.seeks[0] != 5000 {
+		t.Fatalf("expected one seek to 5000, got %v", store.seeks)
+	}
+	if downloaded != int64(len(data)) {
+		t.Fatalf("expected %d bytes downloaded in total, got %d", len(data), downloaded)
+	}
+	blob, err := ioutil.ReadFile(f.blobPath(desc.Digest))
+	if err != nil {
+		t.Fatalf("expected the blob in the cache, %v", err)
+	}
+	if !bytes.Equal(blob, data) {
+		t.Fatal("cached blob does not match")
+	}
+	if _, err := os.Stat(f.blobPath(desc.Digest) + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial file to be gone, %v", err)
+	}
+
+	// A verified blob in the cache is not downloaded again.
+	if err := f.fetchBlob(context.Background(), repo, desc); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if store.opens != 2 {
+		t.Fatalf("expected the cached blob to be used, blob opened %d times", store.opens)
+	}
+}
+
+func TestFetchBlobDigestMismatch(t *testing.T) {
+	f, cleanup := newTestFetcher(t)
+	defer cleanup()
+
+	data := testBlobData()
+	desc := distribution.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	corrupt := append([]byte{}, data...)
+	corrupt[100] = 'x'
+	repo := &testRepository{blobs: &testBlobStore{data: corrupt}}
+
+	if err := f.fetchBlob(context.Background(), repo, desc); err == nil {
+		t.Fatal("expected a digest mismatch")
+	}
+	if _, err := os.Stat(f.blobPath(desc.Digest)); !os.IsNotExist(err) {
+		t.Fatalf("expected no cached blob, %v", err)
+	}
+	// Resuming bad data can never succeed, the next attempt starts over.
+	if _, err := os.Stat(f.blobPath(desc.Digest) + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial file to be removed, %v", err)
+	}
+}
+
+func TestFetchBlobCorruptCache(t *testing.T) {
+	f, cleanup := newTestFetcher(t)
+	defer cleanup()
+
+	data := testBlobData()
+	desc := distribution.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	store := &testBlobStore{data: data}
+	repo := &testRepository{blobs: store}
+
+	finalPath := f.blobPath(desc.Digest)
+	if err := os.MkdirAll(path.Dir(finalPath), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(finalPath, data[:100], 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := f.fetchBlob(context.Background(), repo, desc); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if store.opens != 1 {
+		t.Fatalf("expected the corrupt cached blob to be fetched again, blob opened %d times", store.opens)
+	}
+	blob, err := ioutil.ReadFile(finalPath)
+	if err != nil || !bytes.Equal(blob, data) {
+		t.Fatalf("expected the blob to be replaced, %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package imagesync
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math"
 	"net/url"
 	"strings"
@@ -12,29 +14,39 @@ import (
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
-	"github.com/docker/engine-api/types"
 	ddistro "github.com/fuserobotics/deviced/pkg/distribution"
 
+	"github.com/Sirupsen/logrus"
 	dct "github.com/docker/docker/api/types"
 	dc "github.com/docker/docker/client"
 	"github.com/fuserobotics/deviced/pkg/arch"
+	"github.com/fuserobotics/deviced/pkg/audit"
 	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/credentials"
+	"github.com/fuserobotics/deviced/pkg/imagefetch"
+	"github.com/fuserobotics/deviced/pkg/jsonmessage"
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/metrics"
 	"github.com/fuserobotics/deviced/pkg/registry"
 	"github.com/fuserobotics/deviced/pkg/utils"
 )
 
+var log = logging.Component("imagesync")
+
 type ImageSyncWorker struct {
 	Config       *config.DevicedConfig
 	ConfigLock   *sync.Mutex
 	WorkerLock   *sync.Mutex
 	DockerClient *dc.Client
+	Audit        *audit.Log
+	Credentials  *credentials.Resolver
 
-	Running              bool
-	WakeChannel          chan bool
-	QuitChannel          chan bool
-	WakeContainerChannel *chan bool
-	RecheckTimer         *time.Timer
-	UnsolvedReqs         bool
+	Running             bool
+	WakeChannel         chan bool
+	QuitChannel         chan bool
+	WakeContainerWorker func()
+	RecheckTimer        *time.Timer
+	UnsolvedReqs        bool
 
 	RegistryContext context.Context
 }
@@ -66,6 +78,26 @@ func (iw *ImageSyncWorker) initRecheckTimer() {
 	iw.ConfigLock.Unlock()
 }
 
+func (iw *ImageSyncWorker) fetcher(registry string) *imagefetch.Fetcher {
+	return &imagefetch.Fetcher{
+		CacheDir:   iw.Config.ImageConfig.CacheDir,
+		MaxRetries: iw.Config.ImageConfig.MaxBlobRetries,
+		KeepCache:  iw.Config.ImageConfig.KeepBlobCache,
+		Progress: func(n int64) {
+			metrics.PullBytes.Add(float64(n), registry)
+		},
+	}
+}
+
+// dockerConfigPath returns the Docker config.json to take credentials from,
+// empty if disabled.
+func (iw *ImageSyncWorker) dockerConfigPath() string {
+	if !iw.Config.ImageConfig.UseDockerConfig {
+		return ""
+	}
+	return iw.Config.ImageConfig.DockerConfigPath
+}
+
 func (iw *ImageSyncWorker) RecheckConfig() {
 	iw.killRecheckTimer()
 }
@@ -85,15 +117,17 @@ func (iw *ImageSyncWorker) sleepShouldQuit(t time.Duration) bool {
 // AvailableAt
 // - map between tag -> registry
 type imageToFetch struct {
-	FetchAny    bool
-	NeededTags  []string
-	AvailableAt map[string][]availableDownloadRepository
-	Target      config.TargetContainer
+	FetchAny     bool
+	NeededTags   []string
+	PrefetchTags []string
+	AvailableAt  map[string][]availableDownloadRepository
+	Target       config.TargetContainer
 }
 
 type availableDownloadRepository struct {
 	Repo    distribution.Repository
 	RepoRef config.RemoteRepository
+	Auth    *credentials.Auth
 }
 
 func (iw *ImageSyncWorker) processOnce() {
@@ -104,10 +138,15 @@ func (iw *ImageSyncWorker) processOnce() {
 	iw.WorkerLock.Lock()
 	defer iw.WorkerLock.Unlock()
 	shouldTriggerContainerCheck := false
-	fmt.Printf("ImageSyncWorker checking repositories...\n")
+	log.Info("ImageSyncWorker checking repositories...")
+	started := time.Now()
+	defer func() {
+		metrics.ReconcileTotal.Inc(metrics.WorkerImage)
+		metrics.ReconcileDuration.Observe(time.Since(started).Seconds(), metrics.WorkerImage)
+	}()
 	repoLen := len(iw.Config.Repos)
 	if repoLen == 0 {
-		fmt.Printf("No repositories given in config.\n")
+		log.Info("No repositories given in config.")
 		return
 	}
 
@@ -115,7 +154,8 @@ func (iw *ImageSyncWorker) processOnce() {
 	liOpts := dct.ImageListOptions{}
 	images, err := iw.DockerClient.ImageList(context.Background(), liOpts)
 	if err != nil {
-		fmt.Printf("Error fetching images list %v\n", err)
+		metrics.DockerErrors.Inc("image_list")
+		log.Errorf("Error fetching images list %v", err)
 		return
 	}
 
@@ -138,26 +178,39 @@ func (iw *ImageSyncWorker) processOnce() {
 				bestAvailable = avail
 			}
 		}
-		if bestAvailableScore == 0 || (len(ctr.Versions) == 0 && !ctr.UseAnyVersion) {
-			continue
+		// Prefetch tags are pulled ahead of time but never selected.
+		var prefetchTags []string
+		for _, tag := range arch.AppendArchTagSuffix(ctr.Prefetch) {
+			if !utils.StringSliceContains(availableTags, tag) {
+				prefetchTags = append(prefetchTags, tag)
+			}
 		}
-		versionList := arch.AppendArchTagSuffix(ctr.Versions)
-		// fetch anything from index 0 to bestAvailableScore (non inclusive)
 		var tagsToFetch []string
-		if bestAvailable == "" {
-			tagsToFetch = versionList
-		} else {
-			tagsToFetch = versionList[:bestAvailableScore]
+		if bestAvailableScore != 0 && (len(ctr.Versions) != 0 || ctr.UseAnyVersion) {
+			versionList := arch.AppendArchTagSuffix(ctr.Versions)
+			// fetch anything from index 0 to bestAvailableScore (non inclusive)
+			if bestAvailable == "" {
+				tagsToFetch = versionList
+			} else {
+				tagsToFetch = versionList[:bestAvailableScore]
+			}
+		}
+		if len(tagsToFetch) == 0 && len(prefetchTags) == 0 {
+			continue
+		}
+		log.Infof("We need to fetch images for %s", *image)
+		log.Infof("Best available: %s score: %d", bestAvailable, bestAvailableScore)
+		log.Infof("Versions to fetch: %v", tagsToFetch)
+		if len(prefetchTags) != 0 {
+			log.Infof("Versions to prefetch: %v", prefetchTags)
 		}
-		fmt.Printf("We need to fetch images for %s\n", *image)
-		fmt.Printf("Best available: %s score: %d\n", bestAvailable, bestAvailableScore)
-		fmt.Printf("Versions to fetch: %v\n", tagsToFetch)
 		if ctr.UseAnyVersion {
-			fmt.Printf("... but we will settle for any version.\n")
+			log.Info("... but we will settle for any version.")
 		}
 		toFetch := new(imageToFetch)
 		toFetch.FetchAny = ctr.UseAnyVersion
 		toFetch.NeededTags = tagsToFetch
+		toFetch.PrefetchTags = prefetchTags
 		toFetch.Target = *ctr
 		toFetch.AvailableAt = make(map[string][]availableDownloadRepository)
 		imagesToFetch = append(imagesToFetch, toFetch)
@@ -167,14 +220,14 @@ func (iw *ImageSyncWorker) processOnce() {
 		return
 	}
 
-	fmt.Printf("Preparing to fetch %d repos...\n", len(imagesToFetch))
+	log.Infof("Preparing to fetch %d repos...", len(imagesToFetch))
 
 	// Build registry client
 	// Rebuild the registry list
 	for _, rege := range iw.Config.Repos {
 		urlParsed, err := url.Parse(rege.Url)
 		if err != nil {
-			fmt.Printf("Unable to parse url %s, %v\n", rege.Url, err)
+			log.Warnf("Unable to parse url %s, %v", rege.Url, err)
 			continue
 		}
 		var insecureRegs []string
@@ -182,6 +235,11 @@ func (iw *ImageSyncWorker) processOnce() {
 			insecureRegs = []string{urlParsed.Host}
 		}
 		service := registry.NewService(registry.ServiceOptions{InsecureRegistries: insecureRegs})
+		auth, err := iw.Credentials.AuthConfig(rege, iw.dockerConfigPath())
+		if err != nil {
+			log.Errorf("Unable to check %s, %v", rege.Url, err)
+			continue
+		}
 		for _, tf := range imagesToFetch {
 			image := tf.Target.Image
 			imagePts := strings.Split(image, "/")
@@ -191,48 +249,48 @@ func (iw *ImageSyncWorker) processOnce() {
 			}
 			ref, err := reference.ParseNamed(image)
 			if err != nil {
-				fmt.Printf("Error parsing reference %s, %v.\n", image, err)
+				log.Errorf("Error parsing reference %s, %v.", image, err)
 				continue
 			}
 			info, err := registry.ParseRepositoryInfo(ref)
 			if err != nil {
-				fmt.Printf("Error parsing repository info %s, %v.\n", image, err)
+				log.Errorf("Error parsing repository info %s, %v.", image, err)
 				continue
 			}
 			endpoints, err := service.LookupPullEndpoints(urlParsed.Host)
 			if err != nil {
-				fmt.Printf("Error parsing endpoints %s, %v.\n", rege.Url, err)
+				log.Errorf("Error parsing endpoints %s, %v.", rege.Url, err)
 				continue
 			}
 			metaHeaders := rege.MetaHeaders
-			authConfig := &types.AuthConfig{Username: rege.Username, Password: rege.Password}
 			successfullyConnected := false
 			// var endpoint registry.APIEndpoint
 			var reg distribution.Repository
 			for _, endp := range endpoints {
-				reg, _, err = ddistro.NewV2Repository(iw.RegistryContext, info, endp, metaHeaders, authConfig, "pull")
+				reg, _, err = ddistro.NewV2Repository(iw.RegistryContext, info, endp, metaHeaders, &auth.Config, auth.TokenRefreshed, "pull")
 				if err != nil {
-					fmt.Printf("Error connecting to '%s', %v\n", rege.Url, err)
+					log.Errorf("Error connecting to '%s', %v", rege.Url, err)
 					continue
 				}
 				successfullyConnected = true
 				break
 			}
 			if !successfullyConnected {
-				fmt.Printf("Unable to connect successfully to %s.\n", rege.Url)
+				log.Warnf("Unable to connect successfully to %s.", rege.Url)
 				continue
 			}
 			// tags is the tag service
 			tags, err := reg.Tags(iw.RegistryContext).All(iw.RegistryContext)
 			if err != nil {
-				fmt.Printf("Error checking '%s' for %s, %v\n", rege.Url, image, err)
+				log.Errorf("Error checking '%s' for %s, %v", rege.Url, image, err)
 				continue
 			}
-			fmt.Printf("From %s, %s is available with %d tags, pull prefix %s.\n", rege.Url, image, len(tags), rege.PullPrefix)
+			log.Infof("From %s, %s is available with %d tags, pull prefix %s.", rege.Url, image, len(tags), rege.PullPrefix)
 			for _, tag := range tags {
 				tf.AvailableAt[tag] = append(tf.AvailableAt[tag], availableDownloadRepository{
 					Repo:    reg,
 					RepoRef: *rege,
+					Auth:    auth,
 				})
 			}
 		}
@@ -242,41 +300,10 @@ func (iw *ImageSyncWorker) processOnce() {
 			matchedBest := false
 			for idx, tag := range tf.NeededTags {
 				for _, reg := range tf.AvailableAt[tag] {
-					fmt.Printf("%s:%s available from %s, pulling...\n", tf.Target.Image, tag, reg.RepoRef.Url)
-					imageWithPrefix := tf.Target.Image
-					if reg.RepoRef.PullPrefix != "" {
-						imageWithPrefix = strings.Join([]string{reg.RepoRef.PullPrefix, tf.Target.Image}, "/")
-					}
-					popts := dct.ImagePullOptions{
-						RegistryAuth: reg.RepoRef.BuildBase64Creds(),
-					}
-					err := func() error {
-						rc, err := iw.DockerClient.ImagePull(context.Background(), fmt.Sprintf("%s:%s", imageWithPrefix, tag), popts)
-						if err != nil {
-							return err
-						}
-						defer rc.Close()
-						_, err = ioutil.ReadAll(rc)
-						if err != nil {
-							return err
-						}
-						return err
-					}()
-					if err != nil {
-						fmt.Printf("Failed to pull %s:%s from %s, %v\n", tf.Target.Image, tag, reg.RepoRef.Url, err)
+					if err := iw.pullImage(tf.Target.Image, tag, reg); err != nil {
 						continue
 					}
-					if reg.RepoRef.PullPrefix != "" {
-						imageWithPrefixAndTag := strings.Join([]string{imageWithPrefix, tag}, ":")
-						targetImageWithTag := strings.Join([]string{tf.Target.Image, tag}, ":")
-						err = iw.DockerClient.ImageTag(context.Background(), imageWithPrefixAndTag, targetImageWithTag)
-						if err != nil {
-							fmt.Printf("Failed to tag %s as %s:%s, %v\n", imageWithPrefixAndTag, tf.Target.Image, tag, err)
-							continue
-						}
-						shouldTriggerContainerCheck = true
-						fmt.Printf("tagged %s as %s:%s\n", imageWithPrefixAndTag, tf.Target.Image, tag)
-					}
+					shouldTriggerContainerCheck = true
 					matchedOne = true
 					if idx == 0 {
 						matchedBest = true
@@ -287,15 +314,38 @@ func (iw *ImageSyncWorker) processOnce() {
 					break
 				}
 			}
+			if len(tf.NeededTags) == 0 {
+				matchedOne = true
+				matchedBest = true
+			}
+			// Pull prefetch tags, keeping any we couldn't get for the next registry.
+			var remainingPrefetch []string
+			for _, tag := range tf.PrefetchTags {
+				prefetched := false
+				for _, reg := range tf.AvailableAt[tag] {
+					if err := iw.pullImage(tf.Target.Image, tag, reg); err != nil {
+						continue
+					}
+					prefetched = true
+					break
+				}
+				if !prefetched {
+					remainingPrefetch = append(remainingPrefetch, tag)
+				}
+			}
+			tf.PrefetchTags = remainingPrefetch
+			if len(remainingPrefetch) != 0 {
+				matchedBest = false
+			}
 			if !matchedOne || !matchedBest {
 				iw.UnsolvedReqs = true
-				fmt.Printf("%s: dependencies unsolved, will recheck later.\n", tf.Target.Image)
+				log.Infof("%s: dependencies unsolved, will recheck later.", tf.Target.Image)
 			}
 		}
 
 		// trigger a wake
 		if shouldTriggerContainerCheck {
-			(*iw.WakeContainerChannel) <- true
+			iw.WakeContainerWorker()
 		}
 
 		// Flush the wake channel
@@ -312,24 +362,124 @@ func (iw *ImageSyncWorker) processOnce() {
 	}
 }
 
+// pullImage fetches image:tag from reg and tags it without the pull prefix.
+func (iw *ImageSyncWorker) pullImage(image string, tag string, reg availableDownloadRepository) (err error) {
+	defer func() {
+		entry := &audit.Entry{
+			Type:    audit.TypePull,
+			Outcome: audit.Outcome(err),
+			Image:   image,
+			Tag:     tag,
+			Message: "from " + reg.RepoRef.Url,
+		}
+		if err != nil {
+			entry.Message = fmt.Sprintf("from %s: %v", reg.RepoRef.Url, err)
+		}
+		iw.Audit.Record(entry)
+	}()
+	plog := log.WithFields(logrus.Fields{
+		"image":    image,
+		"tag":      tag,
+		"registry": reg.RepoRef.Url,
+	})
+	plog.Infof("%s:%s available from %s, pulling...", image, tag, reg.RepoRef.Url)
+	started := time.Now()
+	if iw.Config.ImageConfig.PullMode == config.PullModeDirect {
+		err = iw.fetcher(reg.RepoRef.Url).FetchAndLoad(context.Background(), iw.DockerClient, reg.Repo, image, tag)
+		if err != nil {
+			metrics.PullFailures.Inc(reg.RepoRef.Url)
+			plog.Errorf("Failed to fetch %s:%s directly from %s, %v", image, tag, reg.RepoRef.Url, err)
+			return err
+		}
+		metrics.PullDuration.Observe(time.Since(started).Seconds(), reg.RepoRef.Url)
+		plog.Infof("Loaded %s:%s from %s.", image, tag, reg.RepoRef.Url)
+		return nil
+	}
+
+	imageWithPrefix := image
+	if reg.RepoRef.PullPrefix != "" {
+		imageWithPrefix = strings.Join([]string{reg.RepoRef.PullPrefix, image}, "/")
+	}
+	popts := dct.ImagePullOptions{
+		RegistryAuth: reg.Auth.Encode(),
+	}
+	err = func() error {
+		rc, err := iw.DockerClient.ImagePull(context.Background(), fmt.Sprintf("%s:%s", imageWithPrefix, tag), popts)
+		if err != nil {
+			metrics.DockerErrors.Inc("image_pull")
+			return err
+		}
+		defer rc.Close()
+		n, err := readPullStream(rc)
+		metrics.PullBytes.Add(float64(n), reg.RepoRef.Url)
+		return err
+	}()
+	if err != nil {
+		metrics.PullFailures.Inc(reg.RepoRef.Url)
+		plog.Errorf("Failed to pull %s:%s from %s, %v", image, tag, reg.RepoRef.Url, err)
+		return err
+	}
+	metrics.PullDuration.Observe(time.Since(started).Seconds(), reg.RepoRef.Url)
+	if reg.RepoRef.PullPrefix != "" {
+		imageWithPrefixAndTag := strings.Join([]string{imageWithPrefix, tag}, ":")
+		targetImageWithTag := strings.Join([]string{image, tag}, ":")
+		err = iw.DockerClient.ImageTag(context.Background(), imageWithPrefixAndTag, targetImageWithTag)
+		if err != nil {
+			metrics.DockerErrors.Inc("image_tag")
+			plog.Errorf("Failed to tag %s as %s:%s, %v", imageWithPrefixAndTag, image, tag, err)
+			return err
+		}
+		plog.Infof("tagged %s as %s:%s", imageWithPrefixAndTag, image, tag)
+	}
+	return nil
+}
+
+// readPullStream drains a pull progress stream, returning the bytes
+// downloaded and any error reported in the stream.
+func readPullStream(r io.Reader) (int64, error) {
+	// Size of each downloaded layer, keyed by layer id
+	layers := make(map[string]int64)
+	var total int64
+	dec := json.NewDecoder(r)
+	for {
+		msg := &jsonmessage.JSONMessage{}
+		if err := dec.Decode(msg); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return total, err
+		}
+		if msg.Error != nil {
+			return total, msg.Error
+		}
+		if msg.ErrorMessage != "" {
+			return total, errors.New(msg.ErrorMessage)
+		}
+		if msg.Status == "Downloading" && msg.ProgressDetail != nil {
+			total += msg.ProgressDetail.Current - layers[msg.ID]
+			layers[msg.ID] = msg.ProgressDetail.Current
+		}
+	}
+}
+
 func (iw *ImageSyncWorker) Run() {
 	doRecheck := true
 	for iw.Running {
 		if !doRecheck {
-			fmt.Printf("ImageSyncWorker sleeping...\n")
+			log.Info("ImageSyncWorker sleeping...")
 			iw.initRecheckTimer()
 		}
 		for !doRecheck {
 			select {
 			case <-iw.QuitChannel:
-				fmt.Printf("ImageSyncWorker exiting...\n")
+				log.Info("ImageSyncWorker exiting...")
 				return
 			case <-iw.WakeChannel:
-				fmt.Printf("ImageSyncWorker woken, re-checking...\n")
+				log.Info("ImageSyncWorker woken, re-checking...")
 				doRecheck = true
 				break
 			case <-iw.RecheckTimer.C:
-				fmt.Printf("ImageSyncWorker timer elapsed, re-checking...\n")
+				log.Info("ImageSyncWorker timer elapsed, re-checking...")
 				doRecheck = true
 				break
 			}
@@ -337,7 +487,7 @@ func (iw *ImageSyncWorker) Run() {
 		doRecheck = false
 		iw.processOnce()
 	}
-	fmt.Printf("ImageSyncWorker exiting...\n")
+	log.Info("ImageSyncWorker exiting...")
 }
 
 func (iw *ImageSyncWorker) Quit() {
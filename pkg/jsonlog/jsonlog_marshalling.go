@@ -66,6 +66,7 @@ package jsonlog
 
 import (
 	"bytes"
+	"sort"
 	"unicode/utf8"
 )
 
@@ -110,6 +111,24 @@ func (mj *JSONLog) MarshalJSONBuf(buf *bytes.Buffer) error {
 		return err
 	}
 	buf.WriteString(timestamp)
+	if len(mj.Attrs) != 0 {
+		// Sorted so equal entries encode the same
+		keys := make([]string, 0, len(mj.Attrs))
+		for k := range mj.Attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString(`,"attrs":{`)
+		for i, k := range keys {
+			if i != 0 {
+				buf.WriteString(`,`)
+			}
+			ffjsonWriteJSONString(buf, k)
+			buf.WriteString(`:`)
+			ffjsonWriteJSONString(buf, mj.Attrs[k])
+		}
+		buf.WriteString(`}`)
+	}
 	buf.WriteString(`}`)
 	return nil
 }
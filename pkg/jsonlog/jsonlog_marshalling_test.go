@@ -32,3 +32,15 @@ func TestJSONLogMarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestJSONLogMarshalJSONAttrs(t *testing.T) {
+	jl := &JSONLog{Log: "a", Attrs: map[string]string{"b": "2", "a": "1"}}
+	data, err := jl.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expression := `^{\"log\":\"a\",\"time\":\".{20,}\",\"attrs\":{\"a\":\"1\",\"b\":\"2\"}}$`
+	if !regexp.MustCompile(expression).MatchString(string(data)) {
+		t.Fatalf("Log line not in expected format [%v]: %q", expression, string(data))
+	}
+}
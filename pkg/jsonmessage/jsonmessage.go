@@ -8,3 +8,19 @@ type JSONError struct {
 func (e *JSONError) Error() string {
 	return e.Message
 }
+
+// JSONProgress is the progress of a layer in a pull stream.
+type JSONProgress struct {
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+// JSONMessage is one line of a pull stream.
+type JSONMessage struct {
+	Status          string        `json:"status,omitempty"`
+	ProgressMessage string        `json:"progress,omitempty"`
+	ProgressDetail  *JSONProgress `json:"progressDetail,omitempty"`
+	ID              string        `json:"id,omitempty"`
+	Error           *JSONError    `json:"errorDetail,omitempty"`
+	ErrorMessage    string        `json:"error,omitempty"`
+}
@@ -0,0 +1,289 @@
+package logcollect
+
+/*
+Collector follows stdout and stderr of managed containers.
+
+Each target gets a log file in the log dir, one jsonlog line per output
+line with the deviced.id, image tag and container in attrs. Files are
+rotated by size. After a restart the collector resumes each container
+from the time of its last line in the target's file.
+
+With forwarding enabled, lines are also buffered in segment files and
+sent to a syslog or HTTP sink, see forwarder.
+*/
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	dct "github.com/docker/docker/api/types"
+	dcf "github.com/docker/docker/api/types/filters"
+	dc "github.com/docker/docker/client"
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+	"github.com/fuserobotics/deviced/pkg/logging"
+	"github.com/fuserobotics/deviced/pkg/redact"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+var log = logging.Component("logcollect")
+
+// ErrDisabled is returned when reading logs while collection is disabled.
+var ErrDisabled = errors.New("container log collection is disabled")
+
+// syncPeriod is how often the container list is checked for new containers.
+const syncPeriod = time.Duration(10) * time.Second
+
+// Must match the label the container worker uses.
+const deviced_id_label string = "deviced.id"
+
+type Collector struct {
+	Config       *config.DevicedConfig
+	ConfigLock   *sync.Mutex
+	DockerClient *dc.Client
+
+	Running     bool
+	WakeChannel chan bool
+	QuitChannel chan bool
+
+	mtx sync.Mutex
+	// Config in use, copied on each sync
+	conf config.ContainerLogConfig
+	// Followed containers by id
+	followers map[string]context.CancelFunc
+	// Open log files by target
+	writers   map[string]*utils.RotatingFile
+	forwarder *forwarder
+}
+
+func (c *Collector) Init() {
+	c.Running = true
+	c.WakeChannel = make(chan bool, 1)
+	c.QuitChannel = make(chan bool, 1)
+	c.followers = make(map[string]context.CancelFunc)
+	c.writers = make(map[string]*utils.RotatingFile)
+}
+
+func (c *Collector) Run() {
+	ticker := time.NewTicker(syncPeriod)
+	defer ticker.Stop()
+	for c.Running {
+		c.sync()
+		select {
+		case <-c.QuitChannel:
+			c.Running = false
+		case <-c.WakeChannel:
+		case <-ticker.C:
+		}
+	}
+	c.stop()
+	log.Info("Log collector exiting...")
+}
+
+func (c *Collector) Quit() {
+	c.QuitChannel <- true
+}
+
+// Wake checks for new containers and config changes now.
+func (c *Collector) Wake() {
+	select {
+	case c.WakeChannel <- true:
+	default:
+	}
+}
+
+// sync applies config changes and follows containers not yet followed.
+func (c *Collector) sync() {
+	c.ConfigLock.Lock()
+	conf := c.Config.ContainerLogs
+	if conf.Forward != nil {
+		fwd := *conf.Forward
+		conf.Forward = &fwd
+	}
+	c.ConfigLock.Unlock()
+
+	c.mtx.Lock()
+	changed := !reflect.DeepEqual(conf, c.conf)
+	if changed {
+		// Followers pick up the new files and sink when restarted.
+		c.stopLocked()
+		c.conf = conf
+	}
+	c.mtx.Unlock()
+
+	if !conf.Enabled {
+		return
+	}
+	if changed {
+		if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+			log.Warnf("Unable to create log dir %s, %v", conf.Dir, err)
+			return
+		}
+		if conf.Forward != nil {
+			fwd, err := newForwarder(conf.Forward, conf.BufferDir())
+			if err != nil {
+				log.Warnf("Unable to start log forwarding, %v", err)
+			} else {
+				c.mtx.Lock()
+				c.forwarder = fwd
+				c.mtx.Unlock()
+				go fwd.run()
+			}
+		}
+	}
+
+	args, _ := dcf.ParseFlag("label="+deviced_id_label, dcf.NewArgs())
+	ctrs, err := c.DockerClient.ContainerList(context.Background(), dct.ContainerListOptions{Filters: args})
+	if err != nil {
+		log.Warnf("Unable to list containers, %v", err)
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, ctr := range ctrs {
+		if _, ok := c.followers[ctr.ID]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		c.followers[ctr.ID] = cancel
+		go c.follow(ctx, ctr)
+	}
+}
+
+// stop ends all followers and closes the files and the forwarder.
+func (c *Collector) stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stopLocked()
+}
+
+func (c *Collector) stopLocked() {
+	for cid, cancel := range c.followers {
+		cancel()
+		delete(c.followers, cid)
+	}
+	for target, w := range c.writers {
+		w.Close()
+		delete(c.writers, target)
+	}
+	if c.forwarder != nil {
+		c.forwarder.close()
+		c.forwarder = nil
+	}
+}
+
+// follow copies the output of a container until it exits or is cancelled.
+func (c *Collector) follow(ctx context.Context, ctr dct.Container) {
+	target := ctr.Labels[deviced_id_label]
+	_, tag := utils.ParseImageAndTag(ctr.Image)
+	clog := log.WithField("target", target).WithField("container", ctr.ID)
+	defer func() {
+		c.mtx.Lock()
+		if ctx.Err() == nil {
+			delete(c.followers, ctr.ID)
+		}
+		c.mtx.Unlock()
+	}()
+
+	info, err := c.DockerClient.ContainerInspect(ctx, ctr.ID)
+	if err != nil {
+		clog.Warnf("Unable to inspect container, not collecting logs, %v", err)
+		return
+	}
+
+	since := c.lastWritten(target, ctr.ID)
+	opts := dct.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+	}
+	if !since.IsZero() {
+		opts.Since = formatSince(since)
+	}
+	rc, err := c.DockerClient.ContainerLogs(ctx, ctr.ID, opts)
+	if err != nil {
+		clog.Warnf("Unable to follow logs, %v", err)
+		return
+	}
+	defer rc.Close()
+
+	attrs := map[string]string{
+		deviced_id_label: target,
+		"tag":            tag,
+		"container":      ctr.ID,
+	}
+	emit := func(stream string, created time.Time, line string) {
+		// Lines at the resume time may have been written already.
+		if !created.After(since) {
+			return
+		}
+		c.write(target, &jsonlog.JSONLog{
+			Log:     redact.String(line),
+			Stream:  stream,
+			Created: created,
+			Attrs:   attrs,
+		})
+	}
+	clog.Info("Collecting container logs...")
+	if err := copyLogStream(rc, info.Config != nil && info.Config.Tty, emit); err != nil && ctx.Err() == nil {
+		clog.Warnf("Log stream ended, %v", err)
+	}
+}
+
+// lastWritten returns the time collection of a container resumes from.
+func (c *Collector) lastWritten(target string, container string) time.Time {
+	c.mtx.Lock()
+	name := logFileName(c.conf.Dir, target)
+	c.mtx.Unlock()
+	t, err := lastLogTime(name, container)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithField("target", target).Warnf("Unable to read %s, %v", name, err)
+	}
+	return t
+}
+
+func (c *Collector) write(target string, jl *jsonlog.JSONLog) {
+	line, err := encodeLine(jl)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.conf.Enabled {
+		return
+	}
+	key := strings.ToLower(target)
+	w, ok := c.writers[key]
+	if !ok {
+		w, err = utils.OpenRotatingFile(logFileName(c.conf.Dir, target), int64(c.conf.MaxSizeMB)*1024*1024, c.conf.MaxFiles)
+		if err != nil {
+			log.WithField("target", target).Warnf("Unable to open log file, %v", err)
+			return
+		}
+		c.writers[key] = w
+	}
+	if _, err := w.Write(line); err != nil {
+		log.WithField("target", target).Warnf("Unable to write log file, %v", err)
+	}
+	if c.forwarder != nil {
+		c.forwarder.write(line)
+	}
+}
+
+// Tail returns the last n collected lines of a target, oldest first.
+func (c *Collector) Tail(target string, n int) ([]*jsonlog.JSONLog, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.conf.Enabled {
+		return nil, ErrDisabled
+	}
+	return tailLogFiles(logFileName(c.conf.Dir, target), c.conf.MaxFiles, n)
+}
@@ -0,0 +1,119 @@
+package logcollect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+// tailReadSize is how much of the end of a file is read to find its last line.
+const tailReadSize int64 = 64 * 1024
+
+// logFileName is the file of a target in dir, ids are matched case insensitively.
+func logFileName(dir string, target string) string {
+	name := strings.Replace(strings.ToLower(target), "/", "_", -1)
+	return path.Join(dir, name+".log")
+}
+
+func encodeLine(jl *jsonlog.JSONLog) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jl.MarshalJSONBuf(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// lastLogTime returns the time of the last line of a container near the
+// end of a file, or of the last line if the container has none there.
+func lastLogTime(name string, container string) (time.Time, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	offset := info.Size() - tailReadSize
+	if offset < 0 {
+		offset = 0
+	}
+	dat := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(dat, offset); err != nil && err != io.EOF {
+		return time.Time{}, err
+	}
+	var last time.Time
+	lines := bytes.Split(bytes.TrimRight(dat, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		jl := &jsonlog.JSONLog{}
+		if err := json.Unmarshal(lines[i], jl); err != nil {
+			continue
+		}
+		if jl.Attrs["container"] == container {
+			return jl.Created, nil
+		}
+		if last.IsZero() {
+			last = jl.Created
+		}
+	}
+	return last, nil
+}
+
+// readLogFile reads all lines of a file, skipping any it cannot parse.
+func readLogFile(name string) ([]*jsonlog.JSONLog, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var res []*jsonlog.JSONLog
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		jl := &jsonlog.JSONLog{}
+		if err := json.Unmarshal(scanner.Bytes(), jl); err != nil {
+			continue
+		}
+		res = append(res, jl)
+	}
+	return res, scanner.Err()
+}
+
+// tailLogFiles returns the last n lines of a target, oldest first,
+// reading into rotated files as needed. n < 1 returns everything.
+func tailLogFiles(name string, maxFiles int, n int) ([]*jsonlog.JSONLog, error) {
+	var res []*jsonlog.JSONLog
+	for i := 0; i <= maxFiles; i++ {
+		fname := name
+		if i > 0 {
+			fname = utils.RotatedName(name, i)
+		}
+		lines, err := readLogFile(fname)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return nil, err
+		}
+		res = append(lines, res...)
+		if n > 0 && len(res) >= n {
+			break
+		}
+	}
+	if n > 0 && len(res) > n {
+		res = res[len(res)-n:]
+	}
+	return res, nil
+}
@@ -0,0 +1,125 @@
+package logcollect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+func writeLines(t *testing.T, w *utils.RotatingFile, container string, start int, count int) {
+	for i := start; i < start+count; i++ {
+		line, err := encodeLine(&jsonlog.JSONLog{
+			Log:     fmt.Sprintf("line %d\n", i),
+			Stream:  "stdout",
+			Created: time.Unix(int64(i), 0).UTC(),
+			Attrs:   map[string]string{"container": container},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRotateAndTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logcollect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := logFileName(dir, "MyTarget")
+	if path.Base(name) != "mytarget.log" {
+		t.Fatalf("unexpected file name %s", name)
+	}
+	// Each line is about 100 bytes, rotate every few lines.
+	w, err := utils.OpenRotatingFile(name, 400, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, w, "a", 1, 20)
+	w.Close()
+
+	if _, err := os.Stat(utils.RotatedName(name, 3)); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 rotated files")
+	}
+
+	lines, err := tailLogFiles(name, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines, got %d", len(lines))
+	}
+	for i, jl := range lines {
+		expected := fmt.Sprintf("line %d\n", 16+i)
+		if jl.Log != expected {
+			t.Fatalf("line %d: expected %q, got %q", i, expected, jl.Log)
+		}
+	}
+
+	all, err := tailLogFiles(name, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) >= 20 || all[len(all)-1].Log != "line 20\n" {
+		t.Fatalf("expected the oldest lines to be rotated out, got %d lines", len(all))
+	}
+}
+
+func TestLastLogTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logcollect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := logFileName(dir, "target")
+	w, err := utils.OpenRotatingFile(name, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, w, "a", 1, 3)
+	writeLines(t, w, "b", 4, 2)
+	w.Close()
+
+	if last, _ := lastLogTime(name, "a"); last.Unix() != 3 {
+		t.Fatalf("expected container a to resume at 3, got %d", last.Unix())
+	}
+	if last, _ := lastLogTime(name, "c"); last.Unix() != 5 {
+		t.Fatalf("expected unknown container to resume at 5, got %d", last.Unix())
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var got []string
+	var times []time.Time
+	w := &lineWriter{stream: "stdout", emit: func(stream string, created time.Time, line string) {
+		got = append(got, line)
+		times = append(times, created)
+	}}
+	w.Write([]byte("2017-06-01T10:00:00.5Z hello\n2017-06-01T10:00:01Z wor"))
+	w.Write([]byte("ld\npartial"))
+	w.flush()
+
+	expected := []string{"hello\n", "world\n", "partial\n"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d lines, got %v", len(expected), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("line %d: expected %q, got %q", i, expected[i], got[i])
+		}
+	}
+	if times[0].Nanosecond() != 500000000 || times[1].Second() != 1 {
+		t.Fatalf("timestamps not parsed: %v", times)
+	}
+}
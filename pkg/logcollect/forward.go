@@ -0,0 +1,327 @@
+package logcollect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+	"github.com/fuserobotics/deviced/pkg/utils"
+)
+
+const (
+	// flushPeriod is how often buffered lines are sent.
+	flushPeriod = time.Duration(5) * time.Second
+	// segmentSuffix marks buffer files, named by sequence number.
+	segmentSuffix string = ".jsonl"
+)
+
+// sink is a remote destination for collected lines.
+type sink interface {
+	Send(lines []*jsonlog.JSONLog) error
+	Close() error
+}
+
+func newSink(conf *config.LogForwardConfig) (sink, error) {
+	switch conf.Type {
+	case config.LogForwardSyslog:
+		return &syslogSink{conf: conf}, nil
+	case config.LogForwardHttp:
+		return &httpSink{
+			url:    conf.Address,
+			client: &http.Client{Timeout: time.Duration(30) * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown log forward type %q", conf.Type)
+}
+
+// forwarder appends lines to segment files in the buffer dir and sends
+// complete segments to the sink, so lines survive the sink or the
+// daemon being down.
+type forwarder struct {
+	dir     string
+	maxSize int64
+	sink    sink
+
+	mtx     sync.Mutex
+	current *os.File
+	seq     uint64
+
+	quit chan bool
+	done chan bool
+}
+
+func newForwarder(conf *config.LogForwardConfig, dir string) (*forwarder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s, err := newSink(conf)
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{
+		dir:     dir,
+		maxSize: int64(conf.MaxBufferMB) * 1024 * 1024,
+		sink:    s,
+		quit:    make(chan bool, 1),
+		done:    make(chan bool),
+	}
+	// Continue after the segments left from a previous run.
+	segments, _ := f.segments()
+	if len(segments) != 0 {
+		f.seq = segments[len(segments)-1].seq + 1
+	}
+	return f, nil
+}
+
+type segment struct {
+	seq  uint64
+	name string
+	size int64
+}
+
+type segmentsBySeq []*segment
+
+func (s segmentsBySeq) Len() int           { return len(s) }
+func (s segmentsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s segmentsBySeq) Less(i, j int) bool { return s[i].seq < s[j].seq }
+
+// segments lists the buffer files, oldest first.
+func (f *forwarder) segments() ([]*segment, error) {
+	infos, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res segmentsBySeq
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), segmentSuffix) {
+			continue
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(info.Name(), segmentSuffix), "%d", &seq); err != nil {
+			continue
+		}
+		res = append(res, &segment{seq: seq, name: path.Join(f.dir, info.Name()), size: info.Size()})
+	}
+	sort.Sort(res)
+	return res, nil
+}
+
+// write buffers one encoded line.
+func (f *forwarder) write(line []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.current == nil {
+		name := path.Join(f.dir, fmt.Sprintf("%020d%s", f.seq, segmentSuffix))
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Warnf("Unable to open log buffer %s, %v", name, err)
+			return
+		}
+		f.current = file
+		f.seq++
+	}
+	f.current.Write(line)
+}
+
+// cut closes the current segment so it can be sent.
+func (f *forwarder) cut() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.current != nil {
+		f.current.Close()
+		f.current = nil
+	}
+}
+
+func (f *forwarder) run() {
+	defer close(f.done)
+	backoff := utils.Backoff{Min: flushPeriod, Max: time.Duration(5) * time.Minute}
+	wait := flushPeriod
+	for {
+		select {
+		case <-f.quit:
+			f.cut()
+			f.sink.Close()
+			return
+		case <-time.After(wait):
+		}
+
+		f.cut()
+		if err := f.flush(); err != nil {
+			wait = backoff.Next()
+			log.Warnf("Unable to forward logs, retrying in %s, %v", wait.String(), err)
+			continue
+		}
+		backoff.Reset()
+		wait = flushPeriod
+	}
+}
+
+// closedSegments lists the segments that are no longer written to, oldest first.
+func (f *forwarder) closedSegments() ([]*segment, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	segments, err := f.segments()
+	if err != nil || f.current == nil {
+		return segments, err
+	}
+	// A line written since the last cut opened segment seq-1.
+	res := segments[:0]
+	for _, seg := range segments {
+		if seg.seq != f.seq-1 {
+			res = append(res, seg)
+		}
+	}
+	return res, nil
+}
+
+// flush sends closed segments in order, removing each once sent.
+func (f *forwarder) flush() error {
+	segments, err := f.closedSegments()
+	if err != nil {
+		return err
+	}
+	f.dropOldest(segments)
+	for _, seg := range segments {
+		if _, err := os.Stat(seg.name); os.IsNotExist(err) {
+			continue
+		}
+		lines, err := readLogFile(seg.name)
+		if err != nil {
+			return err
+		}
+		if len(lines) != 0 {
+			if err := f.sink.Send(lines); err != nil {
+				return err
+			}
+		}
+		os.Remove(seg.name)
+	}
+	return nil
+}
+
+// dropOldest removes segments past the buffer size limit.
+func (f *forwarder) dropOldest(segments []*segment) {
+	if f.maxSize < 1 {
+		return
+	}
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+	for _, seg := range segments {
+		if total <= f.maxSize {
+			return
+		}
+		log.Warnf("Log buffer is over %d bytes, dropping %s.", f.maxSize, seg.name)
+		os.Remove(seg.name)
+		total -= seg.size
+	}
+}
+
+func (f *forwarder) close() {
+	f.quit <- true
+	<-f.done
+}
+
+// syslogSink writes each line as a syslog message, stderr lines at error priority.
+type syslogSink struct {
+	conf   *config.LogForwardConfig
+	writer *syslog.Writer
+}
+
+func (s *syslogSink) dial() error {
+	if s.writer != nil {
+		return nil
+	}
+	network, raddr := "", ""
+	if s.conf.Address != "" {
+		u, err := url.Parse(s.conf.Address)
+		if err != nil {
+			return err
+		}
+		network, raddr = u.Scheme, u.Host
+		if network == "unix" || network == "unixgram" {
+			raddr = u.Path
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, s.conf.Tag)
+	if err != nil {
+		return err
+	}
+	s.writer = w
+	return nil
+}
+
+func (s *syslogSink) Send(lines []*jsonlog.JSONLog) error {
+	if err := s.dial(); err != nil {
+		return err
+	}
+	for _, jl := range lines {
+		msg := fmt.Sprintf("%s: %s", jl.Attrs[deviced_id_label], strings.TrimSuffix(jl.Log, "\n"))
+		var err error
+		if jl.Stream == "stderr" {
+			err = s.writer.Err(msg)
+		} else {
+			err = s.writer.Info(msg)
+		}
+		if err != nil {
+			// Reconnect on the next attempt.
+			s.writer.Close()
+			s.writer = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Close()
+}
+
+// httpSink POSTs lines as newline delimited JSON.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Send(lines []*jsonlog.JSONLog) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, jl := range lines {
+		if err := enc.Encode(jl); err != nil {
+			return err
+		}
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
@@ -0,0 +1,65 @@
+package logcollect
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+)
+
+type recordingSink struct {
+	lines []*jsonlog.JSONLog
+}
+
+func (s *recordingSink) Send(lines []*jsonlog.JSONLog) error {
+	s.lines = append(s.lines, lines...)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestFlushSkipsOpenSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logforward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &recordingSink{}
+	f := &forwarder{dir: dir, sink: sink}
+	writeLine := func(msg string) {
+		line, err := encodeLine(&jsonlog.JSONLog{Log: msg, Stream: "stdout", Created: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.write(line)
+	}
+
+	writeLine("first\n")
+	f.cut()
+	// Written after the cut, before the flush lists the segments.
+	writeLine("second\n")
+
+	if err := f.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.lines) != 1 || sink.lines[0].Log != "first\n" {
+		t.Fatalf("expected only the closed segment to be sent, got %d lines", len(sink.lines))
+	}
+
+	f.cut()
+	if err := f.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.lines) != 2 || sink.lines[1].Log != "second\n" {
+		t.Fatalf("expected the second segment after the cut, got %d lines", len(sink.lines))
+	}
+	segments, _ := f.segments()
+	if len(segments) != 0 {
+		t.Fatalf("expected sent segments to be removed, %d left", len(segments))
+	}
+}
@@ -0,0 +1,79 @@
+package logcollect
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// maxLineLength splits very long lines so a runaway container cannot
+// grow the buffer without bound.
+const maxLineLength int = 16 * 1024
+
+type emitFunc func(stream string, created time.Time, line string)
+
+// lineWriter splits a stream written with timestamps into lines.
+type lineWriter struct {
+	stream string
+	emit   emitFunc
+	buf    bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if idx < 0 {
+			if w.buf.Len() > maxLineLength {
+				w.line(string(w.buf.Next(maxLineLength)) + "\n")
+			}
+			return len(p), nil
+		}
+		w.line(string(w.buf.Next(idx + 1)))
+	}
+}
+
+// flush emits a trailing partial line.
+func (w *lineWriter) flush() {
+	if w.buf.Len() != 0 {
+		w.line(w.buf.String() + "\n")
+		w.buf.Reset()
+	}
+}
+
+// line emits one line, parsing the timestamp Docker prefixes it with.
+func (w *lineWriter) line(line string) {
+	created := time.Now()
+	if idx := strings.IndexByte(line, ' '); idx > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[:idx]); err == nil {
+			created = t
+			line = line[idx+1:]
+		}
+	}
+	w.emit(w.stream, created, line)
+}
+
+// copyLogStream reads a ContainerLogs stream until it ends. Streams of
+// containers without a tty are multiplexed.
+func copyLogStream(r io.Reader, tty bool, emit emitFunc) error {
+	stdout := &lineWriter{stream: "stdout", emit: emit}
+	stderr := &lineWriter{stream: "stderr", emit: emit}
+	var err error
+	if tty {
+		_, err = io.Copy(stdout, r)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, r)
+	}
+	stdout.flush()
+	stderr.flush()
+	return err
+}
+
+// formatSince formats a time for the since option of ContainerLogs.
+func formatSince(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
@@ -0,0 +1,112 @@
+// Package logging configures the daemon's structured logger.
+//
+// Packages log through an entry from Component, which adds a "component"
+// field. Other fields in use are "target", "container", "image", "tag"
+// and "registry".
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fuserobotics/deviced/pkg/jsonlog"
+)
+
+// Output formats.
+const (
+	FormatText string = "text"
+	FormatJSON string = "json"
+)
+
+var recent = &ringBuffer{}
+
+func init() {
+	logrus.SetOutput(os.Stderr)
+	// Hooks fire in order, redact before buffering.
+	logrus.AddHook(redactHook{})
+	logrus.AddHook(recent)
+}
+
+// Component returns the logger for a part of the daemon.
+func Component(name string) *logrus.Entry {
+	return logrus.WithField("component", name)
+}
+
+// Validate checks a level and format without applying them.
+func Validate(level string, format string) error {
+	if level != "" {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+}
+
+// Configure applies the level, the output format and the size of the
+// buffer of recent entries, 0 disables the buffer.
+func Configure(level string, format string, bufferSize int) error {
+	if err := SetLevel(level); err != nil {
+		return err
+	}
+	switch format {
+	case "", FormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case FormatJSON:
+		logrus.SetFormatter(&jsonlogFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	recent.Resize(bufferSize)
+	return nil
+}
+
+// SetLevel changes the level at runtime.
+func SetLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+// Level returns the current level.
+func Level() string {
+	return logrus.GetLevel().String()
+}
+
+// Recent returns the buffered entries, oldest first.
+func Recent() []*Entry {
+	return recent.Entries()
+}
+
+// jsonlogFormatter writes one jsonlog.JSONLog per line, fields are kept in attrs.
+type jsonlogFormatter struct{}
+
+func (f *jsonlogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	attrs := map[string]string{"level": entry.Level.String()}
+	for k, v := range entry.Data {
+		attrs[k] = fmt.Sprint(v)
+	}
+	jl := &jsonlog.JSONLog{
+		Log:     entry.Message + "\n",
+		Stream:  "stderr",
+		Created: entry.Time,
+		Attrs:   attrs,
+	}
+	dat, err := json.Marshal(jl)
+	if err != nil {
+		return nil, err
+	}
+	return append(dat, '\n'), nil
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fuserobotics/deviced/pkg/redact"
+)
+
+// redactHook replaces secret values in the message and fields before the
+// entry is buffered or written.
+type redactHook struct{}
+
+func (h redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact.String(entry.Message)
+	var data logrus.Fields
+	for k, v := range entry.Data {
+		s := fmt.Sprint(v)
+		r := redact.String(s)
+		if r == s {
+			continue
+		}
+		// Data may be shared with the parent entry, copy before changing it.
+		if data == nil {
+			data = make(logrus.Fields, len(entry.Data))
+			for dk, dv := range entry.Data {
+				data[dk] = dv
+			}
+		}
+		data[k] = r
+	}
+	if data != nil {
+		entry.Data = data
+	}
+	return nil
+}
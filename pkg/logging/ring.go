@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Entry is a buffered log entry.
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// ringBuffer is a logrus hook keeping the most recent entries.
+type ringBuffer struct {
+	mtx     sync.Mutex
+	entries []*Entry
+	next    int
+	full    bool
+}
+
+// Resize sets the number of entries kept, dropping the buffered ones.
+func (r *ringBuffer) Resize(size int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if size < 0 {
+		size = 0
+	}
+	if size == len(r.entries) {
+		return
+	}
+	r.entries = make([]*Entry, size)
+	r.next = 0
+	r.full = false
+}
+
+func (r *ringBuffer) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *ringBuffer) Fire(entry *logrus.Entry) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if len(r.entries) == 0 {
+		return nil
+	}
+	e := &Entry{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	if len(entry.Data) != 0 {
+		e.Fields = make(map[string]string)
+		for k, v := range entry.Data {
+			e.Fields[k] = fmt.Sprint(v)
+		}
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	return nil
+}
+
+// Entries returns a copy of the buffered entries, oldest first.
+func (r *ringBuffer) Entries() []*Entry {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if !r.full {
+		return append([]*Entry(nil), r.entries[:r.next]...)
+	}
+	res := append([]*Entry(nil), r.entries[r.next:]...)
+	return append(res, r.entries[:r.next]...)
+}
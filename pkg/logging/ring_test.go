@@ -0,0 +1,27 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestRingBuffer(t *testing.T) {
+	r := &ringBuffer{}
+	r.Resize(3)
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		r.Fire(&logrus.Entry{Message: msg, Data: logrus.Fields{"target": "nav"}})
+	}
+	entries := r.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, msg := range []string{"b", "c", "d"} {
+		if entries[i].Message != msg {
+			t.Fatalf("entry %d: expected %s got %s", i, msg, entries[i].Message)
+		}
+	}
+	if entries[0].Fields["target"] != "nav" {
+		t.Fatal("expected fields to be kept")
+	}
+}
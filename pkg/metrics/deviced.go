@@ -0,0 +1,40 @@
+package metrics
+
+// Default is the registry served at /metrics.
+var Default = NewRegistry()
+
+// Worker label values of the reconcile metrics.
+const (
+	WorkerContainer string = "container"
+	WorkerImage     string = "image"
+	WorkerNetwork   string = "network"
+)
+
+var (
+	ReconcileDuration = Default.NewHistogram("deviced_reconcile_duration_seconds",
+		"Duration of reconcile passes.", DurationBuckets, "worker")
+	ReconcileTotal = Default.NewCounter("deviced_reconcile_total",
+		"Number of reconcile passes.", "worker")
+
+	PullBytes = Default.NewCounter("deviced_pull_bytes_total",
+		"Bytes downloaded by image pulls.", "registry")
+	PullDuration = Default.NewHistogram("deviced_pull_duration_seconds",
+		"Duration of successful image pulls.", DurationBuckets, "registry")
+	PullFailures = Default.NewCounter("deviced_pull_failures_total",
+		"Number of failed image pulls.", "registry")
+
+	ContainerRestarts = Default.NewCounter("deviced_container_restarts_total",
+		"Number of exited containers restarted.", "target")
+	ContainerReplacements = Default.NewCounter("deviced_container_replacements_total",
+		"Number of containers replaced with a different version.", "target")
+	VersionScore = Default.NewGauge("deviced_version_score",
+		"Version score of the running container, lower is better.", "target")
+
+	HookDuration = Default.NewHistogram("deviced_hook_duration_seconds",
+		"Duration of lifecycle hook runs.", DurationBuckets, "target", "phase")
+	HookFailures = Default.NewCounter("deviced_hook_failures_total",
+		"Number of failed lifecycle hook runs.", "target", "phase")
+
+	DockerErrors = Default.NewCounter("deviced_docker_api_errors_total",
+		"Number of failed Docker API calls.", "operation")
+)
@@ -0,0 +1,238 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter   string = "counter"
+	kindGauge     string = "gauge"
+	kindHistogram string = "histogram"
+)
+
+// DurationBuckets are histogram bounds in seconds, from 10ms to 10 minutes.
+var DurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600}
+
+// Registry holds the metrics of the daemon.
+type Registry struct {
+	mtx     sync.Mutex
+	metrics []*vec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// series is one set of label values of a metric.
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only, counts per bucket are not cumulative
+	buckets []uint64
+	count   uint64
+}
+
+type vec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mtx    sync.Mutex
+	series map[string]*series
+}
+
+func (r *Registry) add(name string, help string, kind string, buckets []float64, labels []string) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.mtx.Lock()
+	r.metrics = append(r.metrics, v)
+	r.mtx.Unlock()
+	return v
+}
+
+// get returns the series for the label values, adding it if missing.
+// The caller must hold v.mtx.
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if v.kind == kindHistogram {
+			s.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Counter only goes up.
+type Counter struct{ v *vec }
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{v: r.add(name, help, kindCounter, nil, labels)}
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.v.mtx.Lock()
+	defer c.v.mtx.Unlock()
+	c.v.get(labelValues).value += delta
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value that is set.
+type Gauge struct{ v *vec }
+
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{v: r.add(name, help, kindGauge, nil, labels)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.v.mtx.Lock()
+	defer g.v.mtx.Unlock()
+	g.v.get(labelValues).value = value
+}
+
+// Delete drops the series, e.g. for a target removed from the config.
+func (g *Gauge) Delete(labelValues ...string) {
+	g.v.mtx.Lock()
+	defer g.v.mtx.Unlock()
+	delete(g.v.series, strings.Join(labelValues, "\xff"))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct{ v *vec }
+
+// NewHistogram registers a histogram, buckets are upper bounds in increasing order.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{v: r.add(name, help, kindHistogram, buckets, labels)}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.v.mtx.Lock()
+	defer h.v.mtx.Unlock()
+	s := h.v.get(labelValues)
+	for i, bound := range h.v.buckets {
+		if value <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mtx.Lock()
+	metrics := append([]*vec(nil), r.metrics...)
+	r.mtx.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, v := range metrics {
+		v.writeText(bw)
+	}
+	return bw.Flush()
+}
+
+type seriesByLabels []*series
+
+func (s seriesByLabels) Len() int      { return len(s) }
+func (s seriesByLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s seriesByLabels) Less(i, j int) bool {
+	return strings.Join(s[i].labelValues, "\xff") < strings.Join(s[j].labelValues, "\xff")
+}
+
+func (v *vec) writeText(w *bufio.Writer) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	all := make(seriesByLabels, 0, len(v.series))
+	for _, s := range v.series {
+		all = append(all, s)
+	}
+	sort.Sort(all)
+
+	for _, s := range all {
+		if v.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelText(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelText(s.labelValues, formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelText(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelText(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelText(s.labelValues, ""), s.count)
+	}
+}
+
+// labelText formats the label set, le is added for histogram buckets.
+func (v *vec) labelText(labelValues []string, le string) string {
+	var pairs []string
+	for i, name := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(labelValues[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.", "target")
+	g := r.NewGauge("test_score", "A gauge.")
+	h := r.NewHistogram("test_seconds", "A histogram.", []float64{1, 5}, "worker")
+
+	c.Inc("b")
+	c.Add(2, "a")
+	c.Inc("quo\"te")
+	g.Set(3.5)
+	h.Observe(0.5, "x")
+	h.Observe(2, "x")
+	h.Observe(10, "x")
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{target="a"} 2
+test_total{target="b"} 1
+test_total{target="quo\"te"} 1
+# HELP test_score A gauge.
+# TYPE test_score gauge
+test_score 3.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{worker="x",le="1"} 1
+test_seconds_bucket{worker="x",le="5"} 2
+test_seconds_bucket{worker="x",le="+Inf"} 3
+test_seconds_sum{worker="x"} 12.5
+test_seconds_count{worker="x"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestGaugeDelete(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("test_score", "A gauge.", "target")
+	g.Set(1, "a")
+	g.Delete("a")
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	expected := "# HELP test_score A gauge.\n# TYPE test_score gauge\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestCounterIgnoresNegative(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	c.Add(-1)
+	c.Inc()
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	expected := "# HELP test_total A counter.\n# TYPE test_total counter\ntest_total 1\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
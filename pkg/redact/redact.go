@@ -0,0 +1,62 @@
+// Package redact hides known secret values in text shown to users.
+//
+// Secrets are added when they are resolved, everything that leaves the
+// daemon (log entries, the status and config API, the audit log) is passed
+// through String.
+package redact
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Placeholder replaces secret values.
+const Placeholder string = "<redacted>"
+
+// minLength is the shortest value redacted, shorter values would mangle
+// unrelated text.
+const minLength int = 4
+
+var (
+	mtx    sync.RWMutex
+	values []string
+)
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// Add registers a secret value.
+func Add(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minLength {
+		return
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	for _, v := range values {
+		if v == value {
+			return
+		}
+	}
+	values = append(values, value)
+	// Longest first, so a secret containing another is replaced whole.
+	sort.Sort(byLength(values))
+}
+
+// String replaces every registered secret in s.
+func String(s string) string {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	for _, v := range values {
+		if strings.Contains(s, v) {
+			s = strings.Replace(s, v, Placeholder, -1)
+		}
+	}
+	return s
+}
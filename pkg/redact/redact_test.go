@@ -0,0 +1,19 @@
+package redact
+
+import "testing"
+
+func TestString(t *testing.T) {
+	Add("abc")
+	Add("s3cret")
+	Add("s3cret-token")
+	cases := map[string]string{
+		"abc is too short to redact": "abc is too short to redact",
+		"password s3cret":            "password " + Placeholder,
+		"token=s3cret-token;":        "token=" + Placeholder + ";",
+	}
+	for in, expected := range cases {
+		if out := String(in); out != expected {
+			t.Fatalf("%q: expected %q, got %q", in, expected, out)
+		}
+	}
+}
@@ -219,6 +219,16 @@ func newIndexInfo(config *serviceConfig, indexName string) (*registrytypes.Index
 	return index, nil
 }
 
+// IndexInfoForHost returns the index info of a registry host[:port], the
+// Docker Hub hosts map to the official index.
+func IndexInfoForHost(host string) (*registrytypes.IndexInfo, error) {
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		host = IndexName
+	}
+	return newIndexInfo(emptyServiceConfig, host)
+}
+
 // GetAuthConfigKey special-cases using the full index address of the official
 // index as the AuthConfig key, and uses the (host)name[:port] for private indexes.
 func GetAuthConfigKey(index *registrytypes.IndexInfo) string {
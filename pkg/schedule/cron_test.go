@@ -0,0 +1,52 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// 2017-03-06 is a Monday.
+	from := time.Date(2017, 3, 6, 10, 30, 0, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2017, 3, 6, 10, 45, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2017, 3, 6, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * sun", time.Date(2017, 3, 12, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 jan-jun *", time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * mon-fri", time.Date(2017, 3, 6, 13, 0, 0, 0, time.UTC)},
+		// day of month and day of week restricted: either matches
+		{"0 0 13 * fri", time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		if next := s.Next(from); !next.Equal(c.next) {
+			t.Fatalf("%s: expected %s, got %s", c.expr, c.next, next)
+		}
+	}
+}
+
+func TestScheduleParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("expected %q to fail to parse", expr)
+		}
+	}
+}
+
+func TestScheduleNeverMatches(t *testing.T) {
+	s, err := Parse("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Fatalf("expected no match, got %s", next)
+	}
+}
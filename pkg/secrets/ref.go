@@ -0,0 +1,112 @@
+// Package secrets resolves secret references in the config and keeps an
+// encrypted secret store on the device.
+//
+// A reference is file:/path, env:NAME or store:name. Resolved values are
+// registered with pkg/redact so they never show up in logs or the API.
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/fuserobotics/deviced/pkg/redact"
+)
+
+// Reference kinds.
+const (
+	KindFile  string = "file"
+	KindEnv   string = "env"
+	KindStore string = "store"
+)
+
+// namePattern matches store and container secret names, which are used as file names.
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+// ValidName checks a store or container secret name.
+func ValidName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q, expected letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// Ref is a parsed secret reference.
+type Ref struct {
+	Kind string
+	// Path, variable or store name
+	Name string
+}
+
+// ParseRef parses file:/path, env:NAME or store:name.
+func ParseRef(ref string) (*Ref, error) {
+	idx := strings.Index(ref, ":")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid secret reference %q, expected file:, env: or store:", ref)
+	}
+	r := &Ref{Kind: ref[:idx], Name: ref[idx+1:]}
+	switch r.Kind {
+	case KindFile:
+		if !strings.HasPrefix(r.Name, "/") {
+			return nil, fmt.Errorf("invalid secret reference %q, the path must be absolute", ref)
+		}
+	case KindEnv:
+		if r.Name == "" {
+			return nil, fmt.Errorf("invalid secret reference %q, missing variable name", ref)
+		}
+	case KindStore:
+		if err := ValidName(r.Name); err != nil {
+			return nil, fmt.Errorf("invalid secret reference %q, %v", ref, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid secret reference %q, unknown kind %s", ref, r.Kind)
+	}
+	return r, nil
+}
+
+func (r *Ref) String() string {
+	return r.Kind + ":" + r.Name
+}
+
+// Resolve returns the value of a reference and registers it for redaction.
+// The store may be nil, store: references then fail.
+func (s *Store) Resolve(ref string) ([]byte, error) {
+	r, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	switch r.Kind {
+	case KindFile:
+		val, err = ioutil.ReadFile(r.Name)
+	case KindEnv:
+		v, ok := os.LookupEnv(r.Name)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", r.Name)
+		}
+		val = []byte(v)
+	case KindStore:
+		if s == nil {
+			err = fmt.Errorf("secret %s: the secret store is not available", r.Name)
+		} else {
+			val, err = s.Get(r.Name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	redact.Add(string(val))
+	return val, nil
+}
+
+// ResolveString resolves a reference to a single line value such as a
+// password, dropping a trailing newline.
+func (s *Store) ResolveString(ref string) (string, error) {
+	val, err := s.Resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(val), "\r\n"), nil
+}
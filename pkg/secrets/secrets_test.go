@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fuserobotics/deviced/pkg/redact"
+)
+
+func TestParseRef(t *testing.T) {
+	for _, ref := range []string{"file:/etc/deviced/pw", "env:REGISTRY_PASSWORD", "store:registry"} {
+		r, err := ParseRef(ref)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", ref, err)
+		}
+		if r.String() != ref {
+			t.Fatalf("expected %s, got %s", ref, r.String())
+		}
+	}
+	for _, ref := range []string{"", "registry", "file:pw", "env:", "store:../pw", "vault:pw"} {
+		if _, err := ParseRef(ref); err == nil {
+			t.Fatalf("expected %q to be invalid", ref)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenStore(dir, "machine-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("registry", []byte("hunter22")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("api-token", []byte("t0ken")); err != nil {
+		t.Fatal(err)
+	}
+	if dat, _ := ioutil.ReadFile(path.Join(dir, "registry"+secretSuffix)); strings.Contains(string(dat), "hunter22") {
+		t.Fatal("secret stored in the clear")
+	}
+
+	// Reopened on the same device
+	s, err = OpenStore(dir, "machine-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := s.Get("registry")
+	if err != nil || string(val) != "hunter22" {
+		t.Fatalf("expected hunter22, got %q %v", val, err)
+	}
+	names, _ := s.Names()
+	if !reflect.DeepEqual(names, []string{"api-token", "registry"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	// Copied to another device
+	other, err := OpenStore(dir, "machine-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get("registry"); err == nil {
+		t.Fatal("expected the secret to be unreadable with another machine id")
+	}
+
+	if err := s.Delete("registry"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("registry"); err == nil || !strings.Contains(err.Error(), ErrNotFound.Error()) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwFile := path.Join(dir, "pw")
+	ioutil.WriteFile(pwFile, []byte("from-a-file\n"), 0600)
+	os.Setenv("DEVICED_TEST_SECRET", "from-the-env")
+	defer os.Unsetenv("DEVICED_TEST_SECRET")
+
+	var s *Store
+	if val, err := s.ResolveString("file:" + pwFile); err != nil || val != "from-a-file" {
+		t.Fatalf("expected from-a-file, got %q %v", val, err)
+	}
+	if val, err := s.ResolveString("env:DEVICED_TEST_SECRET"); err != nil || val != "from-the-env" {
+		t.Fatalf("expected from-the-env, got %q %v", val, err)
+	}
+	if _, err := s.Resolve("store:registry"); err == nil {
+		t.Fatal("expected store references to fail without a store")
+	}
+	if out := redact.String("password is from-the-env"); out != "password is "+redact.Placeholder {
+		t.Fatalf("expected the resolved value to be redacted, got %q", out)
+	}
+}
@@ -0,0 +1,169 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+)
+
+// secretSuffix marks the encrypted secret files in the store dir.
+const secretSuffix string = ".secret"
+
+// saltSize is the size of the random salt mixed into the key.
+const saltSize int = 32
+
+// ErrNotFound is returned for a secret that is not in the store.
+var ErrNotFound = errors.New("secret not found")
+
+// Store keeps secrets encrypted with AES-GCM in a directory. The key is
+// derived from the machine id and a random salt in the dir, so a copy of
+// the dir is useless on another device.
+type Store struct {
+	Dir string
+
+	mtx  sync.Mutex
+	aead cipher.AEAD
+}
+
+// OpenStore opens the store in dir, creating it and its salt if needed.
+func OpenStore(dir string, machineId string) (*Store, error) {
+	if machineId == "" {
+		return nil, errors.New("the secret store needs a machine id")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+	salt, err := readSalt(path.Join(dir, "salt"))
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(machineId))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir, aead: aead}, nil
+}
+
+func readSalt(name string) ([]byte, error) {
+	salt, err := ioutil.ReadFile(name)
+	if err == nil {
+		if len(salt) != saltSize {
+			return nil, fmt.Errorf("corrupt salt %s", name)
+		}
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if err := ioutils.AtomicWriteFile(name, salt, 0600); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func (s *Store) secretPath(name string) string {
+	return path.Join(s.Dir, name+secretSuffix)
+}
+
+// Set stores a secret, replacing any with the same name.
+func (s *Store) Set(name string, value []byte) error {
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	// The name is authenticated so secret files can not be swapped.
+	dat := s.aead.Seal(nonce, nonce, value, []byte(name))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return ioutils.AtomicWriteFile(s.secretPath(name), dat, 0600)
+}
+
+// Get decrypts a secret.
+func (s *Store) Get(name string) ([]byte, error) {
+	if err := ValidName(name); err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	dat, err := ioutil.ReadFile(s.secretPath(name))
+	s.mtx.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("secret %s: %v", name, ErrNotFound)
+		}
+		return nil, err
+	}
+	size := s.aead.NonceSize()
+	if len(dat) < size {
+		return nil, fmt.Errorf("secret %s is corrupt", name)
+	}
+	val, err := s.aead.Open(nil, dat[:size], dat[size:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt secret %s, was the store copied from another device?", name)
+	}
+	return val, nil
+}
+
+// Delete removes a secret.
+func (s *Store) Delete(name string) error {
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := os.Remove(s.secretPath(name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("secret %s: %v", name, ErrNotFound)
+	}
+	return err
+}
+
+// Names lists the stored secrets in name order.
+func (s *Store) Names() ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() && strings.HasSuffix(name, secretSuffix) {
+			names = append(names, strings.TrimSuffix(name, secretSuffix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,32 @@
+// +build linux
+
+package secrets
+
+import (
+	"os"
+	"syscall"
+)
+
+// tmpfsMagic is the statfs type of a tmpfs.
+const tmpfsMagic int64 = 0x01021994
+
+// IsTmpfs checks if dir is on a tmpfs.
+func IsTmpfs(dir string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false, err
+	}
+	return int64(st.Type) == tmpfsMagic, nil
+}
+
+// EnsureTmpfs creates dir and mounts a tmpfs on it unless it is on one
+// already, so secret files never reach the disk.
+func EnsureTmpfs(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if ok, err := IsTmpfs(dir); err != nil || ok {
+		return err
+	}
+	return syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0700")
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package secrets
+
+import "errors"
+
+// IsTmpfs fails, secret files are only written to a tmpfs.
+func IsTmpfs(dir string) (bool, error) {
+	return false, errors.New("secret files need a tmpfs, which is only supported on linux")
+}
+
+// EnsureTmpfs fails, secret files are only written to a tmpfs.
+func EnsureTmpfs(dir string) error {
+	return errors.New("secret files need a tmpfs, which is only supported on linux")
+}
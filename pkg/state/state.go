@@ -10,5 +10,7 @@ type RunningContainer struct {
 	Image        string         `yaml:"image"`
 	ImageTag     string         `yaml:"imageTag"`
 	Score        uint           `yaml:"score,omitempty"`
+	Replica      int            `yaml:"replica,omitempty"`
+	Generation   int            `yaml:"generation,omitempty"`
 	ApiContainer *dct.Container `yaml:"apiContainer"`
 }
@@ -0,0 +1,290 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/config"
+	"github.com/fuserobotics/deviced/pkg/redact"
+)
+
+// TargetStatus is the last observed state of a target container.
+type TargetStatus struct {
+	DevicedID string `json:"devicedId"`
+	Kind      string `json:"kind"`
+	// Config file the target is defined in
+	Source      string `json:"source,omitempty"`
+	ContainerID string `json:"containerId,omitempty"`
+	// Docker state of the container when last listed, e.g. running or exited
+	State    string `json:"state,omitempty"`
+	Image    string `json:"image,omitempty"`
+	ImageTag string `json:"imageTag,omitempty"`
+	// A better tag is available but replacement is not allowed yet
+	PendingTag    string `json:"pendingTag,omitempty"`
+	PendingReason string `json:"pendingReason,omitempty"`
+	Held          bool   `json:"held,omitempty"`
+	// Why the container cannot be created yet, such as a missing network
+	Blocked string `json:"blocked,omitempty"`
+	// No suitable image is available locally yet, e.g. while it is pulled
+	WaitingForImage bool `json:"waitingForImage,omitempty"`
+	// Most recent hook runs, oldest first
+	Hooks []*HookStatus `json:"hooks,omitempty"`
+	// Last finished run of a job
+	LastJob *JobResult `json:"lastJob,omitempty"`
+	// Scheduled targets only
+	NextRun    *time.Time   `json:"nextRun,omitempty"`
+	RunHistory []*JobResult `json:"runHistory,omitempty"`
+	// Managed volumes used by the target
+	Volumes []string `json:"volumes,omitempty"`
+	// Services with more than one replica
+	Replicas []*ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// Unhealthy returns why the target is unhealthy, or an empty string.
+func (ts *TargetStatus) Unhealthy() string {
+	if ts.Blocked != "" {
+		return "blocked, " + ts.Blocked
+	}
+	if ts.LastJob != nil && !ts.LastJob.Success {
+		return fmt.Sprintf("last run failed with exit code %d", ts.LastJob.ExitCode)
+	}
+	if ts.Kind != config.TargetKindService {
+		return ""
+	}
+	if ts.ContainerID == "" {
+		return "no container"
+	}
+	switch ts.State {
+	case "exited", "dead", "restarting":
+		return "container " + ts.State
+	}
+	return ""
+}
+
+// ReplicaStatus is the observed state of one replica of a service.
+type ReplicaStatus struct {
+	Index       int    `json:"index"`
+	ContainerID string `json:"containerId,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ImageTag    string `json:"imageTag,omitempty"`
+	Generation  int    `json:"generation"`
+	PendingTag  string `json:"pendingTag,omitempty"`
+}
+
+// Replica returns the status of a replica, adding it if missing.
+func (ts *TargetStatus) Replica(index int) *ReplicaStatus {
+	for _, rs := range ts.Replicas {
+		if rs.Index == index {
+			return rs
+		}
+	}
+	rs := &ReplicaStatus{Index: index}
+	ts.Replicas = append(ts.Replicas, rs)
+	return rs
+}
+
+// HookStatus is the outcome of a lifecycle hook run.
+type HookStatus struct {
+	Time        time.Time `json:"time"`
+	Phase       string    `json:"phase"`
+	Index       int       `json:"index"`
+	ContainerID string    `json:"containerId,omitempty"`
+	Success     bool      `json:"success"`
+	ExitCode    int       `json:"exitCode"`
+	Output      string    `json:"output,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Event is a notable action taken by the daemon.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Target  string    `json:"target,omitempty"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+const (
+	maxHookHistory int = 10
+	maxEvents      int = 100
+)
+
+// StatusSnapshot is a copy of the status safe to serialize.
+type StatusSnapshot struct {
+	Updated    time.Time                `json:"updated"`
+	GlobalHold bool                     `json:"globalHold"`
+	Targets    map[string]*TargetStatus `json:"targets"`
+}
+
+// Status is shared between the workers and the API.
+type Status struct {
+	mtx         sync.Mutex
+	updated     time.Time
+	globalHold  bool
+	targetHolds map[string]bool
+	// Keeps the holds across restarts, may be nil
+	store   *Store
+	targets map[string]*TargetStatus
+	hooks   map[string][]*HookStatus
+	events  []*Event
+}
+
+func NewStatus() *Status {
+	return &Status{
+		targetHolds: make(map[string]bool),
+		targets:     make(map[string]*TargetStatus),
+		hooks:       make(map[string][]*HookStatus),
+	}
+}
+
+// PersistHolds restores the holds kept in store and saves later changes to it.
+func (s *Status) PersistHolds(store *Store) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.store = store
+	var targets []string
+	s.globalHold, targets = store.Holds()
+	for _, target := range targets {
+		s.targetHolds[strings.ToLower(target)] = true
+	}
+}
+
+// SetHold sets or clears the replacement hold. An empty target is the global hold.
+// Target ids are matched ignoring case, like everywhere else.
+// The hold applies even if it could not be persisted.
+func (s *Status) SetHold(target string, held bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	target = strings.ToLower(target)
+	if target == "" {
+		s.globalHold = held
+	} else if held {
+		s.targetHolds[target] = true
+	} else {
+		delete(s.targetHolds, target)
+	}
+	if s.store == nil {
+		return nil
+	}
+	return s.store.SetHold(target, held)
+}
+
+// IsHeld checks if replacements are held for the target, globally or individually.
+func (s *Status) IsHeld(target string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.globalHold || s.targetHolds[strings.ToLower(target)]
+}
+
+// SetTargets replaces the target list after a reconcile pass.
+func (s *Status) SetTargets(targets map[string]*TargetStatus) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.targets = targets
+	s.updated = time.Now()
+}
+
+// UpdateTargets replaces the status of the given targets only.
+func (s *Status) UpdateTargets(targets map[string]*TargetStatus) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for id, ts := range targets {
+		s.targets[id] = ts
+	}
+	s.updated = time.Now()
+}
+
+// RecordHook keeps the result of a hook run for the target.
+func (s *Status) RecordHook(target string, hs *HookStatus) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hooks := append(s.hooks[target], hs)
+	if len(hooks) > maxHookHistory {
+		hooks = hooks[len(hooks)-maxHookHistory:]
+	}
+	s.hooks[target] = hooks
+}
+
+// AddEvent appends to the recent events list.
+func (s *Status) AddEvent(target string, eventType string, message string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.events = append(s.events, &Event{
+		Time:    time.Now(),
+		Target:  target,
+		Type:    eventType,
+		Message: message,
+	})
+	if len(s.events) > maxEvents {
+		s.events = s.events[len(s.events)-maxEvents:]
+	}
+}
+
+// Events returns a copy of the recent events, oldest first.
+func (s *Status) Events() []*Event {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	events := make([]*Event, len(s.events))
+	for i, ev := range s.events {
+		evc := *ev
+		evc.Message = redact.String(evc.Message)
+		events[i] = &evc
+	}
+	return events
+}
+
+func (s *Status) Snapshot() *StatusSnapshot {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	snap := &StatusSnapshot{
+		Updated:    s.updated,
+		GlobalHold: s.globalHold,
+		Targets:    make(map[string]*TargetStatus),
+	}
+	for id, ts := range s.targets {
+		tsc := *ts
+		tsc.Held = s.globalHold || s.targetHolds[id]
+		tsc.Hooks = append([]*HookStatus(nil), s.hooks[id]...)
+		tsc.redact()
+		snap.Targets[id] = &tsc
+	}
+	return snap
+}
+
+// redact replaces secrets in the free text of a copied status.
+func (ts *TargetStatus) redact() {
+	ts.PendingReason = redact.String(ts.PendingReason)
+	ts.Blocked = redact.String(ts.Blocked)
+	for i, hs := range ts.Hooks {
+		hsc := *hs
+		hsc.Output = redact.String(hsc.Output)
+		hsc.Error = redact.String(hsc.Error)
+		ts.Hooks[i] = &hsc
+	}
+	if ts.LastJob != nil {
+		ts.LastJob = ts.LastJob.redacted()
+	}
+	if len(ts.RunHistory) != 0 {
+		history := make([]*JobResult, len(ts.RunHistory))
+		for i, res := range ts.RunHistory {
+			history[i] = res.redacted()
+		}
+		ts.RunHistory = history
+	}
+}
+
+func (r *JobResult) redacted() *JobResult {
+	rc := *r
+	rc.LogTail = redact.String(rc.LogTail)
+	return &rc
+}
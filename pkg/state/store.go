@@ -0,0 +1,188 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/deviced/pkg/ioutils"
+)
+
+// JobResult is the outcome of a one-shot job run.
+type JobResult struct {
+	DevicedID   string    `json:"devicedId"`
+	Image       string    `json:"image"`
+	ImageTag    string    `json:"imageTag"`
+	RunKey      string    `json:"runKey"`
+	ContainerID string    `json:"containerId,omitempty"`
+	Started     time.Time `json:"started,omitempty"`
+	Finished    time.Time `json:"finished"`
+	ExitCode    int       `json:"exitCode"`
+	Success     bool      `json:"success"`
+	LogTail     string    `json:"logTail,omitempty"`
+}
+
+type storeData struct {
+	Jobs map[string]*JobResult `json:"jobs"`
+	// Results of scheduled runs, oldest first
+	Runs map[string][]*JobResult `json:"runs"`
+	// Time of the last scheduled run per target
+	LastScheduled map[string]time.Time `json:"lastScheduled"`
+	// Replacement holds set through the API
+	GlobalHold  bool            `json:"globalHold,omitempty"`
+	TargetHolds map[string]bool `json:"targetHolds,omitempty"`
+}
+
+func (d *storeData) init() {
+	if d.Jobs == nil {
+		d.Jobs = make(map[string]*JobResult)
+	}
+	if d.Runs == nil {
+		d.Runs = make(map[string][]*JobResult)
+	}
+	if d.LastScheduled == nil {
+		d.LastScheduled = make(map[string]time.Time)
+	}
+	if d.TargetHolds == nil {
+		d.TargetHolds = make(map[string]bool)
+	}
+}
+
+// Store persists state that must survive a restart, as JSON on disk.
+type Store struct {
+	Path string
+
+	mtx  sync.Mutex
+	data storeData
+}
+
+// OpenStore loads the store at storePath, starting empty if it does not exist.
+func OpenStore(storePath string) (*Store, error) {
+	s := &Store{Path: storePath}
+	s.data.init()
+
+	if err := os.MkdirAll(path.Dir(storePath), 0755); err != nil {
+		return nil, err
+	}
+	dat, err := ioutil.ReadFile(storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(dat, &s.data); err != nil {
+		return nil, err
+	}
+	s.data.init()
+	return s, nil
+}
+
+// save must be called with mtx locked.
+func (s *Store) save() error {
+	dat, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(s.Path, dat, 0600)
+}
+
+func (s *Store) JobResult(devicedID string) *JobResult {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res, ok := s.data.Jobs[devicedID]
+	if !ok {
+		return nil
+	}
+	resc := *res
+	return &resc
+}
+
+func (s *Store) SetJobResult(res *JobResult) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	resc := *res
+	s.data.Jobs[res.DevicedID] = &resc
+	return s.save()
+}
+
+// AppendRunResult adds a scheduled run result, keeping the last limit results.
+func (s *Store) AppendRunResult(res *JobResult, limit int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	resc := *res
+	runs := append(s.data.Runs[res.DevicedID], &resc)
+	if limit > 0 && len(runs) > limit {
+		runs = runs[len(runs)-limit:]
+	}
+	s.data.Runs[res.DevicedID] = runs
+	return s.save()
+}
+
+// RunHistory returns the retained scheduled run results, oldest first.
+func (s *Store) RunHistory(devicedID string) []*JobResult {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var runs []*JobResult
+	for _, res := range s.data.Runs[devicedID] {
+		resc := *res
+		runs = append(runs, &resc)
+	}
+	return runs
+}
+
+func (s *Store) LastScheduled(devicedID string) (time.Time, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	t, ok := s.data.LastScheduled[devicedID]
+	return t, ok
+}
+
+func (s *Store) SetLastScheduled(devicedID string, t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.data.LastScheduled[devicedID] = t
+	return s.save()
+}
+
+// Holds returns the global hold and the held targets.
+func (s *Store) Holds() (bool, []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var targets []string
+	for target := range s.data.TargetHolds {
+		targets = append(targets, target)
+	}
+	return s.data.GlobalHold, targets
+}
+
+// SetHold sets or clears a replacement hold. An empty target is the global hold.
+func (s *Store) SetHold(target string, held bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if target == "" {
+		s.data.GlobalHold = held
+	} else if held {
+		s.data.TargetHolds[target] = true
+	} else {
+		// Holds may have been kept with another case.
+		for name := range s.data.TargetHolds {
+			if strings.EqualFold(name, target) {
+				delete(s.data.TargetHolds, name)
+			}
+		}
+	}
+	return s.save()
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "time"
+
+// Backoff is an exponential delay between Min and Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	current time.Duration
+}
+
+// Next returns the delay to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	if b.current < b.Min {
+		b.current = b.Min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.Max {
+		b.current = b.Max
+	}
+	return b.current
+}
+
+// Reset starts again from Min.
+func (b *Backoff) Reset() {
+	b.current = 0
+}
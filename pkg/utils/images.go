@@ -34,3 +34,12 @@ func ParseImageAndTag(imagestr string) (string, string) {
 	}
 	return image, imageTag
 }
+
+func StringSliceContains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// machineIdPaths are checked in order for the machine id.
+var machineIdPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// MachineId returns the systemd / dbus machine id of the device.
+func MachineId() (string, error) {
+	for _, name := range machineIdPaths {
+		dat, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(dat)); id != "" {
+			return id, nil
+		}
+	}
+	return "", errors.New("no machine id in /etc/machine-id or /var/lib/dbus/machine-id")
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// RotatedName is the name of the nth rotated file, name.1 is the newest.
+func RotatedName(name string, n int) string {
+	return fmt.Sprintf("%s.%d", name, n)
+}
+
+// RotatingFile appends to a file, rotating it once it reaches a size.
+type RotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens name for appending. A maxSize < 1 never rotates,
+// maxFiles is the number of rotated files kept.
+func OpenRotatingFile(name string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	w := &RotatingFile{name: name, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingFile) open() error {
+	file, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if it would not fit.
+func (w *RotatingFile) Write(p []byte) (int, error) {
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate shifts name.1 to name.2 and so on, dropping files past maxFiles.
+func (w *RotatingFile) rotate() error {
+	w.file.Close()
+	if w.maxFiles < 1 {
+		os.Remove(w.name)
+	} else {
+		os.Remove(RotatedName(w.name, w.maxFiles))
+		for n := w.maxFiles - 1; n > 0; n-- {
+			os.Rename(RotatedName(w.name, n), RotatedName(w.name, n+1))
+		}
+		if err := os.Rename(w.name, RotatedName(w.name, 1)); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+func (w *RotatingFile) Close() error {
+	return w.file.Close()
+}